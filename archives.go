@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+ * Archives are named by the id of their content and kept, like git
+ * objects, in a subdirectory named by the first two characters of it,
+ *
+ *	archives/ab/abcdef....gz
+ *
+ * so the archives directory stays small with thousands of versions.
+ * Repositories made before that have every archive right in archives/.
+ * They are moved into their subdirectory when the repository is opened,
+ * and an archive still in the old place is found there anyway.
+ *
+ * What follows the id is config suffix, for backup tools that go by
+ * extension, and may hold the {ext} of the file archived, as in
+ * ".manuscript{ext}.gz". Archives are found by the id alone, so those
+ * written with another suffix, or for another extension, are still
+ * found and shared.
+ */
+
+const DefaultSuffix = ".gz"
+
+var suffixKeys = []string{"ext"}
+
+func checkSuffix(suffix string) error {
+	if err := checkPlaceholders(suffix, suffixKeys); err != nil {
+		return err
+	}
+	if !strings.HasPrefix(suffix, ".") || strings.Contains(suffix, ".tmp") {
+		return fmt.Errorf("suffix must start with a dot and can't hold .tmp")
+	}
+	return nil
+}
+
+func (repo *Repo) archiveSuffix(origFile string) string {
+	/* The suffix of a new archive of origFile; "" is for one of no file in particular */
+	ext := filepath.Ext(origFile)
+	if origFile == "" || strings.HasSuffix(origFile, "/") {
+		ext = ""
+	}
+	return renderFilename(repo.config.suffix, map[string]string{"ext": ext})
+}
+
+func archiveID(archive string) string {
+	/* The id an archive is named by, "" for a file that is not one */
+	id, _, ok := strings.Cut(filepath.Base(archive), ".")
+	if !ok || !isSha1(id) || strings.Contains(filepath.Base(archive), ".tmp") {
+		return ""
+	}
+	return id
+}
+
+func shardPath(archivesDir, id, suffix string) string {
+	if len(id) <= 2 {
+		return filepath.Join(archivesDir, id) + suffix
+	}
+	return filepath.Join(archivesDir, id[:2], id) + suffix
+}
+
+func findArchive(dir, id string) string {
+	/* The archive of id in dir whatever its suffix, "" if there is none */
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+	for _, e := range entries {
+		if e.Type().IsRegular() && archiveID(e.Name()) == id {
+			return filepath.Join(dir, e.Name())
+		}
+	}
+	return ""
+}
+
+func archivePathIn(archivesDir, id, suffix string) string {
+	/*
+	 * Where the archive of id is, or else where a new one goes.
+	 * Every lookup of an archive comes through here.
+	 */
+	path := shardPath(archivesDir, id, suffix)
+	if _, err := os.Stat(path); err == nil || len(id) <= 2 {
+		return path
+	}
+	if found := findArchive(filepath.Dir(path), id); found != "" {
+		return found
+	}
+	if found := findArchive(archivesDir, id); found != "" {
+		return found
+	}
+	return path
+}
+
+func (repo *Repo) archivePath(id string) string {
+	return archivePathIn(repo.archivesDir, id, repo.archiveSuffix(""))
+}
+
+func (repo *Repo) newArchivePath(id, origFile string) string {
+	/* Like archivePath, named for origFile if it is not there yet */
+	return archivePathIn(repo.archivesDir, id, repo.archiveSuffix(origFile))
+}
+
+func archivesDirOf(archive string) string {
+	/* The archives directory archive is in, whether sharded or not */
+	dir := filepath.Dir(archive)
+	id := archiveID(archive)
+	if len(id) > 2 && filepath.Base(dir) == id[:2] {
+		return filepath.Dir(dir)
+	}
+	return dir
+}
+
+func isShard(name string) bool {
+	return len(name) == 2 && strings.Trim(name, "0123456789abcdef") == ""
+}
+
+func (repo *Repo) archiveFiles() ([]string, error) {
+	/* Every file of the archives directory and of its subdirectories */
+	entries, err := os.ReadDir(repo.archivesDir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, e := range entries {
+		path := filepath.Join(repo.archivesDir, e.Name())
+		if !e.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		if !isShard(e.Name()) {
+			continue
+		}
+		shard, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range shard {
+			if !s.IsDir() {
+				files = append(files, filepath.Join(path, s.Name()))
+			}
+		}
+	}
+	return files, nil
+}
+
+func (repo *Repo) shardArchives() {
+	/* Move the archives still right in archives/ into their subdirectory */
+	entries, err := os.ReadDir(repo.archivesDir)
+	if err != nil {
+		fail(err)
+	}
+	var flat []string
+	for _, e := range entries {
+		if e.Type().IsRegular() && archiveID(e.Name()) != "" {
+			flat = append(flat, e.Name())
+		}
+	}
+	if len(flat) == 0 {
+		return
+	}
+
+	if err := repo.tryLock(); isReadOnly(err) {
+		debugf("can't move archives in a read-only repository: %v", err)
+		return
+	} else if err != nil {
+		fail(err)
+	}
+	defer repo.unlock()
+
+	var moved int
+	for _, name := range flat {
+		id := archiveID(name)
+		from := filepath.Join(repo.archivesDir, name)
+		to := filepath.Join(repo.archivesDir, id[:2], name)
+		if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+			fail(err)
+		}
+		if findArchive(filepath.Dir(to), id) != "" {
+			/* Same id, same content: the flat one is a leftover */
+			os.Remove(from)
+			continue
+		}
+		if err := os.Rename(from, to); err != nil {
+			fmt.Fprintf(os.Stderr, "Can't move %s: %v\n", from, err)
+			continue
+		}
+		moved++
+	}
+	fmt.Fprintf(os.Stderr, "Move %d archives into subdirectories of %s.\n", moved, repo.archivesDir)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func archiveNames(t *testing.T, dir string) []string {
+	/* The names of the files under dir, archives and shards as they are on disk */
+	t.Helper()
+	var names []string
+	filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			names = append(names, filepath.Base(path))
+		}
+		return nil
+	})
+	return names
+}
+
+func TestArchiveSuffixRoundTrip(t *testing.T) {
+	dir := newTestRepo(t)
+	msm(t, dir, "config", "suffix", ".manuscript{ext}.gz")
+	track(t, dir, "paper", "paper")
+	update(t, dir, "paper", "draft.pdf", "first\n")
+	update(t, dir, "paper", "draft.pdf", "second\n")
+
+	versions := versionsOf(t, dir, "paper")
+	for _, v := range versions {
+		want := filepath.Join(dir, DataDirName, "archives", v.ID[:2], v.ID+".manuscript.pdf.gz")
+		if !exists(want) {
+			t.Errorf("no archive %s, archives are %q", want, archiveNames(t, filepath.Join(dir, DataDirName, "archives")))
+		}
+	}
+
+	/* Found by id after the suffix is changed back */
+	msm(t, dir, "config", "suffix", ".gz")
+	msm(t, dir, "restore", "-o", "one.pdf", "paper", "1")
+	if got := readFile(t, filepath.Join(dir, "one.pdf")); got != "first\n" {
+		t.Errorf("restored version 1 holds %q", got)
+	}
+	msm(t, dir, "verify")
+	if out := msm(t, dir, "gc", "--dry-run"); !strings.Contains(out, "No orphaned archives") {
+		t.Errorf("gc takes archives with a suffix for orphans:\n%s", out)
+	}
+
+	/* Content already there under another suffix is shared, not stored again */
+	track(t, dir, "copy", "copy")
+	update(t, dir, "copy", "same.txt", "second\n")
+	if n := len(archiveNames(t, filepath.Join(dir, DataDirName, "archives"))); n != 2 {
+		t.Errorf("%d archives, want the 2 of paper shared with copy", n)
+	}
+}
+
+func TestArchiveSuffixInTrash(t *testing.T) {
+	dir := newTestRepo(t)
+	msm(t, dir, "config", "suffix", ".m{ext}.gz")
+	track(t, dir, "paper", "paper")
+	update(t, dir, "paper", "draft.pdf", "content\n")
+	id := versionsOf(t, dir, "paper")[0].ID
+
+	msm(t, dir, "undo", "--force", "--no-archive-delete")
+	if names := archiveNames(t, filepath.Join(dir, DataDirName, "trash")); !strings.Contains(strings.Join(names, " "), id+".m.pdf.gz") {
+		t.Errorf("archive in the trash not named with the suffix: %q", names)
+	}
+	msm(t, dir, "trash", "restore", "-o", "back.pdf", id)
+	if got := readFile(t, filepath.Join(dir, "back.pdf")); got != "content\n" {
+		t.Errorf("restored from the trash %q", got)
+	}
+}
+
+func TestCheckSuffix(t *testing.T) {
+	for suffix, ok := range map[string]bool{
+		".gz":            true,
+		".manuscript.gz": true,
+		".x{ext}.gz":     true,
+		"gz":             false,
+		".a/b.gz":        false,
+		".{basename}.gz": false,
+		".tmp.gz":        false,
+	} {
+		if err := checkSuffix(suffix); (err == nil) != ok {
+			t.Errorf("checkSuffix(%q) = %v", suffix, err)
+		}
+	}
+}
+
+func TestArchiveID(t *testing.T) {
+	id := strings.Repeat("ab", 20)
+	for name, want := range map[string]string{
+		id + ".gz":          id,
+		id + ".m.pdf.gz":    id,
+		id + ".gz.tmp12345": "",
+		"table":             "",
+		"abc.gz":            "",
+	} {
+		if got := archiveID(name); got != want {
+			t.Errorf("archiveID(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestArchivesRefs(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	track(t, dir, "copy", "copy")
+	update(t, dir, "paper", "a.txt", "shared\n")
+	update(t, dir, "copy", "b.txt", "shared\n")
+	update(t, dir, "paper", "a.txt", "own\n")
+	repo := openTestRepo(t, dir)
+	paper := versionsOf(t, dir, "paper")
+	orphan := strings.Repeat("ab", 20)
+	if err := compress(strings.NewReader("left over\n"), repo.archivePath(orphan), "gzip", -1, nil); err != nil {
+		t.Fatal(err)
+	}
+	missing := strings.Repeat("cd", 20)
+	writeFile(t, repo.versionsTable, readFile(t, repo.versionsTable)+joinFields("2024-01-01", "10:00", "paper", "3", "c.txt", "paper_3_FD.txt", testAuthor, missing, "", "4", paper[1].ID, "-", "-", "-")+"\n")
+
+	var records []ArchiveRecord
+	out := msm(t, dir, "archives", "--json")
+	if err := json.Unmarshal([]byte(out), &records); err != nil {
+		t.Fatalf("archives --json: %v\n%s", err, out)
+	}
+	want := map[string]struct {
+		refs   int
+		status string
+	}{
+		paper[0].ID: {2, "shared"},
+		paper[1].ID: {1, "ok"},
+		orphan:      {0, "orphan"},
+		missing:     {1, "missing"},
+	}
+	if len(records) != len(want) {
+		t.Errorf("%d archives, want %d:\n%s", len(records), len(want), out)
+	}
+	for _, r := range records {
+		if w := want[r.ID]; r.Refs != w.refs || r.Status != w.status {
+			t.Errorf("archive %s: %d refs, %s, want %d, %s", r.ID, r.Refs, r.Status, w.refs, w.status)
+		}
+		if r.Status != "missing" && (r.Size == nil || *r.Size != int64(len(readFile(t, repo.archivePath(r.ID))))) {
+			t.Errorf("archive %s: size %v", r.ID, r.Size)
+		}
+	}
+	if out := msm(t, dir, "archives"); !strings.Contains(out, orphan) || !strings.Contains(out, "orphan") {
+		t.Errorf("archives:\n%s", out)
+	}
+}
+
+func TestShardedArchives(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	update(t, dir, "paper", "a.txt", "one\n")
+	update(t, dir, "paper", "a.txt", "two\n")
+	repo := openTestRepo(t, dir)
+	v := versionsOf(t, dir, "paper")
+	for _, v := range v {
+		sharded := filepath.Join(repo.archivesDir, v.ID[:2], v.ID+".gz")
+		if !exists(sharded) || repo.archivePath(v.ID) != sharded {
+			t.Errorf("archive of version %d is not at %s", v.Version, sharded)
+		}
+	}
+
+	/* An archive where older repositories kept it is still found */
+	first := filepath.Join(repo.archivesDir, v[0].ID[:2], v[0].ID+".gz")
+	flat := filepath.Join(repo.archivesDir, v[0].ID+".gz")
+	if err := os.Rename(first, flat); err != nil {
+		t.Fatal(err)
+	}
+	if got := repo.archivePath(v[0].ID); got != flat {
+		t.Errorf("archivePath of a flat archive: %s", got)
+	}
+	if content, err := readArchive(repo.archivePath(v[0].ID)); err != nil || string(content) != "one\n" {
+		t.Errorf("reading a flat archive: %q, %v", content, err)
+	}
+
+	/* And moved into its subdirectory on the next command */
+	out := filepath.Join(t.TempDir(), "out.txt")
+	r := run(t, dir, "", "restore", "-o", out, "paper", "1")
+	if r.code != ExitOK || !strings.Contains(r.stderr, "Move 1 archives into subdirectories") {
+		t.Fatalf("restore of a flat archive: exit %d\n%s", r.code, r.stderr)
+	}
+	if readFile(t, out) != "one\n" || exists(flat) || !exists(first) {
+		t.Errorf("the flat archive was not moved to %s", first)
+	}
+
+	/* A flat copy of a sharded archive is a leftover */
+	writeFile(t, flat, readFile(t, first))
+	msm(t, dir, "hist")
+	if exists(flat) || !exists(first) {
+		t.Errorf("the leftover flat archive is still there")
+	}
+	msm(t, dir, "verify")
+}
+
+func TestArchiveSuffixUndo(t *testing.T) {
+	/* Undo, checkout and gc find archives by id, whatever their suffix */
+	dir := newTestRepo(t)
+	msm(t, dir, "config", "suffix", ".m.gz")
+	track(t, dir, "paper", "paper")
+	update(t, dir, "paper", "a.txt", "one\n")
+	update(t, dir, "paper", "a.txt", "two\n")
+	archives := filepath.Join(dir, DataDirName, "archives")
+
+	msm(t, dir, "config", "suffix", ".x{ext}.gz")
+	msm(t, dir, "--author", testAuthor, "--yes", "checkout", "paper", "1")
+	if got := readFile(t, filepath.Join(dir, latestFile(t, dir, "paper"))); got != "one\n" {
+		t.Errorf("checkout of an archive with another suffix: %q", got)
+	}
+	msm(t, dir, "--yes", "undo", "2")
+	if names := archiveNames(t, archives); len(names) != 1 || !strings.HasSuffix(names[0], ".m.gz") {
+		t.Errorf("archives after undo: %q", names)
+	}
+	if out := msm(t, dir, "gc", "--dry-run"); !strings.Contains(out, "No orphaned archives") {
+		t.Errorf("gc after undo:\n%s", out)
+	}
+	msm(t, dir, "verify")
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+/*
+ * A bundle is a tar.gz with the data directory of a repository,
+ * as msmanager-data/..., holding the tables, the config, the known
+ * authors and the archives the versions-table refers to. The oplog
+ * is left out: undo history belongs to the place it was made in.
+ */
+
+func bundleRepo(repo *Repo, args []string) {
+	if len(args) != 3 {
+		fmt.Fprintf(os.Stderr, "Missing arguments.\n")
+		usage(ExitUsage)
+		return
+	}
+
+	/* Only reading, so a read-only repository can be bundled without the lock */
+	if err := repo.tryLock(); isReadOnly(err) {
+		debugf("no lock in a read-only repository: %v", err)
+	} else if err != nil {
+		fail(err)
+	}
+	defer repo.unlock()
+
+	files := []string{repo.labelsTable, repo.versionsTable}
+	for _, f := range []string{repo.configFile, repo.authorsFile, repo.cryptFile} {
+		if _, err := os.Stat(f); err == nil {
+			files = append(files, f)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, v := range repo.readVersionsTable() {
+		if v.id != "none" {
+			seen[v.id] = true
+		}
+	}
+	repo.withBases(seen)
+	for _, id := range slices.Sorted(maps.Keys(seen)) {
+		files = append(files, repo.archivePath(id))
+	}
+
+	out, err := os.Create(args[2])
+	if err != nil {
+		fail(err)
+	}
+	defer out.Close()
+
+	zw := gzip.NewWriter(out)
+	tw := tar.NewWriter(zw)
+	for _, f := range files {
+		rel, err := filepath.Rel(repo.dataDir, f)
+		if err != nil {
+			fail(err)
+		}
+		if err := addToTar(tw, f, filepath.ToSlash(filepath.Join(DataDirName, rel))); err != nil {
+			fail(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		fail(err)
+	}
+	if err := zw.Close(); err != nil {
+		fail(err)
+	}
+	inform("Bundle %s: %d labels, %d archives.\n", args[2], len(repo.readLabels()), len(seen))
+}
+
+func addToTar(tw *tar.Writer, path, name string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     fi.Size(),
+		ModTime:  time.Unix(0, 0),
+		Typeflag: tar.TypeReg,
+		Format:   tar.FormatPAX,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+func unbundleRepo(args []string) {
+	/*
+	 * Make a new repository in dir from a bundle, check every
+	 * archive against its id, and restore the latest version
+	 * file of each label.
+	 */
+
+	if len(args) != 4 {
+		fmt.Fprintf(os.Stderr, "Missing arguments.\n")
+		usage(ExitUsage)
+		return
+	}
+	bundle, dir := args[2], args[3]
+
+	repo := newRepo(dir, filepath.Join(dir, DataDirName))
+	if _, err := os.Stat(repo.dataDir); err == nil {
+		fail(fmt.Errorf("%s already has a repository", dir))
+	}
+
+	in, err := os.Open(bundle)
+	if err != nil {
+		fail(err)
+	}
+	defer in.Close()
+
+	zr, err := gzip.NewReader(in)
+	if err != nil {
+		fail(err)
+	}
+	if err := extractTar(zr, dir); err != nil {
+		fail(err)
+	}
+	if err := os.MkdirAll(repo.archivesDir, 0755); err != nil {
+		fail(err)
+	}
+	repo.config = repo.readConfig()
+	repo.migrate()
+
+	latest := make(map[string]*Version)
+	checked := make(map[string]bool)
+	var problems int
+	for _, v := range repo.readVersionsTable() {
+		if v.versionNumber > 0 {
+			latest[v.label] = v
+		}
+		if v.id == "none" || checked[v.id] {
+			continue
+		}
+		checked[v.id] = true
+		if sum, err := archiveSha1(repo.archivePath(v.id)); err != nil {
+			fmt.Printf("%s: %v\n", v.id, err)
+			problems++
+		} else if sum != v.id {
+			fmt.Printf("%s: content does not match id (got %s)\n", v.id, sum)
+			problems++
+		}
+	}
+	if problems > 0 {
+		fail(integrityError("%d damaged archives in %s", problems, bundle))
+	}
+
+	for _, l := range repo.readLabels() {
+		v, ok := latest[l.Label]
+		if !ok {
+			continue
+		}
+		if err := repo.inflateVersion(v, repo.workPath(v.file)); err != nil {
+			fail(err)
+		}
+	}
+	inform("Unbundle %s into %s: %d labels, %d archives OK.\n", bundle, dir, len(repo.readLabels()), len(checked))
+}
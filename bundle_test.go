@@ -0,0 +1,47 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBundleRoundTrip(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	track(t, dir, "supp", "supp")
+	update(t, dir, "paper", "a.txt", "one\n")
+	update(t, dir, "paper", "a.txt", "two\n")
+	writeFile(t, filepath.Join(dir, "figs", "plot.csv"), "1,2\n")
+	msm(t, dir, "--author", testAuthor, "--yes", "update", "supp", "figs")
+
+	bundle := filepath.Join(t.TempDir(), "paper.tar.gz")
+	msm(t, dir, "bundle", bundle)
+	into := filepath.Join(t.TempDir(), "copy")
+	out := msm(t, dir, "unbundle", bundle, into)
+	if !strings.Contains(out, "3 archives OK") {
+		t.Errorf("unbundle:\n%s", out)
+	}
+
+	from, to := openTestRepo(t, dir), openTestRepo(t, into)
+	for _, table := range []struct{ from, to string }{{from.versionsTable, to.versionsTable}, {from.labelsTable, to.labelsTable}, {from.configFile, to.configFile}} {
+		if readFile(t, table.to) != readFile(t, table.from) {
+			t.Errorf("%s differs after unbundle", filepath.Base(table.to))
+		}
+	}
+	for _, v := range versionsOf(t, into, "paper") {
+		if sum, err := archiveSha1(to.archivePath(v.ID)); err != nil || sum != v.ID {
+			t.Errorf("archive %s after unbundle: %s, %v", v.ID, sum, err)
+		}
+	}
+	msm(t, into, "verify")
+	if got := readFile(t, filepath.Join(into, latestFile(t, into, "paper"))); got != "two\n" {
+		t.Errorf("latest version file after unbundle: %q", got)
+	}
+	if got := readTree(t, filepath.Join(into, latestFile(t, into, "supp"))); got["plot.csv"] != "1,2\n" {
+		t.Errorf("latest version directory after unbundle: %v", got)
+	}
+
+	/* Into a repository that is there already, it refuses */
+	msmFails(t, dir, ExitError, "unbundle", bundle, into)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+/*
+ * "completion bash" and "completion zsh" print a script that completes
+ * command names, and label names after the commands that take one, as
+ *
+ *	source <(msmanager completion bash)
+ *
+ * The labels come from the hidden __complete-labels command, run by
+ * the script each time, so they are the ones tracked at that moment.
+ */
+
+const CompleteLabels = "__complete-labels"
+
+/* Commands whose first argument is a label */
+var labelCommands = []string{"update", "log", "restore", "checkout", "show", "delete", "rename",
+	"set-basename", "diff", "latest", "hist"}
+
+const bashCompletion = `_msmanager() {
+	local cur=${COMP_WORDS[COMP_CWORD]}
+	local i cmd="" repo=() n=0
+	for ((i = 1; i < COMP_CWORD; i++)); do
+		case ${COMP_WORDS[i]} in
+		--repo) repo=(--repo "${COMP_WORDS[i+1]}"); ((i++)) ;;
+		--author) ((i++)) ;;
+		-*) ;;
+		*) if [[ -z $cmd ]]; then cmd=${COMP_WORDS[i]}; else ((n++)); fi ;;
+		esac
+	done
+	if [[ -z $cmd ]]; then
+		COMPREPLY=($(compgen -W "%s" -- "$cur"))
+		return
+	fi
+	case $cmd in
+	%s)
+		if [[ $n -eq 0 && $cur != -* ]]; then
+			COMPREPLY=($(compgen -W "$(msmanager "${repo[@]}" %s 2>/dev/null)" -- "$cur"))
+		fi ;;
+	esac
+}
+complete -o default -F _msmanager msmanager
+`
+
+const zshCompletion = `#compdef msmanager
+_msmanager() {
+	local -a commands labels repo
+	local i cmd="" n=0
+	commands=(%s)
+	for ((i = 2; i < CURRENT; i++)); do
+		case $words[i] in
+		--repo) repo=(--repo "$words[i+1]"); ((i++)) ;;
+		--author) ((i++)) ;;
+		-*) ;;
+		*) if [[ -z $cmd ]]; then cmd=$words[i]; else ((n++)); fi ;;
+		esac
+	done
+	if [[ -z $cmd ]]; then
+		compadd -a commands
+		return
+	fi
+	case $cmd in
+	%s)
+		if [[ $n -eq 0 && $words[CURRENT] != -* ]]; then
+			labels=(${(f)"$(msmanager "${repo[@]}" %s 2>/dev/null)"})
+			compadd -a labels
+			return
+		fi ;;
+	esac
+	_files
+}
+compdef _msmanager msmanager
+`
+
+func printCompletion(args []string) {
+	if len(args) != 3 {
+		fmt.Fprintf(os.Stderr, "Missing arguments.\n")
+		usage(ExitUsage)
+		return
+	}
+	commands := strings.Join(reservedNames, " ")
+	withLabel := strings.Join(labelCommands, "|")
+	switch args[2] {
+	case "bash":
+		fmt.Printf(bashCompletion, commands, withLabel, CompleteLabels)
+	case "zsh":
+		fmt.Printf(zshCompletion, commands, withLabel, CompleteLabels)
+	default:
+		fail(usageError("no completion for shell %q, use bash or zsh", args[2]))
+	}
+}
+
+func completeLabels(repo *Repo) {
+	for _, l := range repo.readLabels() {
+		fmt.Println(l.Label)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCompleteLabels(t *testing.T) {
+	dir := newTestRepo(t)
+	if out := msm(t, dir, CompleteLabels); out != "" {
+		t.Errorf("labels of an empty repository: %q", out)
+	}
+	track(t, dir, "paper", "paper")
+	track(t, dir, "thesis", "thesis")
+	track(t, dir, "grant", "grant")
+	msm(t, dir, "rename", "grant", "grant-2025")
+	msm(t, dir, "--yes", "delete", "thesis")
+	if out := msm(t, dir, CompleteLabels); out != "paper\ngrant-2025\n" {
+		t.Errorf("%s: %q", CompleteLabels, out)
+	}
+
+	/* Nothing, and no error, outside a repository */
+	if r := run(t, t.TempDir(), "", CompleteLabels); r.code != ExitOK || r.stdout != "" || r.stderr != "" {
+		t.Errorf("%s outside a repository: exit %d\n%s%s", CompleteLabels, r.code, r.stdout, r.stderr)
+	}
+}
+
+func TestCompletionScripts(t *testing.T) {
+	dir := t.TempDir()
+	for _, shell := range []string{"bash", "zsh"} {
+		out := msm(t, dir, "completion", shell)
+		if !strings.Contains(out, CompleteLabels) || !strings.Contains(out, "set-basename") {
+			t.Errorf("completion %s:\n%s", shell, out)
+		}
+	}
+	msmFails(t, dir, ExitUsage, "completion", "fish")
+	msmFails(t, dir, ExitUsage, "completion")
+}
+
+func completionPath(t *testing.T) string {
+	/* A directory with msmanager in it, to put on the PATH as the scripts run it */
+	t.Helper()
+	bin := t.TempDir()
+	writeFile(t, filepath.Join(bin, "msmanager"), "#!/bin/sh\n"+testMainEnv+"=1 exec "+os.Args[0]+" \"$@\"\n")
+	if err := os.Chmod(filepath.Join(bin, "msmanager"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return bin
+}
+
+func TestBashCompletion(t *testing.T) {
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		t.Skip("no bash")
+	}
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	track(t, dir, "poster", "poster")
+
+	bin := completionPath(t)
+	complete := func(words ...string) []string {
+		t.Helper()
+		cmd := exec.Command(bash, "-c", `source <(msmanager completion bash)
+COMP_WORDS=("$@"); COMP_CWORD=$(($# - 1)); _msmanager
+printf '%s\n' "${COMPREPLY[@]}"`, "bash", "msmanager")
+		cmd.Args = append(cmd.Args, words...)
+		cmd.Dir = dir
+		cmd.Env = append(testEnv(), "PATH="+bin+":"+os.Getenv("PATH"))
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("completing %q: %v", words, err)
+		}
+		return strings.Fields(string(out))
+	}
+
+	if got := complete("update", "p"); !slices.Equal(got, []string{"paper", "poster"}) {
+		t.Errorf("completing update p: %q", got)
+	}
+	if got := complete("--repo", dir, "restore", "pa"); !slices.Equal(got, []string{"paper"}) {
+		t.Errorf("completing restore pa: %q", got)
+	}
+	if got := complete("undo"); !slices.Equal(got, []string{"undo"}) {
+		t.Errorf("completing undo: %q", got)
+	}
+	if got := complete("update", "paper", ""); len(got) != 0 {
+		t.Errorf("completing after the label: %q", got)
+	}
+}
+
+func TestZshCompletion(t *testing.T) {
+	zsh, err := exec.LookPath("zsh")
+	if err != nil {
+		t.Skip("no zsh")
+	}
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	track(t, dir, "poster", "poster")
+	bin := completionPath(t)
+
+	/* Outside compinit: compadd prints what it is given, unfiltered */
+	complete := func(words ...string) []string {
+		t.Helper()
+		cmd := exec.Command(zsh, "-f", "-c", `compadd() { print -l -- ${(P)2} }
+_files() { print -- _files }
+compdef() { }
+source <(msmanager completion zsh)
+words=(msmanager "$@"); CURRENT=$#words; _msmanager`, "zsh")
+		cmd.Args = append(cmd.Args, words...)
+		cmd.Dir = dir
+		cmd.Env = append(testEnv(), "PATH="+bin+":"+os.Getenv("PATH"))
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("completing %q: %v", words, err)
+		}
+		return strings.Fields(string(out))
+	}
+
+	labels := []string{"paper", "poster"}
+	if got := complete("update", ""); !slices.Equal(got, labels) {
+		t.Errorf("completing update: %q", got)
+	}
+	if got := complete("--yes", "--repo", dir, "restore", ""); !slices.Equal(got, labels) {
+		t.Errorf("completing restore after global flags: %q", got)
+	}
+	if got := complete("--quiet", ""); !slices.Contains(got, "undo") || slices.Contains(got, "paper") {
+		t.Errorf("completing a command after a global flag: %q", got)
+	}
+	if got := complete("update", "paper", ""); !slices.Equal(got, []string{"_files"}) {
+		t.Errorf("completing after the label: %q", got)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+/*
+ * A Compressor is one of the formats archives can be stored in.
+ * Which one to use for new archives is set in the config; existing
+ * archives are read in whatever format they were written, recognized
+ * by their first bytes. Whatever the format, archive names end with
+ * config suffix, which is .gz unless set otherwise.
+ *
+ * The better ratios asked for come from zlib rather than zstd: the
+ * standard library has no zstd, and msmanager takes no other modules.
+ * zlib writes deflate like gzip with a smaller header, so its gain
+ * is small; the level does more. A zstd Compressor would only need
+ * its magic, 28 b5 2f fd, to be told from the other two.
+ */
+type Compressor interface {
+	newWriter(w io.Writer, level int) (io.WriteCloser, error)
+	newReader(r io.Reader) (io.ReadCloser, error)
+	magic() []byte
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) newWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, level)
+}
+
+func (gzipCompressor) newReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+func (gzipCompressor) magic() []byte {
+	return []byte{0x1f, 0x8b}
+}
+
+type zlibCompressor struct{}
+
+func (zlibCompressor) newWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	return zlib.NewWriterLevel(w, level)
+}
+
+func (zlibCompressor) newReader(r io.Reader) (io.ReadCloser, error) {
+	return zlib.NewReader(r)
+}
+
+func (zlibCompressor) magic() []byte {
+	/* Deflate with a 32K window, which is what zlib.NewWriter writes */
+	return []byte{0x78}
+}
+
+var compressors = map[string]Compressor{
+	"gzip": gzipCompressor{},
+	"zlib": zlibCompressor{},
+}
+
+func compress(inFile io.Reader, outputFile string, algorithm string, level int, seal sealer) error {
+	return writeArchive(outputFile, nil, inFile, algorithm, level, seal)
+}
+
+func writeArchive(outputFile string, header []byte, inFile io.Reader, algorithm string, level int, seal sealer) error {
+	/* header goes before the compressed data, as is, and both are sealed if seal is not nil */
+	c, ok := compressors[algorithm]
+	if !ok {
+		return fmt.Errorf("unknown compression %q", algorithm)
+	}
+
+	/*
+	 * Write to a temporary file and rename it into place, so that
+	 * a write failing halfway, like on a full disk, never leaves a
+	 * partial archive under the name of a complete one.
+	 */
+	if err := os.MkdirAll(filepath.Dir(outputFile), 0755); err != nil {
+		return err
+	}
+	outFile, err := os.CreateTemp(filepath.Dir(outputFile), filepath.Base(outputFile)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(outFile.Name())
+
+	if err := outFile.Chmod(0644); err != nil {
+		outFile.Close()
+		return err
+	}
+	if seal == nil {
+		err = writeCompressed(outFile, header, inFile, c, level)
+	} else {
+		var buf bytes.Buffer
+		var sealed []byte
+		if err = writeCompressed(&buf, header, inFile, c, level); err == nil {
+			if sealed, err = seal(buf.Bytes()); err == nil {
+				_, err = outFile.Write(sealed)
+			}
+		}
+	}
+	if err != nil {
+		outFile.Close()
+		return err
+	}
+	if err := outFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(outFile.Name(), outputFile)
+}
+
+func writeCompressed(w io.Writer, header []byte, r io.Reader, c Compressor, level int) error {
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	return compressTo(w, r, c, level)
+}
+
+func compressTo(w io.Writer, r io.Reader, c Compressor, level int) error {
+	/* The compressor flushes on Close, which can fail like any write */
+	writer, err := c.newWriter(w, level)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(writer, r); err != nil {
+		writer.Close()
+		return err
+	}
+	return writer.Close()
+}
+
+/* How checkSpace finds the free space, replaced to fake a full disk */
+var statfs = syscall.Statfs
+
+func checkSpace(dir string, need int64) error {
+	/*
+	 * Compressed content is seldom larger than the input, so
+	 * that much free space is enough for a new archive.
+	 */
+	var st syscall.Statfs_t
+	if err := statfs(dir, &st); err != nil {
+		return err
+	}
+	if free := int64(st.Bavail) * int64(st.Bsize); free < need {
+		return fmt.Errorf("not enough space in %s: %d bytes free, %d needed", dir, free, need)
+	}
+	return nil
+}
+
+type archiveReader struct {
+	io.ReadCloser
+	file io.Closer
+}
+
+func (a archiveReader) Close() error {
+	a.ReadCloser.Close()
+	return a.file.Close()
+}
+
+func openRaw(archive string) (io.Closer, *bufio.Reader, error) {
+	/* The archive as it was before being sealed, if it was */
+	f, err := os.Open(archive)
+	if err != nil {
+		return nil, nil, err
+	}
+	buf := bufio.NewReader(f)
+	if head, _ := buf.Peek(len(cryptMagic)); !isSealed(head) {
+		return f, buf, nil
+	}
+
+	data, err := io.ReadAll(buf)
+	f.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	plain, err := unseal(data, false)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", archive, err)
+	}
+	return io.NopCloser(nil), bufio.NewReader(bytes.NewReader(plain)), nil
+}
+
+func openArchive(archive string) (io.ReadCloser, error) {
+	f, buf, err := openRaw(archive)
+	if err != nil {
+		return nil, err
+	}
+
+	if base, ok := readDeltaBase(buf); ok {
+		return openDelta(archive, base, f, buf)
+	}
+	return openCompressed(archive, f, buf)
+}
+
+func openCompressed(archive string, f io.Closer, buf *bufio.Reader) (io.ReadCloser, error) {
+	head, _ := buf.Peek(2)
+	for _, c := range compressors {
+		if bytes.HasPrefix(head, c.magic()) {
+			r, err := c.newReader(buf)
+			if err != nil {
+				f.Close()
+				return nil, err
+			}
+			return archiveReader{r, f}, nil
+		}
+	}
+	f.Close()
+	return nil, fmt.Errorf("%s: unknown archive format", archive)
+}
+
+func decompress(inputFile string, outputFile string) error {
+	reader, err := openArchive(inputFile)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	outFile, err := os.Create(outputFile)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+
+	if _, err := io.Copy(outFile, reader); err != nil {
+		return err
+	}
+	return nil
+}
+
+func decompressTo(inputFile string, w io.Writer) error {
+	/* Directory archives are written as the tar stream they hold */
+	reader, err := openArchive(inputFile)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	_, err = io.Copy(w, reader)
+	return err
+}
+
+func verifyArchive(archive, id string) error {
+	/*
+	 * With --compress-verify, read a new archive back before the
+	 * version is recorded, so a write the disk got wrong is caught
+	 * while the file it came from is still there.
+	 */
+	if !compressVerify {
+		return nil
+	}
+	debugf("read back %s", archive)
+	if err := checkArchive(archive, id); err != nil {
+		return integrityError("%s does not read back: %v", archive, err)
+	}
+	return nil
+}
+
+func archiveSha1(archive string) (string, error) {
+	reader, err := openArchive(archive)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	h := sha1.New()
+	if _, err := io.Copy(h, reader); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	content := strings.Repeat("The results are robust to the choice of prior.\n", 500)
+	for algorithm, c := range compressors {
+		for _, level := range []int{gzip.BestSpeed, gzip.DefaultCompression, gzip.BestCompression} {
+			archive := filepath.Join(t.TempDir(), "archive.gz")
+			if err := compress(strings.NewReader(content), archive, algorithm, level, nil); err != nil {
+				t.Fatalf("%s level %d: %v", algorithm, level, err)
+			}
+			raw := readFile(t, archive)
+			if !strings.HasPrefix(raw, string(c.magic())) {
+				t.Errorf("%s level %d: archive starts with %x", algorithm, level, raw[:2])
+			}
+			if len(raw) >= len(content) {
+				t.Errorf("%s level %d: %d bytes from %d", algorithm, level, len(raw), len(content))
+			}
+
+			var out bytes.Buffer
+			if err := decompressTo(archive, &out); err != nil {
+				t.Fatalf("%s level %d: %v", algorithm, level, err)
+			}
+			if out.String() != content {
+				t.Errorf("%s level %d: content changed", algorithm, level)
+			}
+		}
+	}
+
+	if err := compress(strings.NewReader(content), filepath.Join(t.TempDir(), "a"), "zstd", 3, nil); err == nil {
+		t.Errorf("compress with an unknown algorithm did not fail")
+	}
+	unknown := filepath.Join(t.TempDir(), "unknown")
+	writeFile(t, unknown, "plain text")
+	if err := decompressTo(unknown, &bytes.Buffer{}); err == nil || !strings.Contains(err.Error(), "unknown archive format") {
+		t.Errorf("decompress of plain text: %v", err)
+	}
+}
+
+func TestRestoreDetectsCompression(t *testing.T) {
+	/* Versions archived before and after changing the compression both restore */
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	update(t, dir, "paper", "a.txt", "with gzip\n")
+	msm(t, dir, "config", "compression", "zlib")
+	msm(t, dir, "config", "level", "9")
+	update(t, dir, "paper", "a.txt", "with zlib\n")
+
+	repo := openTestRepo(t, dir)
+	for i, v := range versionsOf(t, dir, "paper") {
+		algorithm := []string{"gzip", "zlib"}[i]
+		if raw := readFile(t, repo.archivePath(v.ID)); !strings.HasPrefix(raw, string(compressors[algorithm].magic())) {
+			t.Errorf("version %d is not %s: %x", v.Version, algorithm, raw[:2])
+		}
+		want := "with " + algorithm + "\n"
+		if got := msm(t, dir, "restore", "-o", "-", v.ID); got != want {
+			t.Errorf("restore of version %d: %q, want %q", v.Version, got, want)
+		}
+	}
+	msm(t, dir, "verify")
+}
+
+func randomContent(n int) []byte {
+	/* Bytes that don't compress, always the same */
+	b := make([]byte, n)
+	rand.New(rand.NewSource(1)).Read(b)
+	return b
+}
+
+type failingWriter struct {
+	n int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	/* Take n bytes, then fail like a full disk */
+	if len(p) > w.n {
+		n := w.n
+		w.n = 0
+		return n, syscall.ENOSPC
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+func TestCompressWriteFails(t *testing.T) {
+	content := randomContent(1 << 16)
+	for _, n := range []int{0, 10, 1000, 1 << 15} {
+		for algorithm, c := range compressors {
+			err := compressTo(&failingWriter{n}, bytes.NewReader(content), c, -1)
+			if !errors.Is(err, syscall.ENOSPC) {
+				t.Errorf("%s failing after %d bytes: %v", algorithm, n, err)
+			}
+		}
+	}
+}
+
+func TestUpdateWriteFails(t *testing.T) {
+	/*
+	 * Run update with a file size limit below the size of the
+	 * archive, so that writing it fails halfway.
+	 */
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	content := randomContent(1 << 16)
+	writeFile(t, filepath.Join(dir, "a.bin"), string(content))
+	repo := openTestRepo(t, dir)
+	table := readFile(t, repo.versionsTable)
+
+	cmd := exec.Command("sh", "-c", `ulimit -f 8 && exec "$0" --yes --author "$1" update paper a.bin`, os.Args[0], testAuthor)
+	cmd.Dir = dir
+	cmd.Env = testEnv()
+	if out, err := cmd.CombinedOutput(); err == nil || !strings.Contains(string(out), "file too large") {
+		t.Fatalf("update past the file size limit: %v\n%s", err, out)
+	}
+
+	if got := readFile(t, repo.versionsTable); got != table {
+		t.Errorf("the failed update changed the versions-table")
+	}
+	if names := archiveNames(t, repo.archivesDir); len(names) != 0 {
+		t.Errorf("the failed update left %q", names)
+	}
+	if got := readFile(t, filepath.Join(dir, "a.bin")); got != string(content) || exists(filepath.Join(dir, "paper_1_FD.bin")) {
+		t.Errorf("the failed update moved or changed the input file")
+	}
+	update(t, dir, "paper", "a.bin", string(content))
+}
+
+type corruptingWriter struct {
+	/* Writes to w with the byte at offset at flipped, as a bad disk might */
+	w       io.Writer
+	at, off int
+}
+
+func (c *corruptingWriter) Write(b []byte) (int, error) {
+	if i := c.at - c.off; i >= 0 && i < len(b) {
+		b = bytes.Clone(b)
+		b[i] ^= 0x40
+	}
+	c.off += len(b)
+	return c.w.Write(b)
+}
+
+func TestCompressVerify(t *testing.T) {
+	content := randomContent(1 << 14)
+	sum := sha1.Sum(content)
+	id := hex.EncodeToString(sum[:])
+	saved := compressVerify
+	t.Cleanup(func() { compressVerify = saved })
+
+	for algorithm, c := range compressors {
+		for _, at := range []int{20, 1 << 13} {
+			archive := filepath.Join(t.TempDir(), id+".gz")
+			f, err := os.Create(archive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := writeCompressed(&corruptingWriter{w: f, at: at}, nil, bytes.NewReader(content), c, gzip.DefaultCompression); err != nil {
+				t.Fatal(err)
+			}
+			f.Close()
+
+			compressVerify = false
+			if err := verifyArchive(archive, id); err != nil {
+				t.Errorf("%s: verify without --compress-verify: %v", algorithm, err)
+			}
+			compressVerify = true
+			err = verifyArchive(archive, id)
+			if err == nil || exitCode(err) != ExitIntegrity || !strings.Contains(err.Error(), "does not read back") {
+				t.Errorf("%s: byte %d corrupted, verify gives %v", algorithm, at, err)
+			}
+		}
+
+		/* And an archive written right reads back */
+		archive := filepath.Join(t.TempDir(), id+".gz")
+		if err := compress(bytes.NewReader(content), archive, algorithm, gzip.DefaultCompression, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := verifyArchive(archive, id); err != nil {
+			t.Errorf("%s: verify of a good archive: %v", algorithm, err)
+		}
+	}
+}
+
+func TestUpdateCompressVerify(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	writeFile(t, filepath.Join(dir, "a.txt"), "one\n")
+	r := run(t, dir, "", "--compress-verify", "--verbose", "--author", testAuthor, "--yes", "update", "paper", "a.txt")
+	if r.code != ExitOK || !strings.Contains(r.stderr, "read back ") {
+		t.Errorf("update --compress-verify: exit %d\n%s", r.code, r.stderr)
+	}
+
+	writeFile(t, filepath.Join(dir, "b.txt"), "two\n")
+	writeFile(t, filepath.Join(dir, "manifest"), joinFields("paper", "b.txt", testAuthor)+"\n")
+	r = run(t, dir, "", "--compress-verify", "--verbose", "--yes", "batch", "manifest")
+	if r.code != ExitOK || strings.Count(r.stderr, "read back ") != 1 {
+		t.Errorf("batch --compress-verify: exit %d\n%s", r.code, r.stderr)
+	}
+	msm(t, dir, "verify")
+}
+
+func TestBatchChecksSpace(t *testing.T) {
+	/* On a full disk the batch workers compress nothing */
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	writeFile(t, filepath.Join(dir, "a.txt"), "one\n")
+	repo := openTestRepo(t, dir)
+	t.Chdir(dir)
+
+	saved := statfs
+	statfs = func(path string, st *syscall.Statfs_t) error {
+		*st = syscall.Statfs_t{Bsize: 4096}
+		return nil
+	}
+	t.Cleanup(func() { statfs = saved })
+
+	/* The update of the line is left to tell */
+	errs, staged := repo.prepareBatch([][]string{{"paper", "a.txt", testAuthor}}, 1)
+	if errs[0] != nil || len(staged) != 0 {
+		t.Errorf("batch on a full disk: %v, staged %q", errs[0], staged)
+	}
+	if names := archiveNames(t, repo.archivesDir); len(names) != 0 {
+		t.Errorf("batch on a full disk left %q", names)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+const DefaultInitials = "FD"
+
+type Config struct {
+	initials    string
+	author      string
+	compression string
+	level       int
+	precision   string
+	outside     string
+	eol         string
+	restored    string
+	previous    string
+	delta       int
+	encrypt     string
+	trash       string
+	editor      string
+	suffix      string
+}
+
+func defaultConfig() Config {
+	return Config{
+		initials:    DefaultInitials,
+		compression: "gzip",
+		level:       -1,
+		precision:   "second",
+		outside:     "refuse",
+		eol:         "lf",
+		restored:    DefaultRestoredTemplate,
+		previous:    "remove",
+		encrypt:     "off",
+		trash:       "off",
+		suffix:      DefaultSuffix,
+	}
+}
+
+func (repo *Repo) readConfig() Config {
+	/*
+	 * Config file has two columns: KEY VALUE
+	 * A missing file or key falls back to the default value,
+	 * so repositories created before the config existed keep working.
+	 */
+
+	c := defaultConfig()
+
+	f, err := os.Open(repo.configFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c
+		}
+		fail(err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		field := splitFields(line)
+		if len(field) == 0 {
+			continue
+		}
+		if len(field) != 2 {
+			fmt.Fprintf(os.Stderr, "%s:%d: malformed line %q, skipped\n", repo.configFile, n, line)
+			continue
+		}
+		if err := c.set(field[0], field[1]); err != nil {
+			fmt.Fprintf(os.Stderr, "%s:%d: %v, skipped\n", repo.configFile, n, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fail(err)
+	}
+	return c
+}
+
+func (repo *Repo) writeConfig(c Config) {
+	var lines []string
+	for _, e := range c.entries() {
+		lines = append(lines, joinFields(e[0], e[1]))
+	}
+	if err := writeLines(repo.configFile, lines); err != nil {
+		fail(err)
+	}
+}
+
+func (c *Config) set(key, value string) error {
+	switch key {
+	case "initials":
+		if value == "" {
+			return fmt.Errorf("initials can't be empty")
+		}
+		c.initials = value
+	case "author":
+		/* Used by update --yes when no --author is given */
+		if value != "" && !isValidEmail(value) {
+			return fmt.Errorf("invalid email %q", value)
+		}
+		c.author = value
+	case "compression":
+		if value == "zstd" {
+			return fmt.Errorf("compression zstd is not available, it is not in the Go standard library (use gzip or zlib)")
+		}
+		if _, ok := compressors[value]; !ok {
+			return fmt.Errorf("unknown compression %q (use gzip or zlib)", value)
+		}
+		c.compression = value
+	case "level":
+		/* -1 is the default level of the compressor */
+		n, err := strconv.Atoi(value)
+		if err != nil || n < -1 || n > 9 {
+			return fmt.Errorf("level must be a number from 0 to 9, or -1 for the default")
+		}
+		c.level = n
+	case "precision":
+		if _, ok := TimeFormats[value]; !ok {
+			return fmt.Errorf("unknown precision %q (use second or minute)", value)
+		}
+		c.precision = value
+	case "outside":
+		/* What update does with a file outside the repository */
+		if value != "refuse" && value != "move" {
+			return fmt.Errorf("outside must be refuse or move")
+		}
+		c.outside = value
+	case "eol":
+		/* The newlines text labels get their version files with */
+		if value != "lf" && value != "crlf" {
+			return fmt.Errorf("eol must be lf or crlf")
+		}
+		c.eol = value
+	case "restored":
+		/* How restore names the file when no -o is given */
+		if err := checkRestoredTemplate(value); err != nil {
+			return err
+		}
+		c.restored = value
+	case "previous":
+		/* What update does with the unchanged file of the version before */
+		if value != "remove" && value != "keep" {
+			return fmt.Errorf("previous must be remove or keep")
+		}
+		c.previous = value
+	case "delta":
+		/* Store versions as deltas, with a full archive every that many; 0 is off */
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("delta must be 0, to store full archives, or how often to store one")
+		}
+		c.delta = n
+	case "encrypt":
+		/* Seal new archives with a passphrase */
+		if value != "off" && value != "on" {
+			return fmt.Errorf("encrypt must be off or on")
+		}
+		c.encrypt = value
+	case "trash":
+		/* Move the archives undo and delete remove to the trash */
+		if value != "off" && value != "on" {
+			return fmt.Errorf("trash must be off or on")
+		}
+		c.trash = value
+	case "editor":
+		/* For the update note when there is no -m; empty is $VISUAL or $EDITOR */
+		c.editor = value
+	case "suffix":
+		/* What names of new archives end with after the id */
+		if err := checkSuffix(value); err != nil {
+			return err
+		}
+		c.suffix = value
+	default:
+		return fmt.Errorf("unknown config key %q", key)
+	}
+	return nil
+}
+
+func (c Config) entries() [][2]string {
+	return [][2]string{
+		{"initials", c.initials},
+		{"author", c.author},
+		{"compression", c.compression},
+		{"level", strconv.Itoa(c.level)},
+		{"precision", c.precision},
+		{"outside", c.outside},
+		{"eol", c.eol},
+		{"restored", c.restored},
+		{"previous", c.previous},
+		{"delta", strconv.Itoa(c.delta)},
+		{"encrypt", c.encrypt},
+		{"trash", c.trash},
+		{"editor", c.editor},
+		{"suffix", c.suffix},
+	}
+}
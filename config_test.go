@@ -0,0 +1,34 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConfigInitials(t *testing.T) {
+	dir := newTestRepo(t)
+	msm(t, dir, "config", "initials", "JD")
+	if out := msm(t, dir, "config", "initials"); strings.TrimSpace(out) != "JD" {
+		t.Errorf("config initials: got %q", out)
+	}
+	if out := msm(t, dir, "config"); !strings.Contains(out, "initials") || !strings.Contains(out, "JD") {
+		t.Errorf("config does not list the initials:\n%s", out)
+	}
+
+	track(t, dir, "paper", "paper")
+	if file := update(t, dir, "paper", "draft.txt", "text\n"); file != "paper_1_JD.txt" {
+		t.Errorf("version file %s, want paper_1_JD.txt", file)
+	}
+}
+
+func TestConfigRejectsBadValues(t *testing.T) {
+	dir := newTestRepo(t)
+	for _, kv := range [][2]string{{"initials", ""}, {"level", "10"}, {"compression", "xz"}, {"nope", "x"}} {
+		if r := run(t, dir, "", "config", kv[0], kv[1]); r.code == ExitOK {
+			t.Errorf("config %s %q accepted", kv[0], kv[1])
+		}
+	}
+	if r := run(t, dir, "", "config", "compression", "zstd"); !strings.Contains(r.stderr, "zstd is not available") {
+		t.Errorf("config compression zstd: exit %d\n%s", r.code, r.stderr)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+/*
+ * With config encrypt set to on, new archives are sealed with
+ * AES-256-GCM under a key derived from a passphrase, so they can't be
+ * read on disk or in a synced folder without it. A sealed archive is
+ *
+ *	MSMCRYPT\n salt nonce ciphertext
+ *
+ * where the ciphertext holds the archive as it would be otherwise,
+ * delta header included. Ids are still the sha1 of the content, so
+ * a version is found and shared the same way. The salt is the one of
+ * the repository, kept in msmanager-data/crypt with a sealed check
+ * value that tells a wrong passphrase before anything is written.
+ * The passphrase is taken from MSMANAGER_PASSPHRASE or asked once,
+ * without showing it when asked on a terminal.
+ * Archives written before encryption was turned on stay readable.
+ */
+
+const cryptMagic = "MSMCRYPT\n"
+
+const PassphraseEnv = "MSMANAGER_PASSPHRASE"
+
+const (
+	saltSize      = 16
+	kdfIterations = 600000
+	cryptCheck    = "msmanager"
+)
+
+type sealer func(plain []byte) ([]byte, error)
+
+var passphrase string
+
+/* Why there is no passphrase, so it is not asked for again */
+var passphraseErr error
+
+/* Keys already derived, by salt, as deriving one is slow on purpose */
+var derivedKeys = make(map[string][]byte)
+
+func askPassphrase(confirm bool) (string, error) {
+	if passphrase != "" || passphraseErr != nil {
+		return passphrase, passphraseErr
+	}
+	if p := os.Getenv(PassphraseEnv); p != "" {
+		passphrase = p
+		return p, nil
+	}
+
+	ask := func(prompt string) (string, error) {
+		fmt.Fprintf(os.Stderr, "%s: ", prompt)
+		read := func() (string, error) {
+			line, err := stdin.ReadString('\n')
+			if err != nil && (err != io.EOF || line == "") {
+				return "", fmt.Errorf("no passphrase given (set %s)", PassphraseEnv)
+			}
+			return strings.TrimRight(line, "\r\n"), nil
+		}
+		if isTerminal(os.Stdin) {
+			return readHidden(os.Stdin, read)
+		}
+		return read()
+	}
+	p, err := ask("Passphrase")
+	if err != nil {
+		passphraseErr = err
+		return "", err
+	}
+	if p == "" {
+		passphraseErr = fmt.Errorf("passphrase can't be empty")
+		return "", passphraseErr
+	}
+	if confirm {
+		again, err := ask("Passphrase again")
+		if err != nil {
+			return "", err
+		}
+		if again != p {
+			return "", fmt.Errorf("passphrases do not match")
+		}
+	}
+	passphrase = p
+	return p, nil
+}
+
+func deriveKey(salt []byte, confirm bool) ([]byte, error) {
+	if key, ok := derivedKeys[string(salt)]; ok {
+		return key, nil
+	}
+	p, err := askPassphrase(confirm)
+	if err != nil {
+		return nil, err
+	}
+	key, err := pbkdf2.Key(sha256.New, p, salt, kdfIterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	derivedKeys[string(salt)] = key
+	return key, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func seal(salt, key, plain []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := append([]byte(cryptMagic), salt...)
+	out = append(out, nonce...)
+	return gcm.Seal(out, nonce, plain, []byte(cryptMagic)), nil
+}
+
+func isSealed(head []byte) bool {
+	return bytes.HasPrefix(head, []byte(cryptMagic))
+}
+
+func unseal(data []byte, confirm bool) ([]byte, error) {
+	data = bytes.TrimPrefix(data, []byte(cryptMagic))
+	if len(data) < saltSize {
+		return nil, fmt.Errorf("sealed data too short")
+	}
+	salt := data[:saltSize]
+	key, err := deriveKey(salt, confirm)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	data = data[saltSize:]
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("sealed data too short")
+	}
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], []byte(cryptMagic))
+	if err != nil {
+		return nil, fmt.Errorf("wrong passphrase or damaged data")
+	}
+	return plain, nil
+}
+
+func (repo *Repo) sealer() (sealer, error) {
+	/*
+	 * How to seal new archives, nil if encryption is off. The first
+	 * time it is on, pick the salt of the repository and store it.
+	 */
+	if repo.config.encrypt != "on" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(repo.cryptFile)
+	if os.IsNotExist(err) {
+		salt := make([]byte, saltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		key, err := deriveKey(salt, true)
+		if err != nil {
+			return nil, err
+		}
+		if data, err = seal(salt, key, []byte(cryptCheck)); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(repo.cryptFile, data, 0644); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	check, err := unseal(data, false)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", repo.cryptFile, err)
+	}
+	if string(check) != cryptCheck {
+		return nil, fmt.Errorf("%s: unexpected content", repo.cryptFile)
+	}
+	salt := bytes.TrimPrefix(data, []byte(cryptMagic))[:saltSize]
+	key := derivedKeys[string(salt)]
+	return func(plain []byte) ([]byte, error) {
+		return seal(salt, key, plain)
+	}, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func withPassphrase(t *testing.T, p string) {
+	/* Forget the passphrase and keys of the test process, and take p */
+	t.Helper()
+	savedPassphrase, savedErr, savedKeys := passphrase, passphraseErr, derivedKeys
+	passphrase, passphraseErr, derivedKeys = p, nil, make(map[string][]byte)
+	t.Cleanup(func() { passphrase, passphraseErr, derivedKeys = savedPassphrase, savedErr, savedKeys })
+}
+
+func TestSealRoundTrip(t *testing.T) {
+	salt := []byte("0123456789abcdef")
+	plain := []byte("embargoed until publication\n")
+	withPassphrase(t, "correct horse")
+	key, err := deriveKey(salt, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := seal(salt, key, plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isSealed(sealed) || strings.Contains(string(sealed), "embargoed") {
+		t.Errorf("sealed data: %q", sealed)
+	}
+	if got, err := unseal(sealed, false); err != nil || string(got) != string(plain) {
+		t.Errorf("unseal: %q, %v", got, err)
+	}
+
+	/* Sealed twice, it is not the same twice */
+	if again, _ := seal(salt, key, plain); string(again) == string(sealed) {
+		t.Errorf("sealing twice gave the same bytes")
+	}
+
+	damaged := bytes.Clone(sealed)
+	damaged[len(damaged)-1] ^= 1
+	if _, err := unseal(damaged, false); err == nil {
+		t.Errorf("unseal took damaged data")
+	}
+
+	withPassphrase(t, "wrong horse")
+	if _, err := unseal(sealed, false); err == nil || !strings.Contains(err.Error(), "wrong passphrase") {
+		t.Errorf("unseal with the wrong passphrase: %v", err)
+	}
+}
+
+func TestEncryptedRepository(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	msm(t, dir, "config", "encrypt", "on")
+	right := []string{PassphraseEnv + "=correct horse"}
+	wrong := []string{PassphraseEnv + "=wrong horse"}
+
+	content := "embargoed until publication\n"
+	writeFile(t, filepath.Join(dir, "a.txt"), content)
+	if r := runWith(t, dir, "", right, "--author", testAuthor, "--yes", "update", "paper", "a.txt"); r.code != ExitOK {
+		t.Fatalf("update of an encrypted repository: exit %d\n%s", r.code, r.stderr)
+	}
+
+	/* Sealed on disk, with the id of the plain content */
+	v := versionsOf(t, dir, "paper")
+	sum := sha1.Sum([]byte(content))
+	if len(v) != 1 || v[0].ID != hex.EncodeToString(sum[:]) {
+		t.Fatalf("versions of an encrypted repository: %+v", v)
+	}
+	repo := openTestRepo(t, dir)
+	if data, err := os.ReadFile(repo.archivePath(v[0].ID)); err != nil || !isSealed(data) {
+		t.Errorf("archive on disk is not sealed: %v", err)
+	}
+
+	out := filepath.Join(t.TempDir(), "out.txt")
+	if r := runWith(t, dir, "", right, "restore", "-o", out, "paper", "1"); r.code != ExitOK || readFile(t, out) != content {
+		t.Errorf("restore with the passphrase: exit %d\n%s", r.code, r.stderr)
+	}
+	os.Remove(out)
+
+	/* A wrong passphrase or none gets nothing, and writes nothing */
+	r := runWith(t, dir, "", wrong, "restore", "-o", out, "paper", "1")
+	if r.code == ExitOK || !strings.Contains(r.stderr, "wrong passphrase") || exists(out) {
+		t.Errorf("restore with the wrong passphrase: exit %d\n%s", r.code, r.stderr)
+	}
+	if r := run(t, dir, "", "restore", "-o", out, "paper", "1"); r.code == ExitOK || !strings.Contains(r.stderr, "no passphrase given") {
+		t.Errorf("restore without a passphrase: exit %d\n%s", r.code, r.stderr)
+	}
+	writeFile(t, filepath.Join(dir, "b.txt"), "two\n")
+	if r := runWith(t, dir, "", wrong, "--author", testAuthor, "--yes", "update", "paper", "b.txt"); r.code == ExitOK {
+		t.Errorf("update with the wrong passphrase succeeded")
+	}
+	if len(versionsOf(t, dir, "paper")) != 1 || readFile(t, filepath.Join(dir, "b.txt")) != "two\n" {
+		t.Errorf("update with the wrong passphrase changed the repository")
+	}
+	if names := archiveNames(t, repo.archivesDir); len(names) != 1 {
+		t.Errorf("archives after a wrong passphrase: %q", names)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+/*
+ * With config delta set to N, update stores a new version as a delta
+ * against the version before it, and a full archive every N versions.
+ * A delta archive starts with a line naming the archive it is based on,
+ *
+ *	MSMDELTA <id>
+ *
+ * followed by the compressed delta: a list of operations that copy a
+ * piece of the base or insert new bytes,
+ *
+ *	'c' offset length      copy length bytes of the base from offset
+ *	'i' length bytes       insert the bytes
+ *
+ * with numbers as uvarints. openArchive rebuilds the content, walking
+ * back to the full archive, so everything that reads archives works
+ * the same with deltas. The base is named by its id as any archive,
+ * and must be kept while a delta needs it.
+ */
+
+const deltaMagic = "MSMDELTA "
+
+/* Pieces shorter than this are inserted, a copy would not be worth it */
+const deltaBlock = 32
+
+func makeDelta(base, target []byte) []byte {
+	/*
+	 * Index the base by blocks, look for each block of the target
+	 * in it and extend every match as far as it goes.
+	 */
+	index := make(map[string]int)
+	for off := 0; off+deltaBlock <= len(base); off += deltaBlock {
+		if _, ok := index[string(base[off:off+deltaBlock])]; !ok {
+			index[string(base[off:off+deltaBlock])] = off
+		}
+	}
+
+	var delta []byte
+	var insert []byte
+	flush := func() {
+		if len(insert) > 0 {
+			delta = append(delta, 'i')
+			delta = binary.AppendUvarint(delta, uint64(len(insert)))
+			delta = append(delta, insert...)
+			insert = nil
+		}
+	}
+
+	for pos := 0; pos < len(target); {
+		off, ok := -1, false
+		if pos+deltaBlock <= len(target) {
+			off, ok = index[string(target[pos:pos+deltaBlock])]
+		}
+		if !ok {
+			insert = append(insert, target[pos])
+			pos++
+			continue
+		}
+
+		n := deltaBlock
+		for off+n < len(base) && pos+n < len(target) && base[off+n] == target[pos+n] {
+			n++
+		}
+		next := pos + n
+		/* Take back what the pending insert shares with the base */
+		for off > 0 && len(insert) > 0 && base[off-1] == insert[len(insert)-1] {
+			off--
+			n++
+			insert = insert[:len(insert)-1]
+		}
+		flush()
+		delta = append(delta, 'c')
+		delta = binary.AppendUvarint(delta, uint64(off))
+		delta = binary.AppendUvarint(delta, uint64(n))
+		pos = next
+	}
+	flush()
+	return delta
+}
+
+func applyDelta(base, delta []byte) ([]byte, error) {
+	var out []byte
+	r := bytes.NewReader(delta)
+	for {
+		op, err := r.ReadByte()
+		if err == io.EOF {
+			return out, nil
+		}
+		switch op {
+		case 'c':
+			off, err1 := binary.ReadUvarint(r)
+			n, err2 := binary.ReadUvarint(r)
+			if err1 != nil || err2 != nil || off+n > uint64(len(base)) {
+				return nil, fmt.Errorf("bad delta: copy out of the base")
+			}
+			out = append(out, base[off:off+n]...)
+		case 'i':
+			n, err := binary.ReadUvarint(r)
+			if err != nil || n > uint64(r.Len()) {
+				return nil, fmt.Errorf("bad delta: short insert")
+			}
+			piece := make([]byte, n)
+			io.ReadFull(r, piece)
+			out = append(out, piece...)
+		default:
+			return nil, fmt.Errorf("bad delta: unknown operation %q", op)
+		}
+	}
+}
+
+func readDeltaBase(buf *bufio.Reader) (string, bool) {
+	/* The id a delta archive is based on, if it is one */
+	head, _ := buf.Peek(len(deltaMagic))
+	if string(head) != deltaMagic {
+		return "", false
+	}
+	line, err := buf.ReadString('\n')
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimSpace(strings.TrimPrefix(line, deltaMagic)), true
+}
+
+func openDelta(archive, baseID string, f io.Closer, buf *bufio.Reader) (io.ReadCloser, error) {
+	/* Rebuild the content from the base, itself maybe a delta */
+	defer f.Close()
+	base, err := readArchive(archivePathIn(archivesDirOf(archive), baseID, DefaultSuffix))
+	if err != nil {
+		return nil, fmt.Errorf("%s: base %s: %w", archive, baseID, err)
+	}
+	r, err := openCompressed(archive, f, buf)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	delta, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	content, err := applyDelta(base, delta)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", archive, err)
+	}
+	return io.NopCloser(bytes.NewReader(content)), nil
+}
+
+func readArchive(archive string) ([]byte, error) {
+	r, err := openArchive(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func archiveBase(archive string) (string, bool) {
+	/*
+	 * A sealed archive that can't be opened may be a delta, and
+	 * taking it for a full one could let gc remove its base.
+	 */
+	f, buf, err := openRaw(archive)
+	if err != nil && !os.IsNotExist(err) {
+		fail(err)
+	} else if err != nil {
+		return "", false
+	}
+	defer f.Close()
+	return readDeltaBase(buf)
+}
+
+func (repo *Repo) deltaDepth(id string) int {
+	/* How many deltas there are from the archive of id to a full one */
+	depth := 0
+	for {
+		base, ok := archiveBase(repo.archivePath(id))
+		if !ok {
+			return depth
+		}
+		id = base
+		depth++
+	}
+}
+
+func (repo *Repo) withBases(ids map[string]bool) {
+	/* Add to ids the archives the deltas among them are based on */
+	var todo []string
+	for id := range ids {
+		todo = append(todo, id)
+	}
+	for len(todo) > 0 {
+		id := todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+		if base, ok := archiveBase(repo.archivePath(id)); ok && !ids[base] {
+			ids[base] = true
+			todo = append(todo, base)
+		}
+	}
+}
+
+func (repo *Repo) compressDelta(label, origFile string, v Version, archive string) (bool, error) {
+	/*
+	 * Store v as a delta against the version before it, if deltas
+	 * are on and the chain from there is not too long yet. Tells if
+	 * it did, so the caller compresses a full archive otherwise.
+	 */
+	if repo.config.delta < 2 || v.parent == "none" || v.parent == "-" {
+		return false, nil
+	}
+	if repo.deltaDepth(v.parent)+1 >= repo.config.delta {
+		return false, nil
+	}
+	base, err := readArchive(repo.archivePath(v.parent))
+	if err != nil {
+		return false, err
+	}
+	in, err := repo.openInput(label, origFile)
+	if err != nil {
+		return false, err
+	}
+	in = withProgress(in, origFile, v.size)
+	target, err := io.ReadAll(in)
+	in.Close()
+	if err != nil {
+		return false, err
+	}
+
+	seal, err := repo.sealer()
+	if err != nil {
+		return false, err
+	}
+	header := []byte(deltaMagic + v.parent + "\n")
+	delta := makeDelta(base, target)
+	debugf("delta of %d bytes against %s", len(delta), v.parent)
+	return true, writeArchive(archive, header, bytes.NewReader(delta), repo.config.compression, repo.config.level, seal)
+}
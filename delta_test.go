@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestDeltaRoundTrip(t *testing.T) {
+	base := randomContent(1 << 15)
+	edited := append(bytes.Clone(base[:1000]), []byte("a new paragraph\n")...)
+	edited = append(edited, base[1200:]...)
+	for name, target := range map[string][]byte{
+		"same":      base,
+		"empty":     {},
+		"edited":    edited,
+		"prepended": append([]byte("title\n"), base...),
+		"appended":  append(bytes.Clone(base), "the end\n"...),
+		"shuffled":  append(bytes.Clone(base[1<<14:]), base[:1<<14]...),
+		"new":       []byte("nothing in common"),
+	} {
+		delta := makeDelta(base, target)
+		got, err := applyDelta(base, delta)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if !bytes.Equal(got, target) {
+			t.Errorf("%s: the delta gives %d bytes, not the %d of the target", name, len(got), len(target))
+		}
+		if name != "new" && name != "empty" && len(delta) > len(target)/10 {
+			t.Errorf("%s: delta of %d bytes for %d", name, len(delta), len(target))
+		}
+	}
+
+	/* Deltas against nothing and to nothing */
+	if got, err := applyDelta(nil, makeDelta(nil, base)); err != nil || !bytes.Equal(got, base) {
+		t.Errorf("delta from an empty base: %v", err)
+	}
+	for _, bad := range [][]byte{{'c', 0, 0xff, 0x7f}, {'i', 10, 'x'}, {'x'}} {
+		if _, err := applyDelta(base[:16], bad); err == nil {
+			t.Errorf("applyDelta took the bad delta %q", bad)
+		}
+	}
+}
+
+func TestDeltaChain(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	msm(t, dir, "config", "delta", "3")
+
+	/* A chain of edits, each a few changes to the one before */
+	r := rand.New(rand.NewSource(2))
+	content := randomContent(1 << 15)
+	var contents [][]byte
+	for i := range 8 {
+		for range 3 {
+			at := r.Intn(len(content))
+			content = append(content[:at:at], append([]byte(fmt.Sprintf("edit %d\n", i)), content[at+r.Intn(100):]...)...)
+		}
+		contents = append(contents, bytes.Clone(content))
+		update(t, dir, "paper", "in.dat", string(content))
+	}
+
+	/* A full archive every three versions, and deltas that are small */
+	repo := openTestRepo(t, dir)
+	for i, v := range versionsOf(t, dir, "paper") {
+		if depth := repo.deltaDepth(v.ID); depth != i%3 {
+			t.Errorf("version %d is %d deltas from a full archive", v.Version, depth)
+		}
+		info, err := os.Stat(repo.archivePath(v.ID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if full := i%3 == 0; !full && info.Size() > 1<<10 {
+			t.Errorf("the delta of version %d is %d bytes", v.Version, info.Size())
+		}
+	}
+
+	/* Every version comes back as it was, by restore and by checkout */
+	for i, want := range contents {
+		out := filepath.Join(t.TempDir(), "out.dat")
+		msm(t, dir, "restore", "-o", out, "paper", strconv.Itoa(i+1))
+		if got := readFile(t, out); got != string(want) {
+			t.Errorf("restore of version %d: %d bytes, want %d", i+1, len(got), len(want))
+		}
+	}
+	msm(t, dir, "--author", testAuthor, "--yes", "checkout", "paper", "5")
+	if got := readFile(t, filepath.Join(dir, latestFile(t, dir, "paper"))); got != string(contents[4]) {
+		t.Errorf("checkout of version 5: %d bytes, want %d", len(got), len(contents[4]))
+	}
+	msm(t, dir, "verify")
+}
+
+func TestBatchDelta(t *testing.T) {
+	/* Batch stores deltas as update does, with every number of jobs */
+	for _, jobs := range []string{"1", "4"} {
+		dir := newTestRepo(t)
+		track(t, dir, "paper", "paper")
+		msm(t, dir, "config", "delta", "3")
+		content := randomContent(1 << 14)
+		update(t, dir, "paper", "v1.dat", string(content))
+
+		writeFile(t, filepath.Join(dir, "v2.dat"), string(content)+"second\n")
+		writeFile(t, filepath.Join(dir, "v3.dat"), string(content)+"second\nthird\n")
+		writeFile(t, filepath.Join(dir, "manifest"), joinFields("paper", "v2.dat", testAuthor)+"\n"+joinFields("paper", "v3.dat", testAuthor)+"\n")
+		msm(t, dir, "--yes", "batch", "--jobs", jobs, "manifest")
+
+		repo := openTestRepo(t, dir)
+		for i, v := range versionsOf(t, dir, "paper") {
+			if depth := repo.deltaDepth(v.ID); depth != i {
+				t.Errorf("jobs %s: version %d is %d deltas from a full archive", jobs, v.Version, depth)
+			}
+		}
+		if names := archiveNames(t, repo.archivesDir); len(names) != 3 {
+			t.Errorf("jobs %s: archives after batch: %q", jobs, names)
+		}
+		msm(t, dir, "verify")
+	}
+}
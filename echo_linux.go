@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"unsafe"
+)
+
+func readHidden(f *os.File, read func() (string, error)) (string, error) {
+	/*
+	 * Run read with the echo of terminal f turned off, so what is
+	 * typed is not shown, and turn it back on even on an interrupt.
+	 */
+	fd := f.Fd()
+	var saved syscall.Termios
+	if err := termios(fd, syscall.TCGETS, &saved); err == syscall.ENOTTY {
+		/* A character device that is not a terminal, like /dev/null */
+		return read()
+	} else if err != nil {
+		return "", err
+	}
+	hidden := saved
+	hidden.Lflag &^= syscall.ECHO
+	if err := termios(fd, syscall.TCSETS, &hidden); err != nil {
+		return "", err
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-interrupt:
+			termios(fd, syscall.TCSETS, &saved)
+			fmt.Fprintln(os.Stderr)
+			os.Exit(ExitError)
+		case <-done:
+		}
+	}()
+	defer func() {
+		close(done)
+		signal.Stop(interrupt)
+		termios(fd, syscall.TCSETS, &saved)
+		/* The newline typed was not shown either */
+		fmt.Fprintln(os.Stderr)
+	}()
+	return read()
+}
+
+func termios(fd uintptr, request uintptr, t *syscall.Termios) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, uintptr(unsafe.Pointer(t))); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func readHidden(f *os.File, read func() (string, error)) (string, error) {
+	/* No way to turn the echo off here, and a passphrase is not to be shown */
+	return "", fmt.Errorf("can't hide the passphrase as it is typed here, set %s", PassphraseEnv)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+)
+
+/*
+ * Exit codes, so scripts can tell failures apart. Errors carry
+ * their code with exitError; missing files count as not found, and
+ * anything else is a general error.
+ */
+const (
+	ExitOK        = 0
+	ExitError     = 1
+	ExitUsage     = 2
+	ExitNotFound  = 3
+	ExitIntegrity = 4
+)
+
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+func usageError(format string, a ...any) error {
+	return &exitError{ExitUsage, fmt.Errorf(format, a...)}
+}
+
+func notFoundError(format string, a ...any) error {
+	return &exitError{ExitNotFound, fmt.Errorf(format, a...)}
+}
+
+func integrityError(format string, a ...any) error {
+	return &exitError{ExitIntegrity, fmt.Errorf(format, a...)}
+}
+
+func exitCode(err error) int {
+	var e *exitError
+	switch {
+	case errors.As(err, &e):
+		return e.code
+	case errors.Is(err, fs.ErrNotExist):
+		return ExitNotFound
+	}
+	return ExitError
+}
+
+func fail(err error) {
+	/* Like log.Fatal, with the exit code that matches err */
+	log.Print(err)
+	os.Exit(exitCode(err))
+}
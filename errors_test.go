@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestExitCode(t *testing.T) {
+	_, notExist := os.Stat("/nonexistent/file")
+	for _, tt := range []struct {
+		err  error
+		want int
+	}{
+		{usageError("bad flag"), ExitUsage},
+		{notFoundError("no such label"), ExitNotFound},
+		{integrityError("damaged"), ExitIntegrity},
+		{fmt.Errorf("wrapped: %w", integrityError("damaged")), ExitIntegrity},
+		{notExist, ExitNotFound},
+		{fmt.Errorf("reading: %w", notExist), ExitNotFound},
+		{fmt.Errorf("disk full"), ExitError},
+	} {
+		if got := exitCode(tt.err); got != tt.want {
+			t.Errorf("exitCode(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestExitCodes(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	update(t, dir, "paper", "a.txt", "one\n")
+	repo := openTestRepo(t, dir)
+
+	for _, tt := range []struct {
+		code int
+		args []string
+	}{
+		{ExitUsage, []string{"nonsense"}},
+		{ExitUsage, []string{"restore"}},
+		{ExitUsage, []string{"undo", "-1"}},
+		{ExitUsage, []string{"hist", "--since", "tomorrow"}},
+		{ExitNotFound, []string{"latest", "nope"}},
+		{ExitNotFound, []string{"restore", "paper", "7"}},
+		{ExitNotFound, []string{"--yes", "--author", testAuthor, "update", "paper", "missing.txt"}},
+		{ExitError, []string{"track", "paper", "other"}},
+	} {
+		msmFails(t, dir, tt.code, tt.args...)
+	}
+	msmFails(t, t.TempDir(), ExitNotFound, "hist")
+	if !strings.Contains(run(t, dir, "", "help").stdout, "4 integrity problem or repository locked") {
+		t.Errorf("usage does not document the exit codes")
+	}
+
+	/* A damaged archive, and a repository locked by someone else */
+	writeFile(t, repo.archivePath(versionsOf(t, dir, "paper")[0].ID), "damaged")
+	msmFails(t, dir, ExitIntegrity, "verify")
+	if err := repo.tryLock(); err != nil {
+		t.Fatal(err)
+	}
+	defer repo.unlock()
+	if !testing.Short() {
+		/* This one waits LockTimeout for the lock first */
+		msmFails(t, dir, ExitIntegrity, "track", "other", "other")
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+/*
+ * fsck checks what verify does and tells which problems it can fix:
+ * rows of the versions-table whose archive is gone, parents left
+ * pointing to them, and sizes and mtimes recorded as unknown that
+ * the archive or an intact version file still tell. With --repair
+ * it rewrites the table to match what there is. It never removes an
+ * archive, so whatever it can't fix is still there to look at.
+ */
+
+func fsck(repo *Repo, args []string) {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := fs.Bool("repair", false, "fix the versions-table where it is safe")
+	args = parseArgs(fs, args[2:])
+
+	if len(args) != 0 {
+		fmt.Fprintf(os.Stderr, "Too many arguments.\n")
+		usage(ExitUsage)
+		return
+	}
+
+	if *repair {
+		repo.lock()
+		defer repo.unlock()
+	}
+
+	versions := repo.readVersionsTable()
+	checked := make(map[string]error)
+	missing := make(map[string]bool)
+	var fixes, unfixed int
+	for _, v := range versions {
+		if v.id == "none" {
+			continue
+		}
+		if _, ok := checked[v.id]; !ok {
+			checked[v.id] = checkArchive(repo.archivePath(v.id), v.id)
+		}
+		if _, err := os.Stat(repo.archivePath(v.id)); os.IsNotExist(err) {
+			missing[v.id] = true
+			fmt.Printf("%s %d %s: archive missing, remove the row\n", v.label, v.versionNumber, v.id)
+			fixes++
+		} else if err := checked[v.id]; err != nil {
+			fmt.Printf("%s %d %s: %v, can't repair\n", v.label, v.versionNumber, v.id, err)
+			unfixed++
+		}
+	}
+
+	var kept []*Version
+	last := make(map[string]string)
+	for _, v := range versions {
+		if missing[v.id] {
+			continue
+		}
+		kept = append(kept, v)
+		if v.versionNumber == 0 {
+			continue
+		}
+
+		/* Each version must point to the one before it that is kept */
+		expected, ok := last[v.label]
+		if !ok {
+			expected = "none"
+		}
+		last[v.label] = v.id
+		if v.parent == "-" || missing[v.parent] {
+			fmt.Printf("%s %d %s: set parent to %s\n", v.label, v.versionNumber, v.id, expected)
+			v.parent = expected
+			fixes++
+		} else if v.parent != expected {
+			fmt.Printf("%s %d %s: parent is %s, expected %s, can't repair\n", v.label, v.versionNumber, v.id, v.parent, expected)
+			unfixed++
+		}
+
+		if v.size >= 0 && !v.mtime.IsZero() {
+			continue
+		}
+		fi, intact := repo.intactFile(v)
+		if v.size < 0 {
+			if size, err := repo.derivedSize(v, intact, checked[v.id]); err == nil {
+				fmt.Printf("%s %d %s: set size to %d\n", v.label, v.versionNumber, v.id, size)
+				v.size = size
+				fixes++
+			}
+		}
+		if v.mtime.IsZero() && intact {
+			fmt.Printf("%s %d %s: set mtime to %s\n", v.label, v.versionNumber, v.id, formatMtime(fi.ModTime()))
+			v.mtime = fi.ModTime()
+			fixes++
+		}
+	}
+
+	if fixes == 0 && unfixed == 0 {
+		inform("No problems found.\n")
+		return
+	}
+	if !*repair {
+		fmt.Printf("%d problems found, %d can be repaired with --repair.\n", fixes+unfixed, fixes)
+		os.Exit(ExitIntegrity)
+	}
+
+	if fixes > 0 {
+		if len(missing) > 0 && !askYesNo(stdin, "Remove the rows of missing archives?") {
+			fmt.Println("Abort.")
+			return
+		}
+		lines := []string{schemaMarker()}
+		for _, v := range kept {
+			lines = append(lines, joinFields(v.fields()...))
+		}
+		if err := writeLines(repo.versionsTable, lines); err != nil {
+			fail(err)
+		}
+		repo.tableChanged()
+		repo.editOplog(func(op Op) *Op {
+			for _, v := range versions {
+				if missing[v.id] && op.made(v) {
+					return nil
+				}
+			}
+			return &op
+		})
+		inform("%d problems repaired.\n", fixes)
+	}
+	if unfixed > 0 {
+		fmt.Printf("%d problems can't be repaired.\n", unfixed)
+		os.Exit(ExitIntegrity)
+	}
+}
+
+func checkArchive(archive, id string) error {
+	sum, err := archiveSha1(archive)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("archive missing")
+	} else if err == nil && sum != id {
+		return fmt.Errorf("content does not match id (got %s)", sum)
+	}
+	return err
+}
+
+func (repo *Repo) intactFile(v *Version) (os.FileInfo, bool) {
+	/* The version file of v, if it is there unchanged */
+	path := repo.workPath(v.file)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, false
+	}
+	sum, err := repo.inputSha1(v.label, path)
+	return fi, err == nil && sum == v.id
+}
+
+func (repo *Repo) derivedSize(v *Version, intact bool, archiveErr error) (int64, error) {
+	/*
+	 * The size of an intact version file is the size it had. A file
+	 * archived byte for byte has the size of what the archive holds.
+	 */
+	if intact {
+		return contentSize(repo.workPath(v.file))
+	}
+	if v.isDir() || repo.isText(v.label) {
+		return 0, fmt.Errorf("size unknown")
+	}
+	if archiveErr != nil {
+		return 0, archiveErr
+	}
+	r, err := openArchive(repo.archivePath(v.id))
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	return io.Copy(io.Discard, r)
+}
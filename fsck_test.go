@@ -0,0 +1,117 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFsckIntact(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	update(t, dir, "paper", "a.txt", "one\n")
+	update(t, dir, "paper", "a.txt", "two\n")
+	table := readFile(t, openTestRepo(t, dir).versionsTable)
+
+	for _, args := range [][]string{{"fsck"}, {"--yes", "fsck", "--repair"}} {
+		if out := msm(t, dir, args...); out != "No problems found.\n" {
+			t.Errorf("%s of an intact repository:\n%s", strings.Join(args, " "), out)
+		}
+	}
+	if got := readFile(t, openTestRepo(t, dir).versionsTable); got != table {
+		t.Errorf("fsck --repair changed an intact table:\n%s\nwas:\n%s", got, table)
+	}
+}
+
+func TestFsckMissingArchive(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	update(t, dir, "paper", "a.txt", "one\n")
+	update(t, dir, "paper", "a.txt", "two\n")
+	update(t, dir, "paper", "a.txt", "three\n")
+	repo := openTestRepo(t, dir)
+	v := versionsOf(t, dir, "paper")
+	if err := os.Remove(repo.archivePath(v[1].ID)); err != nil {
+		t.Fatal(err)
+	}
+	table := readFile(t, repo.versionsTable)
+
+	/* Only told about, without --repair or when answered no */
+	r := msmFails(t, dir, ExitIntegrity, "fsck")
+	if !strings.Contains(r.stdout, "paper 2 "+v[1].ID+": archive missing, remove the row\n") ||
+		!strings.Contains(r.stdout, "paper 3 "+v[2].ID+": set parent to "+v[0].ID+"\n") ||
+		!strings.Contains(r.stdout, "2 problems found, 2 can be repaired with --repair.\n") {
+		t.Errorf("fsck with a missing archive:\n%s", r.stdout)
+	}
+	if out := run(t, dir, "n\n", "fsck", "--repair").stdout; !strings.Contains(out, "Abort.") {
+		t.Errorf("fsck --repair answered no:\n%s", out)
+	}
+	if got := readFile(t, repo.versionsTable); got != table {
+		t.Errorf("fsck changed the table:\n%s", got)
+	}
+
+	/* The row goes and the next version points past it */
+	if out := msm(t, dir, "--yes", "fsck", "--repair"); !strings.Contains(out, "2 problems repaired.\n") {
+		t.Errorf("fsck --repair:\n%s", out)
+	}
+	after := versionsOf(t, dir, "paper")
+	if len(after) != 2 || after[0].ID != v[0].ID || after[1].ID != v[2].ID || after[1].Parent != v[0].ID {
+		t.Errorf("versions after fsck --repair: %+v", after)
+	}
+	if names := archiveNames(t, repo.archivesDir); len(names) != 2 {
+		t.Errorf("archives after fsck --repair: %q", names)
+	}
+	msm(t, dir, "verify")
+}
+
+func TestFsckColumns(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	update(t, dir, "paper", "a.txt", "one\n")
+	update(t, dir, "paper", "a.txt", "second\n")
+	repo := openTestRepo(t, dir)
+
+	/* Sizes and mtimes unknown, as in an older schema */
+	err := editTable(repo.versionsTable, func(field []string) []string {
+		if field[3] != "0" {
+			field[9], field[11] = "-", "-"
+		}
+		return field
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := versionsOf(t, dir, "paper")
+	info, err := os.Stat(filepath.Join(dir, v[1].File))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := msm(t, dir, "--yes", "fsck", "--repair")
+	for _, fix := range []string{
+		"paper 1 " + v[0].ID + ": set size to 4\n",
+		"paper 2 " + v[1].ID + ": set size to 7\n",
+		"paper 2 " + v[1].ID + ": set mtime to " + formatMtime(info.ModTime()) + "\n",
+		"3 problems repaired.\n",
+	} {
+		if !strings.Contains(out, fix) {
+			t.Errorf("fsck --repair does not tell %q:\n%s", fix, out)
+		}
+	}
+	after := versionsOf(t, dir, "paper")
+	if after[0].Size == nil || *after[0].Size != 4 || after[1].Size == nil || *after[1].Size != 7 {
+		t.Errorf("sizes after fsck --repair: %+v", after)
+	}
+
+	/* What it can't fix it leaves, archive and all */
+	archive := repo.archivePath(v[0].ID)
+	writeFile(t, archive, "not an archive")
+	r := msmFails(t, dir, ExitIntegrity, "--yes", "fsck", "--repair")
+	if !strings.Contains(r.stdout, "can't repair") || !strings.Contains(r.stdout, "1 problems can't be repaired.\n") {
+		t.Errorf("fsck --repair of a broken archive:\n%s", r.stdout)
+	}
+	if !exists(archive) || len(versionsOf(t, dir, "paper")) != 2 {
+		t.Errorf("fsck --repair removed what it can't repair")
+	}
+}
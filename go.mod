@@ -0,0 +1,3 @@
+module github.com/fdecunta/msmanager
+
+go 1.24
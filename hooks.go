@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+)
+
+/*
+ * An executable msmanager-data/hooks/post-update is run once for every
+ * version a command adds, after the command is done and the lock is
+ * released, so the hook can run msmanager itself. It gets the version
+ * in the environment:
+ *
+ *	MSMANAGER_LABEL MSMANAGER_VERSION MSMANAGER_FILE MSMANAGER_ID
+ *	MSMANAGER_AUTHOR
+ *
+ * and runs in the repository root. A failing hook is reported, the
+ * version stays.
+ */
+
+const PostUpdateHook = "post-update"
+
+func (repo *Repo) queueHook(v Version) {
+	repo.added = append(repo.added, v)
+}
+
+func (repo *Repo) runHooks() {
+	added := repo.added
+	repo.added = nil
+	if len(added) == 0 {
+		return
+	}
+
+	hook := filepath.Join(repo.dataDir, "hooks", PostUpdateHook)
+	fi, err := os.Stat(hook)
+	if err != nil || fi.IsDir() || fi.Mode().Perm()&0111 == 0 {
+		return
+	}
+	hook, err = filepath.Abs(hook)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+
+	for _, v := range added {
+		debugf("run %s for version %d of %q", hook, v.versionNumber, v.label)
+		cmd := exec.Command(hook)
+		cmd.Dir = repo.root
+		cmd.Env = append(os.Environ(),
+			"MSMANAGER_LABEL="+v.label,
+			"MSMANAGER_VERSION="+strconv.Itoa(v.versionNumber),
+			"MSMANAGER_FILE="+v.file,
+			"MSMANAGER_ID="+v.id,
+			"MSMANAGER_AUTHOR="+v.author)
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: %s hook for version %d of %q: %v\n", PostUpdateHook, v.versionNumber, v.label, err)
+		}
+	}
+}
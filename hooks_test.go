@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPostUpdateHook(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	hook := filepath.Join(dir, DataDirName, "hooks", PostUpdateHook)
+	logFile := filepath.Join(t.TempDir(), "hook.log")
+	writeFile(t, hook, `#!/bin/sh
+echo "$MSMANAGER_LABEL $MSMANAGER_VERSION $MSMANAGER_FILE $MSMANAGER_ID $MSMANAGER_AUTHOR $(pwd)" >> "$HOOK_LOG"
+exit $HOOK_EXIT
+`)
+	env := []string{"HOOK_LOG=" + logFile, "HOOK_EXIT=0"}
+	updateWith := func(env []string, file, content string) result {
+		t.Helper()
+		writeFile(t, filepath.Join(dir, file), content)
+		return runWith(t, dir, "", env, "--author", testAuthor, "--yes", "update", "paper", file)
+	}
+
+	/* Not executable, not run */
+	updateWith(env, "a.txt", "one\n")
+	if exists(logFile) {
+		t.Errorf("a hook that is not executable was run")
+	}
+
+	if err := os.Chmod(hook, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if r := updateWith(env, "b.txt", "two\n"); r.code != ExitOK {
+		t.Fatalf("update with a hook: exit %d\n%s", r.code, r.stderr)
+	}
+	v := versionsOf(t, dir, "paper")[1]
+	want := strings.Join([]string{"paper", "2", v.File, v.ID, testAuthor, dir}, " ") + "\n"
+	if got := readFile(t, logFile); got != want {
+		t.Errorf("the hook got %q, want %q", got, want)
+	}
+
+	/* A failing hook warns, and the version stays */
+	r := updateWith([]string{"HOOK_LOG=" + logFile, "HOOK_EXIT=3"}, "c.txt", "three\n")
+	if r.code != ExitOK || !strings.Contains(r.stderr, `WARNING: post-update hook for version 3 of "paper"`) {
+		t.Errorf("update with a failing hook: exit %d\n%s", r.code, r.stderr)
+	}
+	if v := versionsOf(t, dir, "paper"); len(v) != 3 {
+		t.Errorf("versions after a failing hook: %+v", v)
+	}
+
+	/* Run for every version batch adds */
+	os.Remove(logFile)
+	writeFile(t, filepath.Join(dir, "d.txt"), "four\n")
+	writeFile(t, filepath.Join(dir, "e.txt"), "five\n")
+	writeFile(t, filepath.Join(dir, "manifest"), joinFields("paper", "d.txt", testAuthor)+"\n"+joinFields("paper", "e.txt", testAuthor)+"\n")
+	if r := runWith(t, dir, "", env, "--yes", "batch", "manifest"); r.code != ExitOK {
+		t.Fatalf("batch with a hook: exit %d\n%s", r.code, r.stderr)
+	}
+	if lines := strings.Split(strings.TrimSpace(readFile(t, logFile)), "\n"); len(lines) != 2 || !strings.HasPrefix(lines[0], "paper 4 ") || !strings.HasPrefix(lines[1], "paper 5 ") {
+		t.Errorf("the hook after batch got %q", lines)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+/*
+ * A tracked directory can have a .msmanagerignore file at its top,
+ * with one gitignore-style pattern per line:
+ *
+ *	# comment
+ *	*.aux           any file or directory named like this, at any depth
+ *	build/          only directories
+ *	/notes.txt      anchored to the top of the tracked directory
+ *	figs/tmp        also anchored, since it has a slash
+ *	!keep.aux       a later negated pattern includes the path again
+ *
+ * In anchored patterns a "**" segment matches any number of directories.
+ *
+ * The ignore file itself is archived with the rest.
+ */
+
+const IgnoreFile = ".msmanagerignore"
+
+type ignorePattern struct {
+	glob    string
+	negate  bool
+	dirOnly bool
+	rooted  bool
+}
+
+type ignoreList []ignorePattern
+
+func readIgnore(dir string) (ignoreList, error) {
+	f, err := os.Open(filepath.Join(dir, IgnoreFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return parseIgnore(lines), nil
+}
+
+func parseIgnore(lines []string) (list ignoreList) {
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var p ignorePattern
+		if strings.HasPrefix(line, "!") {
+			p.negate = true
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			p.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		/* A slash anywhere but the end ties the pattern to the top */
+		if strings.Contains(line, "/") {
+			p.rooted = true
+			line = strings.TrimPrefix(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		p.glob = line
+		list = append(list, p)
+	}
+	return list
+}
+
+func (list ignoreList) match(name string, dir bool) bool {
+	/* name is slash separated and relative to the tracked directory */
+	ignored := false
+	for _, p := range list {
+		if p.dirOnly && !dir {
+			continue
+		}
+		var ok bool
+		if p.rooted {
+			ok = matchSegments(strings.Split(p.glob, "/"), strings.Split(name, "/"))
+		} else {
+			ok, _ = path.Match(p.glob, path.Base(name))
+		}
+		if ok {
+			ignored = !p.negate
+		}
+	}
+	return ignored
+}
+
+func matchSegments(glob, name []string) bool {
+	for len(glob) > 0 {
+		if glob[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(glob[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(glob[0], name[0]); !ok {
+			return false
+		}
+		glob, name = glob[1:], name[1:]
+	}
+	return len(name) == 0
+}
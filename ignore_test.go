@@ -0,0 +1,78 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestIgnoreMatch(t *testing.T) {
+	list := parseIgnore([]string{
+		"# build output",
+		"*.aux",
+		"build/",
+		"/notes.txt",
+		"figs/tmp",
+		"drafts/**/*.bak",
+		"!keep.aux",
+		"",
+	})
+	for _, tt := range []struct {
+		name string
+		dir  bool
+		want bool
+	}{
+		{"paper.aux", false, true},
+		{"sub/deep/paper.aux", false, true},
+		{"keep.aux", false, false},
+		{"sub/keep.aux", false, false},
+		{"build", true, true},
+		{"sub/build", true, true},
+		{"build", false, false},
+		{"notes.txt", false, true},
+		{"sub/notes.txt", false, false},
+		{"figs/tmp", true, true},
+		{"other/figs/tmp", true, false},
+		{"drafts/a.bak", false, true},
+		{"drafts/x/y/a.bak", false, true},
+		{"a.bak", false, false},
+		{"paper.tex", false, false},
+	} {
+		if got := list.match(tt.name, tt.dir); got != tt.want {
+			t.Errorf("match(%q, dir %v) = %v, want %v", tt.name, tt.dir, got, tt.want)
+		}
+	}
+	if list := parseIgnore([]string{"# only a comment", "  ", "/"}); len(list) != 0 {
+		t.Errorf("patterns from comments and blanks: %+v", list)
+	}
+}
+
+func TestIgnoredPathsNotArchived(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "supp", "supp")
+	figs := filepath.Join(dir, "figs")
+	writeFile(t, filepath.Join(figs, IgnoreFile), "*.tmp\n.DS_Store\nbuild/\n")
+	writeFile(t, filepath.Join(figs, "plot.pdf"), "plot\n")
+	writeFile(t, filepath.Join(figs, "sub", "data.csv"), "1,2\n")
+	want := readTree(t, figs)
+	writeFile(t, filepath.Join(figs, "scratch.tmp"), "tmp\n")
+	writeFile(t, filepath.Join(figs, "sub", ".DS_Store"), "junk\n")
+	writeFile(t, filepath.Join(figs, "build", "out.log"), "log\n")
+
+	msm(t, dir, "--author", testAuthor, "--yes", "update", "supp", "figs")
+	out := filepath.Join(dir, "out")
+	msm(t, dir, "restore", "-o", out, "supp", "1")
+	if got := readTree(t, out); !reflect.DeepEqual(got, want) {
+		t.Errorf("restored tree %v, want %v", got, want)
+	}
+
+	/* Changing only ignored files is no new content */
+	writeFile(t, filepath.Join(dir, "copy", IgnoreFile), "*.tmp\n.DS_Store\nbuild/\n")
+	for rel, content := range want {
+		writeFile(t, filepath.Join(dir, "copy", rel), content)
+	}
+	writeFile(t, filepath.Join(dir, "copy", "other.tmp"), "other\n")
+	if r := run(t, dir, "", "--author", testAuthor, "--yes", "update", "supp", "copy"); r.code == ExitOK {
+		t.Errorf("a tree differing only in ignored files made a new version")
+	}
+}
@@ -1,113 +1,295 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
+	"encoding/csv"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"maps"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 )
 
-const UserInitials = "FD"
+const VersionsHeader = "DATE TIME LABEL VERSION ORIGFILE FILE AUTHOR ID NOTE SIZE PARENT MTIME"
 
-const (
-	LocalDir      = "msmanager-data"
-	ArchivesDir   = "msmanager-data/archives"
-	LabelsTable   = "msmanager-data/labels-table"
-	VersionsTable = "msmanager-data/versions-table"
+/* Where each version was made, shown by hist --verbose */
+const ProvenanceHeader = "HOST USER"
+
+/* Global options, given before the command */
+var (
+	assumeYes      bool
+	authorFlag     string
+	compressVerify bool
+	quiet          bool
+	repoFlag       string
+	verbose        bool
 )
 
 func main() {
 	log.SetPrefix("msmanager: ")
 	log.SetFlags(0)
 
-	if len(os.Args) == 1 {
-		usage()
-		return
+	flag.BoolVar(&assumeYes, "yes", false, "answer yes to every question")
+	flag.StringVar(&authorFlag, "author", "", "author email for update")
+	flag.BoolVar(&compressVerify, "compress-verify", false, "read each new archive back before using it")
+	flag.BoolVar(&quiet, "quiet", false, "print only errors and the output asked for")
+	flag.StringVar(&repoFlag, "repo", "", "directory of the repository to use")
+	flag.BoolVar(&verbose, "verbose", false, "log each step to stderr")
+	flag.Usage = func() { usage(ExitUsage) }
+	flag.Parse()
+	if verbose {
+		debugLog.SetOutput(os.Stderr)
 	}
 
-	if _, err := os.Stat(LocalDir); err != nil && os.Args[1] != "init" {
-		fmt.Printf("No repository in current directory. Use %q\n\n", "init")
-		usage()
+	/* Commands expect their arguments from args[2] on, as in os.Args */
+	args := append([]string{os.Args[0]}, flag.Args()...)
+
+	if len(args) == 1 {
+		usage(ExitOK)
+		return
+	}
+	if args[1] == "completion" {
+		printCompletion(args)
 		return
 	}
 
-	switch os.Args[1] {
+	var repo *Repo
+	if args[1] == "init" || args[1] == "unbundle" {
+		/* These make a repository instead of opening one */
+		repo = newRepoHere()
+	} else {
+		var err error
+		if repo, err = openRepo(); err != nil && args[1] == CompleteLabels {
+			/* Nothing to complete outside a repository */
+			return
+		} else if err != nil {
+			fmt.Printf("%v. Use %q\n\n", err, "init")
+			usage(ExitNotFound)
+			return
+		}
+		debugf("repository at %s, data in %s", repo.root, repo.dataDir)
+	}
+
+	switch args[1] {
 	case "init":
-		initDB()
+		initDB(repo)
+	case "config":
+		configure(repo, args)
 	case "track":
-		trackLabel(os.Args)
+		trackLabel(repo, args)
 	case "update":
-		updateLabel(os.Args)
+		updateLabel(repo, args)
+	case "batch":
+		batchUpdate(repo, args)
 	case "hist":
-		printHistory()
+		printHistory(repo, args)
 	case "labels":
-		printLabels()
+		printLabels(repo, args)
 	case "restore":
-		restoreFile(os.Args)
+		restoreFile(repo, args)
+	case "checkout":
+		checkoutVersion(repo, args)
+	case "show":
+		showVersion(repo, args)
 	case "undo":
-		undoUpdate()
+		undoUpdate(repo, args)
+	case "delete":
+		deleteLabel(repo, args)
+	case "rename":
+		renameLabel(repo, args)
+	case "set-basename":
+		setBasename(repo, args)
+	case "amend":
+		amendVersion(repo, args)
+	case "diff":
+		diffVersions(repo, args)
+	case "bundle":
+		bundleRepo(repo, args)
+	case "unbundle":
+		unbundleRepo(args)
+	case "latest":
+		printLatest(repo, args)
+	case "find":
+		findFile(repo, args)
+	case "info":
+		printInfo(repo)
+	case "gc":
+		collectGarbage(repo, args)
+	case "archives":
+		listArchives(repo, args)
+	case "verify":
+		verifyArchives(repo)
+	case "fsck":
+		fsck(repo, args)
+	case "trash":
+		trashCommand(repo, args)
+	case CompleteLabels:
+		completeLabels(repo)
+	case "export":
+		exportCSV(repo, args)
+	case "log":
+		printLog(repo, args)
+	case "status":
+		printStatus(repo, args)
 	default:
-		usage()
+		usage(ExitUsage)
 	}
+	repo.runHooks()
 }
 
-func initDB() {
-	dirs := [2]string{LocalDir, ArchivesDir}
-	files := [2]string{LabelsTable, VersionsTable}
+func initDB(repo *Repo) {
+	dirs := [2]string{repo.dataDir, repo.archivesDir}
+	files := [2]string{repo.labelsTable, repo.versionsTable}
 
 	for _, d := range dirs {
 		err := os.Mkdir(d, 0755)
 		if err != nil {
-			log.Fatal(err)
+			fail(err)
 		}
 	}
 
 	for _, f := range files {
-		fptr, err := os.Create(f)
-		if err != nil {
-			log.Fatal(err)
+		if err := writeLines(f, []string{schemaMarker()}); err != nil {
+			fail(err)
 		}
-		fptr.Close()
 	}
-	fmt.Println("Repository initialized.")
+	repo.writeConfig(defaultConfig())
+	inform("Repository initialized.\n")
 }
 
-func trackLabel(args []string) {
+func trackLabel(repo *Repo, args []string) {
 	/*
 	 *  To start tracking a label, we need to add the label
 	 *  and filename to use to the labels-table, and create an entry
 	 *   in the versions-table with the version number 0.
+	 *  If a file is given, it is archived right away as version 1.
 	 */
 
-	if len(args) != 4 {
+	fs := flag.NewFlagSet("track", flag.ExitOnError)
+	allowDuplicate := fs.Bool("allow-duplicate-basename", false, "allow a basename another label uses")
+	template := fs.String("template", "", "filename template for versions, default "+DefaultTemplate)
+	text := fs.Bool("text", false, "archive files with their newlines normalized to LF")
+	from := fs.String("from", "", "start from a copy of this file as version 1")
+	args = parseArgs(fs, args[2:])
+
+	if len(args) != 2 && len(args) != 3 {
 		fmt.Fprintf(os.Stderr, "Missing arguments.\n")
-		usage()
+		usage(ExitUsage)
 		return
 	}
+	if *from != "" && len(args) == 3 {
+		fail(usageError("give a file or --from, not both"))
+	}
 
-	label := args[2]
-	basename := args[3]
+	label := args[0]
+	basename := args[1]
+	if err := checkName("label", label); err != nil {
+		fail(err)
+	}
+	if err := checkName("basename", basename); err != nil {
+		fail(err)
+	}
+	if *template != "" {
+		if err := checkTemplate(*template); err != nil {
+			fail(err)
+		}
+	}
 
-	labelsMap := readLabelsMap()
+	repo.lock()
+	defer repo.unlock()
+
+	labelsMap := repo.readLabelsMap()
 	if _, ok := labelsMap[label]; ok {
-		log.Fatal(fmt.Errorf("Label %q already exists.", label))
+		fail(fmt.Errorf("Label %q already exists.", label))
+	}
+
+	/* Labels with the same basename would write over each other's version files */
+	for other, b := range labelsMap {
+		if b == basename && !*allowDuplicate {
+			fail(fmt.Errorf("basename %q is already used by label %q, use --allow-duplicate-basename to use it anyway", basename, other))
+		}
+	}
+
+	/* A template is copied to <basename><ext>, which becomes version 1 */
+	var origFile, email string
+	if *from != "" {
+		if fi, err := os.Stat(*from); err != nil {
+			fail(err)
+		} else if fi.IsDir() {
+			fail(usageError("--from takes a file, %s is a directory", *from))
+		}
+		origFile = repo.workPath(basename + filepath.Ext(*from))
+		if _, err := os.Lstat(origFile); err == nil {
+			fail(fmt.Errorf("%s already exists", origFile))
+		}
+	}
+	if len(args) == 3 {
+		origFile = args[2]
+	}
+	if origFile != "" {
+		if _, err := os.Stat(origFile); err != nil && *from == "" {
+			fail(err)
+		}
+
+		var err error
+		email, err = repo.authorEmail()
+		if err != nil {
+			fail(err)
+		}
+		if !askConfirmation(stdin, label, origFile, email, "") {
+			fmt.Println("Abort.")
+			return
+		}
 	}
 
-	writeToLabelsMap(label, basename)
-	writeToVersionsTable(Version{
+	mode := ""
+	if *text {
+		mode = TextMode
+	}
+	repo.writeToLabelsMap(label, basename, *template, mode)
+	repo.writeToVersionsTable(Version{
 		date:          getDate(),
-		time:          getTime(),
+		time:          getTime(repo.config.precision),
 		label:         label,
 		versionNumber: 0,
 		origFile:      "none",
 		file:          "none",
 		author:        "none",
 		id:            "none",
+		size:          -1,
+		parent:        "none",
 	})
-	fmt.Printf("New label %q.\n", label)
+	repo.logOp("track", label)
+	inform("New label %q.\n", label)
+
+	if *from != "" {
+		if err := copyFile(*from, origFile); err != nil {
+			fail(err)
+		}
+		inform("Copy %s to %s\n", *from, origFile)
+	}
+	if origFile != "" {
+		v, err := repo.archiveVersion(label, origFile, email, "")
+		if err != nil {
+			fail(err)
+		}
+		inform("Update: %s --> %s\n", origFile, v.file)
+	}
 }
 
-func updateLabel(args []string) {
+func updateLabel(repo *Repo, args []string) {
 	/*
 	 * Updates the version of LABEL using the file ORIGFILE
 	 *
@@ -121,153 +303,2205 @@ func updateLabel(args []string) {
 	 * versions table.
 	 */
 
-	if len(args) != 4 {
-		fmt.Println("Missing arguments")
-		usage()
-	}
+	fs := flag.NewFlagSet("update", flag.ExitOnError)
+	note := fs.String("m", "", "note describing the update")
+	dryRun := fs.Bool("dry-run", false, "show what would be done without doing it")
+	args = parseArgs(fs, args[2:])
 
-	label := args[2]
-	origFile := args[3]
+	/* With the label, or even the file, left out, ask for them */
+	if len(args) < 2 && isTerminal(os.Stdin) {
+		label, err := pickLabel(stdin, repo.readLabels())
+		if err != nil {
+			fail(err)
+		}
+		if len(args) == 0 {
+			fmt.Printf("File: ")
+			file, err := readLine(stdin)
+			if err != nil || file == "" {
+				fail(usageError("no file given"))
+			}
+			args = append(args, file)
+		}
+		args = []string{label, args[0]}
+	}
 
-	labelsMap := readLabelsMap()
-	basename, ok := labelsMap[label]
-	if !ok {
-		log.Fatal(fmt.Errorf("no such label %q", label))
+	if len(args) < 2 {
+		fmt.Fprintf(os.Stderr, "Missing arguments.\n")
+		usage(ExitUsage)
+		return
 	}
 
-	id := calculateSha1(origFile)
-	newVersionNumber := getLastVersionNumber(label) + 1
-	newArchiveFile := filepath.Join(ArchivesDir, id) + ".gz"
-	newVersionFile := fmt.Sprintf("%s_%d_%s%s", basename, newVersionNumber, UserInitials, filepath.Ext(origFile))
-	email := askAuthorEmail()
+	/* Several files make one version, as a directory holding them */
+	label := args[0]
+	files := args[1:]
+	origFile := strings.Join(files, " ")
 
-	if !askConfirmation(label, origFile, email) {
-		fmt.Println("Abort.")
+	repo.lock()
+	defer repo.unlock()
+
+	names := make(map[string]bool)
+	for _, f := range files {
+		if err := repo.checkUpdate(label, f); err != nil {
+			fail(err)
+		}
+		if names[filepath.Base(f)] {
+			fail(usageError("two files named %s, they can't go in one version", filepath.Base(f)))
+		}
+		names[filepath.Base(f)] = true
+	}
+
+	if *dryRun {
+		var v Version
+		var err error
+		if len(files) == 1 {
+			v, err = repo.planVersion(label, origFile)
+		} else {
+			var dir string
+			var putBack func()
+			if dir, putBack, err = repo.gatherFiles(label, files); err == nil {
+				v, err = repo.planVersion(label, dir)
+				putBack()
+			}
+		}
+		if err != nil {
+			fail(err)
+		}
+		newArchiveFile := repo.newArchivePath(v.id, v.origFile)
+		fmt.Printf("Label  : %s\n", label)
+		fmt.Printf("Version: %d\n", v.versionNumber)
+		fmt.Printf("Update : %s --> %s\n", origFile, v.file)
+		if err := repo.checkDuplicate(v); err != nil {
+			fail(err)
+		}
+		if _, err := os.Stat(newArchiveFile); err == nil {
+			fmt.Printf("Archive: %s (already stored, reused)\n", newArchiveFile)
+		} else {
+			fmt.Printf("Archive: %s\n", newArchiveFile)
+		}
+		if lastVersionFile, err := repo.isLastVersionChanged(label); errors.Is(err, os.ErrNotExist) {
+			fmt.Printf("Remove : %s is not there, nothing to remove\n", lastVersionFile)
+		} else if err != nil {
+			fmt.Println(err, "File would not be removed.")
+		} else if lastVersionFile != "none" && repo.config.previous == "keep" {
+			fmt.Printf("Keep   : %s\n", lastVersionFile)
+		} else if lastVersionFile != "none" {
+			fmt.Printf("Remove : %s\n", lastVersionFile)
+		}
 		return
 	}
 
-	if _, err := os.Stat(newArchiveFile); err == nil {
-		log.Fatal(fmt.Errorf("the same file was used before: \nId: %s", id))
+	/* Without a terminal and without --author or --yes, author and note come piped in */
+	var email string
+	var err error
+	if !isTerminal(os.Stdin) && authorFlag == "" && !assumeYes {
+		var pipedNote string
+		email, pipedNote, err = repo.readMessage(stdin)
+		if err != nil {
+			fail(err)
+		}
+		if *note == "" {
+			*note = pipedNote
+		}
+		printUpdate(label, origFile, email, *note)
+	} else {
+		email, err = repo.authorEmail()
+		if err != nil {
+			fail(err)
+		}
+		if *note == "" && !assumeYes && isTerminal(os.Stdin) && repo.editor() != "" {
+			if *note, err = repo.editNote(label, origFile); err != nil {
+				fail(err)
+			}
+			if *note == "" {
+				fail(fmt.Errorf("empty note, update aborted"))
+			}
+		} else if *note == "" && !assumeYes && isTerminal(os.Stdin) {
+			if *note, err = askNote(stdin); err != nil {
+				fail(err)
+			}
+		}
+		if !askConfirmation(stdin, label, origFile, email, *note) {
+			fmt.Println("Abort.")
+			return
+		}
+	}
+
+	var v Version
+	if len(files) == 1 {
+		v, err = repo.archiveVersion(label, origFile, email, *note)
+	} else {
+		var dir string
+		var putBack func()
+		members := make([]string, len(files))
+		for i, f := range files {
+			if members[i], err = filepath.Abs(f); err != nil {
+				fail(err)
+			}
+		}
+		if dir, putBack, err = repo.gatherFiles(label, files); err == nil {
+			v, err = repo.archiveVersion(label, dir, email, *note, members...)
+			putBack()
+		}
+	}
+	if err != nil {
+		fail(err)
+	}
+	inform("Update: %s --> %s\n", origFile, v.file)
+}
+
+func (repo *Repo) gatherFiles(label string, files []string) (string, func(), error) {
+	/*
+	 * Move files into a directory named like the basename of label,
+	 * to update it with as one version. The returned function puts
+	 * back whatever is still there, after the update or a failure.
+	 */
+	tmp, err := os.MkdirTemp(repo.root, ".msmanager-update-*")
+	if err != nil {
+		return "", nil, err
+	}
+	dir := filepath.Join(tmp, repo.readLabelsMap()[label])
+
+	var moved []string
+	putBack := func() {
+		for _, f := range moved {
+			os.Rename(filepath.Join(dir, filepath.Base(f)), f)
+		}
+		os.RemoveAll(tmp)
+	}
+	if err := os.Mkdir(dir, 0755); err != nil {
+		putBack()
+		return "", nil, err
+	}
+	for _, f := range files {
+		if err := os.Rename(f, filepath.Join(dir, filepath.Base(f))); err != nil {
+			putBack()
+			return "", nil, err
+		}
+		moved = append(moved, f)
 	}
+	return dir, putBack, nil
+}
 
-	if err := compress(origFile, newArchiveFile); err != nil {
-		log.Fatal(err)
+func (repo *Repo) checkUpdate(label, origFile string) error {
+	if _, ok := repo.readLabelsMap()[label]; !ok {
+		return notFoundError("no such label %q", label)
 	}
 
-	if err := os.Rename(origFile, newVersionFile); err != nil {
-		log.Fatal(err)
+	/*
+	 * Version files live in the repository root, so the input file
+	 * is moved there. From outside the repository that is rarely
+	 * what was meant, and it is refused unless "outside" is "move".
+	 */
+	inside, err := repo.contains(origFile)
+	if err != nil {
+		return err
+	}
+	if !inside && repo.config.outside != "move" {
+		return usageError("%s is outside the repository, move it in first or set %q", origFile, "config outside move")
 	}
 
-	if lastVersionFile, err := isLastVersionChanged(label); err != nil {
-		fmt.Println(err, "File not removed.")
-	} else {
-		if lastVersionFile != "none" {
-			os.Remove(lastVersionFile)
+	/*
+	 * Passing a version file again would archive it as the next
+	 * version and then remove it as the previous one.
+	 */
+	for _, v := range repo.readVersionsTable() {
+		if v.label == label && v.versionNumber > 0 && strings.TrimSuffix(v.file, "/") == filepath.Base(origFile) {
+			return fmt.Errorf("%s is version %d of label %q, update with a new file", origFile, v.versionNumber, label)
 		}
 	}
+	return nil
+}
 
-	writeToVersionsTable(Version{
-		date:          getDate(),
-		time:          getTime(),
+func (repo *Repo) planVersion(label, origFile string) (Version, error) {
+	/* The entry origFile would get as the next version of label */
+	if err := repo.checkUpdate(label, origFile); err != nil {
+		return Version{}, err
+	}
+	size, err := contentSize(origFile)
+	if err != nil {
+		return Version{}, err
+	}
+	id, err := repo.inputSha1(label, origFile)
+	if err != nil {
+		return Version{}, err
+	}
+	fi, err := os.Stat(origFile)
+	if err != nil {
+		return Version{}, err
+	}
+	/* The parent is the id of the version this one follows */
+	v := Version{
 		label:         label,
-		versionNumber: newVersionNumber,
+		versionNumber: repo.getLastVersionNumber(label) + 1,
 		origFile:      filepath.Base(origFile),
-		file:          newVersionFile,
-		author:        email,
 		id:            id,
-	})
-	fmt.Printf("Update: %s --> %s\n", origFile, newVersionFile)
+		size:          size,
+		parent:        "none",
+		mtime:         fi.ModTime(),
+	}
+	for _, prev := range repo.readVersionsTable() {
+		if prev.label == label && prev.versionNumber > 0 {
+			v.parent = prev.id
+		}
+	}
+	if isDir(origFile) {
+		v.origFile += "/"
+	}
+	v.file = repo.versionFilename(label, v.versionNumber, v.origFile)
+	debugf("%s: id %s, %d bytes, version %d after %s, file %s", origFile, v.id, v.size, v.versionNumber, v.parent, v.file)
+	return v, nil
+}
+
+func (repo *Repo) versionFilename(label string, number int, origFile string) string {
+	/* The filename of a version, from the template of label. Directories end in "/" */
+	var labelInfo LabelRecord
+	for _, l := range repo.readLabels() {
+		if l.Label == label {
+			labelInfo = l
+		}
+	}
+	return versionName(labelInfo.Template, labelInfo.Basename, number, repo.config.initials, getDate(), origFile)
+}
+
+func versionName(template, basename string, number int, initials, date, origFile string) string {
+	if template == "" {
+		template = DefaultTemplate
+	}
+
+	dir := strings.HasSuffix(origFile, "/")
+	values := map[string]string{
+		"basename": basename,
+		"version":  strconv.Itoa(number),
+		"initials": initials,
+		"date":     date,
+		"ext":      filepath.Ext(origFile),
+	}
+	if dir {
+		/* Directories have no extension, and are marked with a trailing slash */
+		values["ext"] = ""
+		return renderFilename(template, values) + "/"
+	}
+	return renderFilename(template, values)
+}
+
+func (repo *Repo) checkDuplicate(v Version) error {
+	/* The same content as a new version of the same label would change nothing */
+	for _, prev := range repo.readVersionsTable() {
+		if prev.label == v.label && prev.id == v.id {
+			return fmt.Errorf("the same file was used before as version %d of label %q: \nId: %s", prev.versionNumber, v.label, v.id)
+		}
+	}
+	return nil
 }
 
-func printHistory() {
-	header := "DATE TIME LABEL VERSION ORIGFILE FILE AUTHOR ID"
-	printColumns(header, VersionsTable)
+func (repo *Repo) archiveVersion(label, origFile, author, note string, members ...string) (Version, error) {
+	/*
+	 * Archive origFile as the next version of label, rename it to its
+	 * version filename and remove the previous version file if it
+	 * was not modified. members are where the files of a directory
+	 * gathered by gatherFiles came from. The caller must hold the lock.
+	 */
+	v, err := repo.planVersion(label, origFile)
+	if err != nil {
+		return Version{}, err
+	}
+	v.date = getDate()
+	v.time = getTime(repo.config.precision)
+	v.author = author
+	v.note = note
+	v.host, v.user = provenance()
+
+	if err := repo.checkDuplicate(v); err != nil {
+		return Version{}, err
+	}
+
+	/* Content already archived for another label is shared, not stored again */
+	newArchiveFile := repo.newArchivePath(v.id, v.origFile)
+	_, err = os.Stat(newArchiveFile)
+	reused := err == nil
+	if reused {
+		debugf("archive %s is there already, reuse it", newArchiveFile)
+	} else {
+		debugf("compress %s into %s with %s", origFile, newArchiveFile, repo.config.compression)
+		if err := checkSpace(repo.archivesDir, v.size); err != nil {
+			return Version{}, err
+		}
+		done, err := repo.compressDelta(label, origFile, v, newArchiveFile)
+		if !done && err == nil {
+			var in io.ReadCloser
+			var seal sealer
+			if seal, err = repo.sealer(); err == nil {
+				in, err = repo.openInput(label, origFile)
+			}
+			if err == nil {
+				in = withProgress(in, origFile, v.size)
+				err = compress(in, newArchiveFile, repo.config.compression, repo.config.level, seal)
+				in.Close()
+			}
+		}
+		if err == nil {
+			err = verifyArchive(newArchiveFile, v.id)
+		}
+		if err != nil {
+			os.Remove(newArchiveFile)
+			return Version{}, err
+		}
+	}
+
+	if inside, _ := repo.contains(origFile); !inside {
+		inform("Move %s into the repository as %s\n", origFile, repo.workPath(v.file))
+	}
+	debugf("rename %s to %s", origFile, repo.workPath(v.file))
+	if err := os.Rename(origFile, repo.workPath(v.file)); err != nil {
+		if !reused {
+			os.Remove(newArchiveFile)
+		}
+		return Version{}, err
+	}
+
+	if lastVersionFile, err := repo.isLastVersionChanged(label); errors.Is(err, os.ErrNotExist) {
+		inform("%s is not there, nothing to remove.\n", lastVersionFile)
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err, "File not removed.")
+	} else if lastVersionFile != "none" {
+		/* The archive holds the content, the file is only kept if asked to */
+		if repo.config.previous == "keep" {
+			inform("Keep previous version %s\n", lastVersionFile)
+		} else {
+			debugf("remove %s", repo.workPath(lastVersionFile))
+			os.RemoveAll(repo.workPath(lastVersionFile))
+			inform("Remove previous version %s, it is in the archive\n", lastVersionFile)
+		}
+	}
+
+	debugf("add version %d of %q to %s", v.versionNumber, label, repo.versionsTable)
+	repo.writeToVersionsTable(v)
+	repo.logOp("update", append([]string{label, strconv.Itoa(v.versionNumber)}, members...)...)
+	repo.queueHook(v)
+	return v, nil
 }
 
-func printLabels() {
-	header := "LABEL FILENAME"
-	printColumns(header, LabelsTable)
+func batchUpdate(repo *Repo, args []string) {
+	/*
+	 * Run an update for every line of a manifest with the columns
+	 * LABEL FILE AUTHOR [NOTE], separated by tabs or, for .csv
+	 * files, by commas. Lines starting with # are skipped. An empty
+	 * author falls back to --author or the configured author.
+	 */
+
+	fs := flag.NewFlagSet("batch", flag.ExitOnError)
+	failFast := fs.Bool("fail-fast", false, "stop at the first line that fails")
+	jobs := fs.Int("jobs", runtime.GOMAXPROCS(0), "number of files to hash and compress at once")
+	args = parseArgs(fs, args[2:])
+
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "Missing arguments.\n")
+		usage(ExitUsage)
+		return
+	}
+	if *jobs < 1 {
+		fail(usageError("--jobs must be at least 1"))
+	}
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		fail(err)
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	r.FieldsPerRecord = -1
+	if !strings.EqualFold(filepath.Ext(args[0]), ".csv") {
+		r.Comma = '\t'
+		r.LazyQuotes = true
+	}
+	records, err := r.ReadAll()
+	if err != nil {
+		fail(err)
+	}
+
+	inform("%d updates in %s.\n", len(records), args[0])
+	if !askYesNo(stdin, "Run them?") {
+		fmt.Println("Abort.")
+		return
+	}
+
+	repo.lock()
+	defer repo.unlock()
+
+	/*
+	 * Hashing and compressing is the slow part, and is done for all
+	 * the lines at once. The updates then go one by one, in the
+	 * order of the manifest, finding their archives already there.
+	 */
+	errs, staged := repo.prepareBatch(records, *jobs)
+	defer repo.removeUnused(staged)
+
+	var succeeded, failed int
+	for i, field := range records {
+		err := errs[i]
+		if err == nil {
+			err = repo.batchLine(field)
+		}
+		if err != nil {
+			fmt.Printf("%d: FAIL: %v\n", i+1, err)
+			failed++
+			if *failFast {
+				break
+			}
+			continue
+		}
+		inform("%d: OK: %s %s\n", i+1, field[0], field[1])
+		succeeded++
+	}
+
+	inform("%d succeeded, %d failed.\n", succeeded, failed)
+	if failed > 0 {
+		repo.removeUnused(staged)
+		repo.unlock()
+		repo.runHooks()
+		os.Exit(ExitError)
+	}
 }
 
-func restoreFile(args []string) {
-	if len(args) < 3 {
-		fmt.Println("Missing arguments")
-		usage()
+func (repo *Repo) prepareBatch(records [][]string, jobs int) (errs []error, staged []string) {
+	/*
+	 * Work out the id of every input with jobs workers, and compress
+	 * the ones not archived yet. Returns the error of each line and
+	 * the archives made, so the ones no update used can be removed.
+	 */
+	seal, err := repo.sealer()
+	if err != nil {
+		fail(err)
+	}
+	/* The workers hash every input, not what a batch before left */
+	repo.sums = nil
+	errs = make([]error, len(records))
+	sums := make([]string, len(records))
+	labels := repo.readLabelsMap()
+	claimed := make(map[string]bool)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	lines := make(chan int)
+	for w := 0; w < jobs; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range lines {
+				label, origFile := records[i][0], records[i][1]
+				sum, err := repo.inputSha1(label, origFile)
+				if err != nil {
+					errs[i] = err
+					continue
+				}
+				sums[i] = sum
+
+				/*
+				 * A delta is made against the version before, which an
+				 * earlier line may be about to add, so with deltas on
+				 * every update compresses its own.
+				 */
+				if repo.config.delta >= 2 {
+					continue
+				}
+
+				archive := repo.newArchivePath(sum, origFile)
+				mu.Lock()
+				_, err = os.Stat(archive)
+				mine := err != nil && !claimed[sum]
+				claimed[sum] = true
+				mu.Unlock()
+				if !mine {
+					continue
+				}
+
+				size, err := contentSize(origFile)
+				if err == nil {
+					err = checkSpace(repo.archivesDir, size)
+				}
+				var in io.ReadCloser
+				if err == nil {
+					in, err = repo.openInput(label, origFile)
+				}
+				if err == nil {
+					in = withProgress(in, origFile, size)
+					err = compress(in, archive, repo.config.compression, repo.config.level, seal)
+					in.Close()
+				}
+				if err == nil {
+					err = verifyArchive(archive, sum)
+				}
+				mu.Lock()
+				if err != nil {
+					/* Left for the update of the line, which reports it */
+					os.Remove(archive)
+					delete(claimed, sum)
+				} else {
+					staged = append(staged, archive)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for i, field := range records {
+		/* Malformed lines and unknown labels are reported by the update */
+		if len(field) < 3 || len(field) > 4 {
+			continue
+		}
+		if _, ok := labels[field[0]]; !ok {
+			continue
+		}
+		lines <- i
 	}
-	id := args[2]
+	close(lines)
+	wg.Wait()
+
+	repo.sums = make(map[string]string)
+	for i, sum := range sums {
+		if sum != "" {
+			repo.sums[records[i][0]+"\x00"+records[i][1]] = sum
+		}
+	}
+	return errs, staged
+}
 
-	var origFile string
-	for _, v := range readVersionsTable() {
-		if v.id == id {
-			origFile = v.origFile
-			break
+func (repo *Repo) removeUnused(archives []string) {
+	/* Remove those of archives that no version refers to */
+	used := make(map[string]bool)
+	for _, v := range repo.readVersionsTable() {
+		used[repo.archivePath(v.id)] = true
+	}
+	for _, archive := range archives {
+		if !used[archive] {
+			os.Remove(archive)
 		}
 	}
-	if len(origFile) == 0 {
-		log.Fatal(fmt.Errorf("unable to find ID %s", id))
+}
+
+func (repo *Repo) batchLine(field []string) error {
+	if len(field) < 3 || len(field) > 4 {
+		return fmt.Errorf("expected 3 or 4 fields, got %d", len(field))
+	}
+	label, origFile, author := field[0], field[1], field[2]
+	var note string
+	if len(field) == 4 {
+		note = field[3]
 	}
 
-	compressed_file := filepath.Join(ArchivesDir, id) + ".gz"
-	restored_file := fmt.Sprintf("restored_%s", origFile)
-	if err := decompress(compressed_file, restored_file); err != nil {
-		log.Fatal(err)
+	if author == "" {
+		author = authorFlag
 	}
-	fmt.Printf("File restored: %s\n", restored_file)
+	if author == "" {
+		author = repo.config.author
+	}
+	if !isValidEmail(author) {
+		return fmt.Errorf("invalid author email %q", author)
+	}
+
+	_, err := repo.archiveVersion(label, origFile, author, note)
+	return err
 }
 
-func undoUpdate() {
+func configure(repo *Repo, args []string) {
 	/*
-	 * There are two possibilities:
-	 * 1. Last command was "track". In that case the
-	 *    last entry in versions-table would be a version 0.
-	 *    In this case just remove the last entries from
-	 *    the labels-table and the versions-table
-	 *
-	 * 2. Last command was "update".
-	 *    In this case we must remove the current
-	 *    version and restore the previous from that label.
-	 *    To do this:
-	 *	- Remove the archived file. Rename the current
-	 *	  version to it's original name.
-	 *	- Restore the previous version.
-	 *    Then delete the last entry from versions-table.
+	 * config               print all values
+	 * config <key>         print the value of key
+	 * config <key> <value> set key to value
+	 * config author add <email>  add a known author
 	 */
 
-	versionsTable := readVersionsTable()
-	lastEntry := versionsTable[len(versionsTable)-1]
+	if len(args) == 5 && args[2] == "author" && args[3] == "add" {
+		repo.lock()
+		defer repo.unlock()
+		if err := repo.addAuthor(args[4]); err != nil {
+			fail(err)
+		}
+		inform("Add known author %s\n", args[4])
+		return
+	}
 
-	if lastEntry.versionNumber == 0 {
-		if err := removeLastLine(LabelsTable); err != nil {
-			log.Fatal(err)
+	switch len(args) {
+	case 2:
+		for _, e := range repo.config.entries() {
+			fmt.Printf("%s %s\n", e[0], e[1])
 		}
-		if err := removeLastLine(VersionsTable); err != nil {
-			log.Fatal(err)
+	case 3:
+		for _, e := range repo.config.entries() {
+			if e[0] == args[2] {
+				fmt.Println(e[1])
+				return
+			}
 		}
-		fmt.Printf("Remove label %q.\n", lastEntry.label)
-	} else {
-		compressed_file := filepath.Join(ArchivesDir, lastEntry.id) + ".gz"
-		os.Remove(compressed_file)
-		os.Rename(lastEntry.file, lastEntry.origFile)
-		fmt.Printf("Rename: %s ---> %s\n", lastEntry.file, lastEntry.origFile)
+		fail(usageError("unknown config key %q", args[2]))
+	case 4:
+		repo.lock()
+		defer repo.unlock()
+		if err := repo.config.set(args[2], args[3]); err != nil {
+			fail(err)
+		}
+		repo.writeConfig(repo.config)
+		inform("Set %s = %s\n", args[2], args[3])
+	default:
+		usage(ExitUsage)
+	}
+}
+
+var versionOrders = map[string]func(a, b *Version) int{
+	"date": func(a, b *Version) int {
+		return cmp.Or(cmp.Compare(a.date, b.date), cmp.Compare(a.time, b.time))
+	},
+	"label":   func(a, b *Version) int { return cmp.Compare(a.label, b.label) },
+	"version": func(a, b *Version) int { return cmp.Compare(a.versionNumber, b.versionNumber) },
+	"author":  func(a, b *Version) int { return cmp.Compare(a.author, b.author) },
+}
 
-		if err := removeLastLine(VersionsTable); err != nil {
-			log.Fatal(err)
+func printHistory(repo *Repo, args []string) {
+	fs := flag.NewFlagSet("hist", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print as JSON")
+	since := fs.String("since", "", "show only versions from this date (YYYY-MM-DD)")
+	until := fs.String("until", "", "show only versions up to this date (YYYY-MM-DD)")
+	format := fs.String("format", "", "print each version with a template, or a preset (short, oneline)")
+	author := fs.String("author", "", "show only versions by this author")
+	authorContains := fs.String("author-contains", "", "show only versions by authors containing this text")
+	sortBy := fs.String("sort", "", "sort by date, label, version or author")
+	reverse := fs.Bool("reverse", false, "print in reverse order, newest first")
+	label := fs.String("label", "", "show only versions of this label")
+	long := fs.Bool("verbose", false, "also show the host and user each version was made by")
+	args = parseArgs(fs, args[2:])
+
+	/* hist <label> is hist --label <label> */
+	if len(args) > 1 || len(args) == 1 && *label != "" {
+		fmt.Fprintf(os.Stderr, "Too many arguments.\n")
+		usage(ExitUsage)
+		return
+	} else if len(args) == 1 {
+		*label = args[0]
+	}
+	if _, ok := repo.readLabelsMap()[*label]; *label != "" && !ok {
+		fail(notFoundError("no such label %q", *label))
+	}
+
+	compare, ok := versionOrders[*sortBy]
+	if *sortBy != "" && !ok {
+		fail(usageError("can't sort by %q, use date, label, version or author", *sortBy))
+	}
+
+	for _, d := range []struct{ name, value string }{{"since", *since}, {"until", *until}} {
+		if _, err := time.Parse(DateFormat, d.value); d.value != "" && err != nil {
+			fail(usageError("invalid --%s date %q, expected YYYY-MM-DD", d.name, d.value))
 		}
-		if lastEntry.versionNumber > 1 {
-			restoreLastVersion(lastEntry.label)
+	}
+
+	/* Dates in this format sort as strings, both ends are included */
+	var versions []*Version
+	for _, v := range repo.readVersionsTable() {
+		if *since != "" && v.date < *since || *until != "" && v.date > *until {
+			continue
+		}
+		if *label != "" && v.label != *label {
+			continue
+		}
+		if *author != "" && v.author != *author {
+			continue
+		}
+		if *authorContains != "" && !strings.Contains(v.author, *authorContains) {
+			continue
+		}
+		versions = append(versions, v)
+	}
+
+	/* Stable, so rows that tie stay in the order of the table */
+	if compare != nil {
+		slices.SortStableFunc(versions, compare)
+	}
+	if *reverse {
+		slices.Reverse(versions)
+	}
+
+	if *asJSON {
+		records := []VersionRecord{}
+		for _, v := range versions {
+			records = append(records, v.record())
+		}
+		printJSON(records)
+		return
+	}
+
+	if *format != "" {
+		tmpl, err := parseFormat(*format)
+		if err != nil {
+			fail(err)
+		}
+		for _, v := range versions {
+			if err := tmpl.Execute(os.Stdout, v.record()); err != nil {
+				fail(err)
+			}
+			fmt.Println()
+		}
+		return
+	}
+
+	header := VersionsHeader
+	if *long {
+		header += " " + ProvenanceHeader
+	}
+	var rows [][]string
+	for _, v := range versions {
+		rows = append(rows, v.fields()[:len(strings.Fields(header))])
+	}
+	printRows(header, rows)
+}
+
+func printLog(repo *Repo, args []string) {
+	fs := flag.NewFlagSet("log", flag.ExitOnError)
+	count := fs.Int("n", 0, "show only the last n versions")
+	args = parseArgs(fs, args[2:])
+
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "Missing arguments.\n")
+		usage(ExitUsage)
+		return
+	}
+	label := args[0]
+
+	if _, ok := repo.readLabelsMap()[label]; !ok {
+		fail(notFoundError("no such label %q", label))
+	}
+
+	var rows [][]string
+	for _, v := range repo.readVersionsTable() {
+		if v.label == label {
+			rows = append(rows, v.fields()[:len(strings.Fields(VersionsHeader))])
 		}
 	}
+	if *count > 0 && len(rows) > *count {
+		rows = rows[len(rows)-*count:]
+	}
+	printRows(VersionsHeader, rows)
+}
+
+func printStatus(repo *Repo, args []string) {
+	/*
+	 * For each label, compare the file of its latest version
+	 * with the archive: clean, modified or missing.
+	 */
+
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print as JSON")
+	parseArgs(fs, args[2:])
+
+	latest := make(map[string]*Version)
+	for _, v := range repo.readVersionsTable() {
+		if v.versionNumber > 0 {
+			latest[v.label] = v
+		}
+	}
+
+	records := []StatusRecord{}
+	for _, label := range slices.Sorted(maps.Keys(repo.readLabelsMap())) {
+		r := StatusRecord{Label: label, File: "none", Status: "no versions"}
+		if v, ok := latest[label]; ok {
+			r.File = v.file
+			if _, err := os.Stat(repo.workPath(v.file)); err != nil {
+				r.Status = "missing"
+			} else if sum, err := repo.inputSha1(label, repo.workPath(v.file)); err != nil {
+				fail(err)
+			} else if sum != v.id {
+				r.Status = "modified"
+			} else {
+				r.Status = "clean"
+			}
+		}
+		records = append(records, r)
+	}
+
+	if *asJSON {
+		printJSON(records)
+		return
+	}
+
+	var rows [][]string
+	for _, r := range records {
+		rows = append(rows, []string{r.Label, r.File, r.Status})
+	}
+	printRows("LABEL FILE STATUS", rows)
+}
+
+func printLabels(repo *Repo, args []string) {
+	fs := flag.NewFlagSet("labels", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print as JSON")
+	long := fs.Bool("verbose", false, "show the latest version of each label")
+	parseArgs(fs, args[2:])
+
+	latest := make(map[string]*Version)
+	if *long {
+		for _, v := range repo.readVersionsTable() {
+			if v.versionNumber > 0 {
+				latest[v.label] = v
+			}
+		}
+	}
+
+	if *asJSON {
+		records := []LabelRecord{}
+		for _, l := range repo.readLabels() {
+			if v, ok := latest[l.Label]; ok {
+				l.Version, l.Updated, l.Author = &v.versionNumber, v.date, v.author
+			}
+			records = append(records, l)
+		}
+		printJSON(records)
+		return
+	}
+
+	if *long {
+		var rows [][]string
+		for _, l := range repo.readLabels() {
+			row := []string{l.Label, l.Basename, "-", "-", "-"}
+			if v, ok := latest[l.Label]; ok {
+				row[2], row[3], row[4] = strconv.Itoa(v.versionNumber), v.date, v.author
+			}
+			rows = append(rows, row)
+		}
+		printRows("LABEL FILENAME VERSION UPDATED AUTHOR", rows)
+		return
+	}
+
+	var rows [][]string
+	for _, l := range repo.readLabels() {
+		rows = append(rows, []string{l.Label, l.Basename})
+	}
+	printRows("LABEL FILENAME", rows)
+}
+
+func restoreFile(repo *Repo, args []string) {
+	/*
+	 * The version to restore can be given by its ID,
+	 * or by label and version number (or "latest").
+	 */
+
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	force := fs.Bool("force", false, "overwrite an existing file")
+	output := fs.String("o", "", "write to this path, a directory or - for stdout")
+	all := fs.Bool("all", false, "restore every version of a label, into the -o directory")
+	args = parseArgs(fs, args[2:])
+
+	if *all {
+		if len(args) != 1 {
+			fmt.Fprintf(os.Stderr, "Missing arguments.\n")
+			usage(ExitUsage)
+			return
+		}
+		restoreAll(repo, args[0], *output, *force)
+		return
+	}
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Fprintf(os.Stderr, "Missing arguments.\n")
+		usage(ExitUsage)
+		return
+	}
+
+	found, err := repo.lookupVersion(args)
+	if err != nil {
+		fail(err)
+	}
+
+	compressed_file := repo.archivePath(found.id)
+	if *output == "-" {
+		if err := repo.decompressVersion(found, os.Stdout); err != nil {
+			fail(err)
+		}
+		return
+	}
+
+	restored_file, err := restoredFilename(repo.config.restored, found)
+	if err != nil {
+		fail(err)
+	}
+	if *output != "" {
+		restored_file = *output
+		if fi, err := os.Stat(*output); err == nil && fi.IsDir() {
+			restored_file = filepath.Join(*output, strings.TrimSuffix(found.origFile, "/"))
+		}
+	}
+
+	repo.lock()
+	defer repo.unlock()
+
+	/* A file overwritten with --force is kept, so undo can bring it back */
+	backup := "none"
+	if _, err := os.Lstat(restored_file); err == nil {
+		if !*force {
+			fail(fmt.Errorf("%s already exists, use --force to overwrite it", restored_file))
+		}
+		if backup, err = repo.backupFile(restored_file); err != nil {
+			fail(err)
+		}
+	}
+	debugf("inflate %s into %s", compressed_file, restored_file)
+	if err := repo.inflateVersion(found, restored_file); err != nil {
+		fail(err)
+	}
+	abs, err := filepath.Abs(restored_file)
+	if err != nil {
+		fail(err)
+	}
+	repo.logOp("restore", abs, backup)
+	inform("File restored: %s\n", restored_file)
+}
+
+func restoreAll(repo *Repo, label, dir string, force bool) {
+	/*
+	 * Lay out every version of label side by side in dir, as
+	 * <basename>_v<N><ext>, to compare them. There is nothing to
+	 * undo: the files are new, or overwritten with --force.
+	 */
+	labels := repo.readLabelsMap()
+	basename, ok := labels[label]
+	if !ok {
+		fail(notFoundError("no such label %q", label))
+	}
+	if dir == "" {
+		dir = "."
+	}
+
+	var versions []*Version
+	for _, v := range repo.readVersionsTable() {
+		if v.label == label && v.versionNumber > 0 {
+			versions = append(versions, v)
+		}
+	}
+	if len(versions) == 0 {
+		fail(notFoundError("label %q has no versions yet", label))
+	}
+
+	files := make([]string, len(versions))
+	for i, v := range versions {
+		name := fmt.Sprintf("%s_v%d%s", basename, v.versionNumber, filepath.Ext(v.origFile))
+		if v.isDir() {
+			name = fmt.Sprintf("%s_v%d", basename, v.versionNumber)
+		}
+		files[i] = filepath.Join(dir, name)
+		if _, err := os.Lstat(files[i]); err == nil && !force {
+			fail(fmt.Errorf("%s already exists, use --force to overwrite it", files[i]))
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		fail(err)
+	}
+	for i, v := range versions {
+		if err := os.RemoveAll(files[i]); err != nil {
+			fail(err)
+		}
+		debugf("inflate %s into %s", repo.archivePath(v.id), files[i])
+		if err := repo.inflateVersion(v, files[i]); err != nil {
+			fail(err)
+		}
+		inform("  %s\n", files[i])
+	}
+	inform("%d versions of label %q restored into %s.\n", len(versions), label, dir)
+}
+
+func checkoutVersion(repo *Repo, args []string) {
+	/*
+	 * Go back to an old version and keep working from it. The old
+	 * content becomes the next version of the label, reusing its
+	 * archive, and replaces the current version file. Later
+	 * versions stay in the history.
+	 */
+
+	fs := flag.NewFlagSet("checkout", flag.ExitOnError)
+	force := fs.Bool("force", false, "replace a modified current file without asking")
+	note := fs.String("m", "", "note for the new version")
+	args = parseArgs(fs, args[2:])
+
+	if len(args) != 2 {
+		fmt.Fprintf(os.Stderr, "Missing arguments.\n")
+		usage(ExitUsage)
+		return
+	}
+	label := args[0]
+
+	repo.lock()
+	defer repo.unlock()
+
+	found, err := repo.findVersion(label, args[1])
+	if err != nil {
+		fail(err)
+	}
+	current, err := repo.findVersion(label, "latest")
+	if err != nil {
+		fail(err)
+	}
+	if found.id == current.id {
+		fail(fmt.Errorf("version %d of label %q is the current content already", found.versionNumber, label))
+	}
+
+	/* A current file with changes of its own is only replaced on request */
+	if _, err := repo.isLastVersionChanged(label); err != nil && !errors.Is(err, os.ErrNotExist) {
+		fmt.Fprintln(os.Stderr, err)
+		if !*force && !askYesNo(stdin, fmt.Sprintf("Replace %s?", current.file)) {
+			fmt.Println("Abort.")
+			return
+		}
+	}
+
+	author, err := repo.authorEmail()
+	if err != nil {
+		fail(err)
+	}
+	if *note == "" {
+		*note = fmt.Sprintf("checkout of version %d", found.versionNumber)
+	}
+	v := *found
+	v.date = getDate()
+	v.time = getTime(repo.config.precision)
+	v.versionNumber = current.versionNumber + 1
+	v.author = author
+	v.note = *note
+	v.host, v.user = provenance()
+	v.parent = current.id
+	v.file = repo.versionFilename(label, v.versionNumber, found.origFile)
+
+	newFile := repo.workPath(v.file)
+	if v.file != current.file {
+		if _, err := os.Lstat(newFile); err == nil {
+			fail(fmt.Errorf("%s already exists", v.file))
+		}
+	}
+	if v.file == current.file || repo.config.previous != "keep" {
+		if err := os.RemoveAll(repo.workPath(current.file)); err != nil {
+			fail(err)
+		}
+	}
+	debugf("inflate %s into %s", repo.archivePath(v.id), newFile)
+	if err := repo.inflateVersion(&v, newFile); err != nil {
+		fail(err)
+	}
+
+	repo.writeToVersionsTable(v)
+	repo.logOp("checkout", label, strconv.Itoa(v.versionNumber))
+	repo.queueHook(v)
+	inform("Checkout: version %d of label %q --> %s\n", found.versionNumber, label, v.file)
+}
+
+func showVersion(repo *Repo, args []string) {
+	/*
+	 * Print the content of a version without leaving a file behind.
+	 * It is meant for text, so anything that is not valid UTF-8 is
+	 * refused unless --force is given.
+	 */
+
+	fs := flag.NewFlagSet("show", flag.ExitOnError)
+	force := fs.Bool("force", false, "print binary content too")
+	args = parseArgs(fs, args[2:])
+
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Fprintf(os.Stderr, "Missing arguments.\n")
+		usage(ExitUsage)
+		return
+	}
+
+	found, err := repo.lookupVersion(args)
+	if err != nil {
+		fail(err)
+	}
+	if found.isDir() && !*force {
+		fail(fmt.Errorf("%s is a directory, use restore instead", found.file))
+	}
+
+	var buf bytes.Buffer
+	if err := repo.decompressVersion(found, &buf); err != nil {
+		fail(err)
+	}
+	if !utf8.Valid(buf.Bytes()) && !*force {
+		fail(fmt.Errorf("%s is not a text file, use --force to show it anyway", found.file))
+	}
+	os.Stdout.Write(buf.Bytes())
+}
+
+func undoUpdate(repo *Repo, args []string) {
+	/*
+	 * There are two possibilities:
+	 * 1. Last command was "track". In that case the
+	 *    last entry in versions-table would be a version 0.
+	 *    In this case just remove the last entries from
+	 *    the labels-table and the versions-table
+	 *
+	 * 2. Last command was "update".
+	 *    In this case we must remove the current
+	 *    version and restore the previous from that label.
+	 *    To do this:
+	 *	- Remove the archived file. Rename the current
+	 *	  version to it's original name.
+	 *	- Restore the previous version.
+	 *    Then delete the last entry from versions-table.
+	 *
+	 * "undo <n>" goes back n steps, asking once. It stops before a
+	 * track, since removing a label is better done on purpose.
+	 */
+
+	fs := flag.NewFlagSet("undo", flag.ExitOnError)
+	force := fs.Bool("force", false, "don't ask for confirmation")
+	noDelete := fs.Bool("no-archive-delete", false, "move removed archives to the trash, as with config trash on")
+	args = parseArgs(fs, args[2:])
+
+	steps := 1
+	if len(args) > 1 {
+		fmt.Fprintf(os.Stderr, "Too many arguments.\n")
+		usage(ExitUsage)
+		return
+	}
+	if len(args) == 1 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 1 {
+			fail(usageError("number of steps must be a positive number, got %q", args[0]))
+		}
+		steps = n
+	}
+
+	repo.lock()
+	defer repo.unlock()
+
+	if steps > 1 {
+		inform("Undo the last %d operations.\n", steps)
+		if !*force && !askYesNo(stdin, "Undo?") {
+			fmt.Println("Abort.")
+			return
+		}
+		*force = true
+	}
+	trash := *noDelete || repo.config.trash == "on"
+	for i := 0; i < steps; i++ {
+		if !undoLast(repo, *force, steps > 1, trash) {
+			if steps > 1 {
+				inform("Undid %d of %d operations.\n", i, steps)
+			}
+			return
+		}
+	}
+}
+
+func undoLast(repo *Repo, force bool, keepTracks bool, trash bool) bool {
+	/* Undo one operation, and tell if it was done */
+	op := repo.lastOp()
+	versionsTable := repo.readVersionsTable()
+	var lastEntry *Version
+	if len(versionsTable) > 0 {
+		lastEntry = versionsTable[len(versionsTable)-1]
+	}
+
+	/* Every row is logged as it is added, so an entry that names another one is left from before */
+	for op != nil && op.name != "restore" && (lastEntry == nil || !op.made(lastEntry)) {
+		debugf("drop oplog entry %s %q, not for the last row", op.name, op.args)
+		repo.popOp()
+		op = repo.lastOp()
+	}
+	if op != nil && op.name == "restore" {
+		return undoRestore(repo, op, force)
+	}
+
+	if lastEntry == nil {
+		inform("Nothing to undo.\n")
+		return false
+	}
+	if lastEntry.versionNumber == 0 && keepTracks {
+		fmt.Printf("Stop at the track of label %q, undo it on its own.\n", lastEntry.label)
+		return false
+	}
+
+	/* A checkout made its file from the archive, so there is no original to rename back */
+	checkout := op != nil && op.name == "checkout"
+
+	/* The original name may have been taken since, and is never overwritten */
+	origFile := lastEntry.origFile
+	if lastEntry.versionNumber > 0 && !checkout {
+		origFile = repo.freeName(lastEntry.origFile)
+	}
+
+	/* An update of several files puts each back where it came from */
+	var members, memberDests []string
+	if op != nil && op.name == "update" && len(op.args) > 2 {
+		members = op.args[2:]
+		for _, m := range members {
+			memberDests = append(memberDests, freePath(m, func(p string) string { return p }))
+		}
+	}
+
+	/* Archives are shared by labels with the same content */
+	var shared bool
+	for _, v := range versionsTable[:len(versionsTable)-1] {
+		if v.id == lastEntry.id {
+			shared = true
+		}
+	}
+
+	if lastEntry.versionNumber == 0 {
+		inform("Undo track of label %q.\n", lastEntry.label)
+	} else {
+		inform("Undo version %d of label %q by %s:\n", lastEntry.versionNumber, lastEntry.label, lastEntry.author)
+		if shared {
+			inform("  keep archive %s, used by other versions\n", repo.archivePath(lastEntry.id))
+		} else if trash {
+			inform("  move archive %s to the trash\n", repo.archivePath(lastEntry.id))
+		} else {
+			inform("  remove archive %s\n", repo.archivePath(lastEntry.id))
+		}
+		if checkout {
+			inform("  remove %s\n", lastEntry.file)
+		} else if members != nil {
+			for i, m := range members {
+				inform("  move %s ---> %s\n", filepath.Join(lastEntry.file, filepath.Base(m)), memberDests[i])
+			}
+		} else if origFile != lastEntry.origFile {
+			inform("  rename %s ---> %s, as %s exists\n", lastEntry.file, origFile, lastEntry.origFile)
+		} else {
+			inform("  rename %s ---> %s\n", lastEntry.file, origFile)
+		}
+		for _, v := range versionsTable[:len(versionsTable)-1] {
+			if v.label == lastEntry.label && v.versionNumber == lastEntry.versionNumber-1 && v.versionNumber > 0 {
+				inform("  restore previous version %s\n", v.file)
+			}
+		}
+	}
+	if !force && !askYesNo(stdin, "Undo?") {
+		fmt.Println("Abort.")
+		return false
+	}
+
+	if lastEntry.versionNumber == 0 {
+		if err := removeLastLine(repo.labelsTable); err != nil {
+			fail(err)
+		}
+		if err := removeLastLine(repo.versionsTable); err != nil {
+			fail(err)
+		}
+		repo.tableChanged()
+		inform("Remove label %q.\n", lastEntry.label)
+	} else {
+		/*
+		 * The archive goes last: if anything fails before, the
+		 * table still matches the archives, and a leftover
+		 * archive is only something for gc.
+		 */
+		if checkout {
+			os.RemoveAll(repo.workPath(lastEntry.file))
+			inform("Remove: %s\n", lastEntry.file)
+		} else if members != nil {
+			repo.putBackMembers(lastEntry.file, members, memberDests)
+		} else if err := os.Rename(repo.workPath(lastEntry.file), repo.workPath(origFile)); os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "%s is not there, nothing to rename.\n", lastEntry.file)
+		} else if err != nil {
+			fail(err)
+		} else {
+			inform("Rename: %s ---> %s\n", lastEntry.file, origFile)
+		}
+
+		if err := removeLastLine(repo.versionsTable); err != nil {
+			fail(err)
+		}
+		repo.tableChanged()
+		if !shared {
+			if err := repo.removeArchive(lastEntry, trash); err != nil {
+				fmt.Fprintf(os.Stderr, "Archive %s left in place: %v\n", lastEntry.id, err)
+			}
+		}
+		if lastEntry.versionNumber > 1 {
+			repo.restoreLastVersion(lastEntry.label)
+		}
+	}
+	if op != nil {
+		repo.popOp()
+	}
+	return true
+}
+
+func (repo *Repo) putBackMembers(file string, members, dests []string) {
+	/* Move the files of the version directory file back to dests, then remove it if empty */
+	for i, m := range members {
+		from := filepath.Join(repo.workPath(file), filepath.Base(m))
+		if _, err := os.Lstat(from); os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "%s is not there, nothing to move.\n", from)
+			continue
+		}
+		err := os.MkdirAll(filepath.Dir(dests[i]), 0755)
+		if err == nil {
+			err = os.Rename(from, dests[i])
+		}
+		if err != nil {
+			fail(err)
+		}
+		inform("Move: %s ---> %s\n", filepath.Join(file, filepath.Base(m)), dests[i])
+	}
+	if err := os.Remove(repo.workPath(file)); err != nil && !os.IsNotExist(err) {
+		fmt.Fprintf(os.Stderr, "%s left in place: %v\n", file, err)
+	}
+}
+
+func undoRestore(repo *Repo, op *Op, force bool) bool {
+	/* Remove the restored file, and put back the one it replaced */
+	if len(op.args) != 2 {
+		fail(fmt.Errorf("malformed oplog entry %q", op.args))
+	}
+	file, backup := op.args[0], op.args[1]
+
+	inform("Undo restore of %s:\n", file)
+	inform("  remove %s\n", file)
+	if backup != "none" {
+		inform("  put back the file it replaced\n")
+	}
+	if !force && !askYesNo(stdin, "Undo?") {
+		fmt.Println("Abort.")
+		return false
+	}
+
+	if err := os.RemoveAll(file); err != nil {
+		fail(err)
+	}
+	inform("Remove: %s\n", file)
+	if backup != "none" {
+		if err := os.Rename(backup, file); err != nil {
+			fail(err)
+		}
+		inform("Put back: %s\n", file)
+	}
+	repo.popOp()
+	return true
+}
+
+func deleteLabel(repo *Repo, args []string) {
+	/*
+	 * Remove the label from the labels-table, all its entries from
+	 * the versions-table, and the archives no other label uses.
+	 * Version files in the working directory are left alone.
+	 */
+
+	fs := flag.NewFlagSet("delete", flag.ExitOnError)
+	force := fs.Bool("force", false, "don't ask for confirmation")
+	args = parseArgs(fs, args[2:])
+
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "Missing arguments.\n")
+		usage(ExitUsage)
+		return
+	}
+	label := args[0]
+
+	repo.lock()
+	defer repo.unlock()
+
+	if _, ok := repo.readLabelsMap()[label]; !ok {
+		fail(notFoundError("no such label %q", label))
+	}
+
+	var versions int
+	var ids []*Version
+	usedElsewhere := make(map[string]bool)
+	for _, v := range repo.readVersionsTable() {
+		if v.label != label {
+			usedElsewhere[v.id] = true
+		} else if v.versionNumber > 0 {
+			versions++
+			ids = append(ids, v)
+		}
+	}
+
+	repo.withBases(usedElsewhere)
+	var archives []*Version
+	for _, v := range ids {
+		if !usedElsewhere[v.id] {
+			usedElsewhere[v.id] = true
+			archives = append(archives, v)
+		}
+	}
+
+	trash := repo.config.trash == "on"
+	if trash {
+		inform("Label %q has %d versions and %d archives to move to the trash.\n", label, versions, len(archives))
+	} else {
+		inform("Label %q has %d versions and %d archives to remove.\n", label, versions, len(archives))
+	}
+	if !*force && !askYesNo(stdin, "Delete label?") {
+		fmt.Println("Abort.")
+		return
+	}
+
+	if err := filterTable(repo.labelsTable, func(field []string) bool { return field[0] != label }); err != nil {
+		fail(err)
+	}
+	if err := filterTable(repo.versionsTable, func(field []string) bool { return len(field) < 3 || field[2] != label }); err != nil {
+		fail(err)
+	}
+	repo.tableChanged()
+	repo.editOplog(func(op Op) *Op {
+		if op.name != "restore" && len(op.args) > 0 && op.args[0] == label {
+			return nil
+		}
+		return &op
+	})
+	/* Newest first, so a delta goes to the trash while its base is still there */
+	for _, v := range slices.Backward(archives) {
+		if err := repo.removeArchive(v, trash); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+	inform("Delete label %q.\n", label)
+}
+
+func renameLabel(repo *Repo, args []string) {
+	/*
+	 * Change the label key in both tables. The basename and
+	 * the version files keep their names.
+	 */
+
+	if len(args) != 4 {
+		fmt.Fprintf(os.Stderr, "Missing arguments.\n")
+		usage(ExitUsage)
+		return
+	}
+	oldLabel := args[2]
+	newLabel := args[3]
+	if err := checkName("label", newLabel); err != nil {
+		fail(err)
+	}
+
+	repo.lock()
+	defer repo.unlock()
+
+	labelsMap := repo.readLabelsMap()
+	if _, ok := labelsMap[oldLabel]; !ok {
+		fail(notFoundError("no such label %q", oldLabel))
+	}
+	if _, ok := labelsMap[newLabel]; ok {
+		fail(fmt.Errorf("Label %q already exists.", newLabel))
+	}
+
+	err := editTable(repo.versionsTable, func(field []string) []string {
+		if len(field) > 2 && field[2] == oldLabel {
+			field[2] = newLabel
+		}
+		return field
+	})
+	if err != nil {
+		fail(err)
+	}
+	repo.tableChanged()
+
+	err = editTable(repo.labelsTable, func(field []string) []string {
+		if field[0] == oldLabel {
+			field[0] = newLabel
+		}
+		return field
+	})
+	if err != nil {
+		fail(err)
+	}
+	repo.editOplog(func(op Op) *Op {
+		if op.name != "restore" && len(op.args) > 0 && op.args[0] == oldLabel {
+			op.args[0] = newLabel
+		}
+		return &op
+	})
+	inform("Rename label %q --> %q\n", oldLabel, newLabel)
+}
+
+func setBasename(repo *Repo, args []string) {
+	/*
+	 * Change the basename new versions of a label are named with.
+	 * With --rename the version files get it too: the FILE column
+	 * of every version, and the files that are still there.
+	 */
+
+	fs := flag.NewFlagSet("set-basename", flag.ExitOnError)
+	rename := fs.Bool("rename", false, "rename the existing version files too")
+	args = parseArgs(fs, args[2:])
+
+	if len(args) != 2 {
+		fmt.Fprintf(os.Stderr, "Missing arguments.\n")
+		usage(ExitUsage)
+		return
+	}
+	label, basename := args[0], args[1]
+	if err := checkName("basename", basename); err != nil {
+		fail(err)
+	}
+
+	repo.lock()
+	defer repo.unlock()
+
+	labelsMap := repo.readLabelsMap()
+	oldBasename, ok := labelsMap[label]
+	if !ok {
+		fail(notFoundError("no such label %q", label))
+	}
+	var template string
+	for _, l := range repo.readLabels() {
+		if l.Label == label {
+			template = l.Template
+		}
+	}
+	if oldBasename == basename {
+		fail(fmt.Errorf("label %q has basename %q already", label, basename))
+	}
+	for other, b := range labelsMap {
+		if b == basename {
+			fail(fmt.Errorf("basename %q is already used by label %q", basename, other))
+		}
+	}
+
+	/*
+	 * Old filenames to new ones, checked before anything is changed.
+	 * A name is made again from the template with the new basename,
+	 * if the old one is what the template makes: one renamed by hand,
+	 * or made with other initials, is left as it is.
+	 */
+	renames := make(map[string]string)
+	if *rename {
+		for _, v := range repo.readVersionsTable() {
+			if v.label != label || v.file == "none" {
+				continue
+			}
+			if v.file != versionName(template, oldBasename, v.versionNumber, repo.config.initials, v.date, v.origFile) {
+				inform("%s is not named by the template, keep its name\n", v.file)
+				continue
+			}
+			newFile := versionName(template, basename, v.versionNumber, repo.config.initials, v.date, v.origFile)
+			if _, err := os.Lstat(repo.workPath(newFile)); err == nil {
+				fail(fmt.Errorf("%s already exists", newFile))
+			}
+			renames[v.file] = newFile
+		}
+	}
+
+	err := editTable(repo.labelsTable, func(field []string) []string {
+		if field[0] == label {
+			field[1] = basename
+		}
+		return field
+	})
+	if err != nil {
+		fail(err)
+	}
+	if len(renames) > 0 {
+		err = editTable(repo.versionsTable, func(field []string) []string {
+			if len(field) < 6 || field[2] != label {
+				return field
+			}
+			if newFile, ok := renames[field[5]]; ok {
+				field[5] = newFile
+			}
+			return field
+		})
+		if err != nil {
+			fail(err)
+		}
+		repo.tableChanged()
+	}
+
+	for _, oldFile := range slices.Sorted(maps.Keys(renames)) {
+		if _, err := os.Lstat(repo.workPath(oldFile)); err != nil {
+			continue
+		}
+		if err := os.Rename(repo.workPath(oldFile), repo.workPath(renames[oldFile])); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			continue
+		}
+		inform("Rename: %s ---> %s\n", oldFile, renames[oldFile])
+	}
+	inform("Basename of label %q: %q --> %q\n", label, oldBasename, basename)
+}
+
+func amendVersion(repo *Repo, args []string) {
+	/*
+	 * Change the author or note of the last version, to fix a typo
+	 * or add a note after the fact. Only those columns of its row
+	 * are rewritten: the content, the id and the files stay as
+	 * they are, so the archive still matches.
+	 */
+
+	fs := flag.NewFlagSet("amend", flag.ExitOnError)
+	author := fs.String("author", "", "author email, or the number or name of a known author")
+	note := fs.String("m", "", "note describing the version")
+	args = parseArgs(fs, args[2:])
+
+	if len(args) != 0 {
+		fmt.Fprintf(os.Stderr, "Too many arguments.\n")
+		usage(ExitUsage)
+		return
+	}
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	if !given["author"] && !given["m"] {
+		fail(usageError("nothing to amend, give --author or -m"))
+	}
+
+	repo.lock()
+	defer repo.unlock()
+
+	versions := repo.readVersionsTable()
+	if len(versions) == 0 {
+		fail(notFoundError("no versions to amend"))
+	}
+	last := versions[len(versions)-1]
+	if last.versionNumber == 0 {
+		fail(usageError("the last entry is the track of label %q, there is no version to amend", last.label))
+	}
+
+	oldAuthor, oldNote := last.author, last.note
+	if given["author"] {
+		email := resolveAuthor(repo.readAuthors(), *author)
+		if email == "" {
+			email = *author
+		}
+		if !isValidEmail(email) {
+			fail(usageError("invalid email %q", email))
+		}
+		last.author = email
+	}
+	if given["m"] {
+		last.note = *note
+	}
+
+	lines, err := readLines(repo.versionsTable)
+	if err != nil {
+		fail(err)
+	}
+	for i := len(lines) - 1; i >= 0; i-- {
+		if isMarker(lines[i]) || strings.TrimSpace(lines[i]) == "" {
+			continue
+		}
+		lines[i] = joinFields(last.fields()...)
+		break
+	}
+	if err := writeLines(repo.versionsTable, lines); err != nil {
+		fail(err)
+	}
+	repo.tableChanged()
+
+	inform("Amend version %d of label %q\n", last.versionNumber, last.label)
+	if last.author != oldAuthor {
+		inform("  author: %s --> %s\n", oldAuthor, last.author)
+	}
+	if last.note != oldNote {
+		inform("  note  : %q --> %q\n", oldNote, last.note)
+	}
+}
+
+func diffVersions(repo *Repo, args []string) {
+	if len(args) < 3 || len(args) > 5 {
+		fmt.Fprintf(os.Stderr, "Missing arguments.\n")
+		usage(ExitUsage)
+		return
+	}
+
+	label := args[2]
+	if len(args) == 3 {
+		if err := diffWorking(repo, label); err != nil {
+			fail(err)
+		}
+		return
+	}
+	v1, v2 := args[3], "latest"
+	if len(args) == 5 {
+		v2 = args[4]
+	}
+
+	if err := runDiff(repo, label, v1, v2); err != nil {
+		fail(err)
+	}
+}
+
+func runDiff(repo *Repo, label, v1, v2 string) error {
+	/* Inflate both archives to temporary files and let diff(1) compare them */
+
+	tmp, err := os.MkdirTemp("", "msmanager-diff-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	var files, names [2]string
+	var dirs bool
+	for i, number := range [2]string{v1, v2} {
+		v, err := repo.findVersion(label, number)
+		if err != nil {
+			return err
+		}
+
+		files[i] = filepath.Join(tmp, [2]string{"a", "b"}[i])
+		names[i] = v.file
+		dirs = v.isDir()
+		if err := inflate(repo.archivePath(v.id), files[i], dirs); err != nil {
+			return err
+		}
+	}
+
+	cmd := exec.Command("diff", "-u", "-L", names[0], "-L", names[1], files[0], files[1])
+	if dirs {
+		/* Labels only apply to files, a tree diff names each file a/... and b/... */
+		cmd = exec.Command("diff", "-ruN", "a", "b")
+		cmd.Dir = tmp
+	}
+	return runDiffCommand(cmd)
+}
+
+func diffWorking(repo *Repo, label string) error {
+	/*
+	 * Compare the version file of label, as it is now, with its
+	 * latest archived version: what an update would record.
+	 */
+	v, err := repo.findVersion(label, "latest")
+	if err != nil {
+		return err
+	}
+	file := repo.workPath(v.file)
+	if _, err := os.Stat(file); err != nil {
+		return notFoundError("version file %s is missing", v.file)
+	}
+	sum, err := repo.inputSha1(label, file)
+	if err != nil {
+		return err
+	}
+	if sum == v.id {
+		fmt.Println("No changes.")
+		return nil
+	}
+
+	tmp, err := os.MkdirTemp("", "msmanager-diff-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	/* With the newlines of the config, as the version file got them */
+	archived := filepath.Join(tmp, "a")
+	if err := repo.writeVersion(v, archived); err != nil {
+		return err
+	}
+	cmd := exec.Command("diff", "-u", "-L", v.file+" (archived)", "-L", v.file, archived, file)
+	if v.isDir() {
+		cmd = exec.Command("diff", "-ruN", archived, file)
+	}
+	return runDiffCommand(cmd)
+}
+
+func runDiffCommand(cmd *exec.Cmd) error {
+	/* Exit status 1 only means the files differ */
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+func verifyArchives(repo *Repo) {
+	/*
+	 * Archives are named after the sha1 of their content, so
+	 * inflating each one and hashing it again tells if it was
+	 * damaged. The parent ids must also chain the versions of each
+	 * label in order. Exit with 1 if anything is wrong.
+	 */
+
+	checked := make(map[string]error)
+	var problems int
+	for _, v := range repo.readVersionsTable() {
+		if v.id == "none" {
+			continue
+		}
+
+		err, ok := checked[v.id]
+		if !ok {
+			err = checkArchive(repo.archivePath(v.id), v.id)
+			checked[v.id] = err
+		}
+		if err != nil {
+			fmt.Printf("%s %d %s: %v\n", v.label, v.versionNumber, v.id, err)
+			problems++
+		}
+	}
+
+	/* Each version must point to the one before it in its label */
+	last := make(map[string]string)
+	for _, v := range repo.readVersionsTable() {
+		if v.versionNumber == 0 {
+			continue
+		}
+		expected, ok := last[v.label]
+		if !ok {
+			expected = "none"
+		}
+		last[v.label] = v.id
+		if v.parent != "-" && v.parent != expected {
+			fmt.Printf("%s %d %s: parent is %s, expected %s\n", v.label, v.versionNumber, v.id, v.parent, expected)
+			problems++
+		}
+	}
+
+	if problems > 0 {
+		fmt.Printf("%d problems found.\n", problems)
+		os.Exit(ExitIntegrity)
+	}
+	inform("%d archives OK.\n", len(checked))
+}
+
+func printLatest(repo *Repo, args []string) {
+	/* Print the current version file of label, for scripts */
+	fs := flag.NewFlagSet("latest", flag.ExitOnError)
+	printID := fs.Bool("id", false, "print the ID instead of the filename")
+	args = parseArgs(fs, args[2:])
+
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "Missing arguments.\n")
+		usage(ExitUsage)
+		return
+	}
+
+	v, err := repo.findVersion(args[0], "latest")
+	if err != nil {
+		fail(err)
+	}
+	if *printID {
+		fmt.Println(v.id)
+		return
+	}
+	fmt.Println(v.file)
+}
+
+func findFile(repo *Repo, args []string) {
+	/* Tell which versions have the same content as a file */
+	if len(args) != 3 {
+		fmt.Fprintf(os.Stderr, "Missing arguments.\n")
+		usage(ExitUsage)
+		return
+	}
+
+	/* Text labels have the id of the file with its newlines normalized */
+	id := calculateSha1(args[2])
+	textID, err := textSha1(args[2])
+	if err != nil {
+		fail(err)
+	}
+
+	var rows [][]string
+	for _, v := range repo.readVersionsTable() {
+		if v.id == id || (v.id == textID && !v.isDir() && repo.isText(v.label)) {
+			rows = append(rows, []string{v.label, strconv.Itoa(v.versionNumber), v.date, v.file})
+		}
+	}
+	if len(rows) == 0 {
+		fmt.Printf("%s: not tracked\n", args[2])
+		os.Exit(ExitNotFound)
+	}
+	printRows("LABEL VERSION DATE FILE", rows)
+}
+
+func printInfo(repo *Repo) {
+	root, err := filepath.Abs(repo.root)
+	if err != nil {
+		fail(err)
+	}
+
+	var versions int
+	var first, last string
+	for _, v := range repo.readVersionsTable() {
+		if v.versionNumber > 0 {
+			versions++
+		}
+		if first == "" || v.date < first {
+			first = v.date
+		}
+		if v.date > last {
+			last = v.date
+		}
+	}
+
+	files, err := repo.archiveFiles()
+	if err != nil {
+		fail(err)
+	}
+	var archives int
+	var size int64
+	for _, f := range files {
+		fi, err := os.Lstat(f)
+		if err != nil {
+			fail(err)
+		}
+		if fi.Mode().IsRegular() {
+			archives++
+			size += fi.Size()
+		}
+	}
+
+	fmt.Printf("Root    : %s\n", root)
+	fmt.Printf("Labels  : %d\n", len(repo.readLabels()))
+	fmt.Printf("Versions: %d\n", versions)
+	fmt.Printf("Archives: %d (%d bytes)\n", archives, size)
+	if first != "" {
+		fmt.Printf("Activity: %s to %s\n", first, last)
+	}
+}
+
+func listArchives(repo *Repo, args []string) {
+	/*
+	 * List the archives with their size and how many versions refer
+	 * to them. Orphans are what gc would remove, shared ones are
+	 * content stored once for several versions. Archives the table
+	 * refers to but that are not there are listed as missing.
+	 */
+
+	fs := flag.NewFlagSet("archives", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print as JSON")
+	args = parseArgs(fs, args[2:])
+
+	if len(args) != 0 {
+		fmt.Fprintf(os.Stderr, "Too many arguments.\n")
+		usage(ExitUsage)
+		return
+	}
+
+	refs := make(map[string]int)
+	for _, v := range repo.readVersionsTable() {
+		if v.id != "none" {
+			refs[v.id]++
+		}
+	}
+
+	files, err := repo.archiveFiles()
+	if err != nil {
+		fail(err)
+	}
+
+	bases := make(map[string]bool)
+	for id := range refs {
+		bases[id] = true
+	}
+	repo.withBases(bases)
+
+	records := []ArchiveRecord{}
+	seen := make(map[string]bool)
+	for _, f := range files {
+		id := archiveID(f)
+		if id == "" {
+			continue
+		}
+		fi, err := os.Lstat(f)
+		if err != nil {
+			fail(err)
+		}
+		seen[id] = true
+		size := fi.Size()
+		records = append(records, ArchiveRecord{ID: id, Size: &size, Refs: refs[id], Base: bases[id] && refs[id] == 0})
+	}
+	for _, id := range slices.Sorted(maps.Keys(refs)) {
+		if !seen[id] {
+			records = append(records, ArchiveRecord{ID: id, Refs: refs[id]})
+		}
+	}
+	for i := range records {
+		records[i].Status = records[i].status()
+	}
+
+	if *asJSON {
+		printJSON(records)
+		return
+	}
+	var rows [][]string
+	for _, r := range records {
+		size := "-"
+		if r.Size != nil {
+			size = strconv.FormatInt(*r.Size, 10)
+		}
+		rows = append(rows, []string{r.ID, size, strconv.Itoa(r.Refs), r.Status})
+	}
+	printRows("ID SIZE REFS STATUS", rows)
+}
+
+func collectGarbage(repo *Repo, args []string) {
+	/*
+	 * Remove the files in the archives directory that no entry of
+	 * the versions-table refers to. They are left behind by updates
+	 * that failed halfway or by edits made to the tables by hand.
+	 */
+
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "list orphaned archives without removing them")
+	args = parseArgs(fs, args[2:])
+
+	if len(args) != 0 {
+		fmt.Fprintf(os.Stderr, "Too many arguments.\n")
+		usage(ExitUsage)
+		return
+	}
+
+	repo.lock()
+	defer repo.unlock()
+
+	/* Deltas need the archives they are based on */
+	ids := make(map[string]bool)
+	for _, v := range repo.readVersionsTable() {
+		if v.id != "none" {
+			ids[v.id] = true
+		}
+	}
+	repo.withBases(ids)
+	used := make(map[string]bool)
+	for id := range ids {
+		used[repo.archivePath(id)] = true
+	}
+
+	files, err := repo.archiveFiles()
+	if err != nil {
+		fail(err)
+	}
+
+	var orphans []string
+	var size int64
+	for _, path := range files {
+		if used[path] {
+			continue
+		}
+		fi, err := os.Lstat(path)
+		if err != nil {
+			fail(err)
+		}
+		fmt.Printf("%s  %d bytes\n", path, fi.Size())
+		orphans = append(orphans, path)
+		size += fi.Size()
+	}
+
+	if len(orphans) == 0 {
+		inform("No orphaned archives.\n")
+		return
+	}
+	inform("%d orphaned archives, %d bytes.\n", len(orphans), size)
+	if *dryRun {
+		return
+	}
+	if !askYesNo(stdin, "Remove them?") {
+		fmt.Println("Abort.")
+		return
+	}
+
+	var reclaimed int64
+	for _, path := range orphans {
+		fi, err := os.Stat(path)
+		if err == nil {
+			err = os.Remove(path)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			continue
+		}
+		reclaimed += fi.Size()
+	}
+	inform("Reclaimed %d bytes.\n", reclaimed)
+}
+
+func exportCSV(repo *Repo, args []string) {
+	if len(args) != 3 {
+		fmt.Fprintf(os.Stderr, "Missing arguments.\n")
+		usage(ExitUsage)
+		return
+	}
+
+	out := os.Stdout
+	if args[2] != "-" {
+		f, err := os.Create(args[2])
+		if err != nil {
+			fail(err)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	w := csv.NewWriter(out)
+	w.Write(strings.Fields(VersionsHeader + " " + ProvenanceHeader))
+	for _, v := range repo.readVersionsTable() {
+		w.Write(v.fields())
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		fail(err)
+	}
 }
 
-func usage() {
-	fmt.Println("usage: msmanager")
+func usage(code int) {
+	fmt.Println("usage: msmanager [--yes] [--quiet] [--verbose] [--author <email>] [--repo <dir>] <command> [<args>]")
+	fmt.Println("Options:")
+	fmt.Println("  --yes                       Don't ask for confirmation")
+	fmt.Println("  --quiet                     Print only errors and the output asked for")
+	fmt.Println("  --author <email>            Author email for update, instead of asking")
+	fmt.Println("  --compress-verify           Read each new archive back, to check it before using it")
+	fmt.Println("  --repo <dir>                Use the repository in dir, instead of looking for one")
+	fmt.Println("  --verbose                   Log each step to stderr")
 	fmt.Println("Commands:")
 	fmt.Println("  init                        Initialize a new repository")
-	fmt.Println("  track <label> <basename>    Start tracking label, naming files with <basename>")
-	fmt.Println("  update <label> <file>       Update version of label with file")
-	fmt.Println("  hist                        Show versions history")
-	fmt.Println("  labels                      Print labels and their basenames")
-	fmt.Println("  restore <ID>                Restore a file")
-	fmt.Println("  undo                        Undo the last command")
-	os.Exit(0)
+	fmt.Println("  config [<key> [<value>]]    Show or set configuration (keys: initials, author, compression, level, precision, outside, eol, restored, previous, delta, encrypt, trash, editor, suffix)")
+	fmt.Println("  config author add <email>   Add a known author, to pick by number or name")
+	fmt.Println("  track [--allow-duplicate-basename] [--template <t>] [--text] [--from <file>]")
+	fmt.Println("        <label> <basename> [<file>]")
+	fmt.Println("                              Start tracking label, naming files with <basename>,")
+	fmt.Println("                              from a copy of the --from file if given")
+	fmt.Println("  update [-m <note>] [--dry-run] [<label>] [<file>...]")
+	fmt.Println("                              Update version of label with file or directory,")
+	fmt.Println("                              asking for the ones left out")
+	fmt.Println("  batch [--fail-fast] [--jobs <n>] <manifest>")
+	fmt.Println("                              Update versions from lines of label, file, author and note")
+	fmt.Println("  hist [--json] [--format <template>] [--since <date>] [--until <date>]")
+	fmt.Println("       [--author <email>] [--author-contains <text>] [--sort <column>] [--reverse]")
+	fmt.Println("       [--verbose] [[--label] <label>]")
+	fmt.Println("                              Show versions history, of label if given")
+	fmt.Println("  log [-n <count>] <label>    Show the versions history of label")
+	fmt.Println("  labels [--json] [--verbose] Print labels and their basenames")
+	fmt.Println("  status [--json]             Show if version files are clean, modified or missing")
+	fmt.Println("  restore [--force] [-o <path>] <ID>")
+	fmt.Println("                              Restore a file, to <path> if given (- for stdout)")
+	fmt.Println("  restore <label> <version>   Restore a version of label (or \"latest\")")
+	fmt.Println("  restore --all [--force] [-o <dir>] <label>")
+	fmt.Println("                              Restore every version of label, into dir if given")
+	fmt.Println("  checkout [--force] [-m <note>] <label> <version>")
+	fmt.Println("                              Make an old version the current one, as a new version")
+	fmt.Println("  show [--force] <ID>         Print a version to stdout (or <label> <version>)")
+	fmt.Println("  undo [--force] [--no-archive-delete] [<n>]")
+	fmt.Println("                              Undo the last track, update, checkout or restore (or the last n),")
+	fmt.Println("                              moving the archives it removes to the trash if asked")
+	fmt.Println("  trash [list]                List the versions whose archives are in the trash")
+	fmt.Println("  trash restore [-o <path>] <ID>")
+	fmt.Println("                              Write a version from the trash, to <path> if given")
+	fmt.Println("  trash empty [--force]       Remove the archives in the trash for good")
+	fmt.Println("  delete [--force] <label>    Stop tracking label and remove its archives")
+	fmt.Println("  amend [--author <email>] [-m <note>]")
+	fmt.Println("                              Change the author or note of the last version")
+	fmt.Println("  rename <old> <new>          Rename a label")
+	fmt.Println("  set-basename [--rename] <label> <basename>")
+	fmt.Println("                              Name new version files of label with basename, and")
+	fmt.Println("                              with --rename the existing ones")
+	fmt.Println("  diff <label> [<v1> [<v2>]]  Compare two versions (v2 defaults to latest), or")
+	fmt.Println("                              with no versions the version file with the latest")
+	fmt.Println("  latest [--id] <label>       Print the current version file of label (or its ID)")
+	fmt.Println("  find <file>                 Show the versions with the same content as file")
+	fmt.Println("  info                        Summarize the repository")
+	fmt.Println("  verify                      Check archives against their IDs")
+	fmt.Println("  fsck [--repair]             Check the repository, and with --repair fix the")
+	fmt.Println("                              versions-table to match the archives there are")
+	fmt.Println("  archives [--json]           List archives with their size and number of versions")
+	fmt.Println("  gc [--dry-run]              Remove archives no version refers to or needs")
+	fmt.Println("  bundle <out.tar.gz>         Pack the tables, config and archives into one file")
+	fmt.Println("  unbundle <in.tar.gz> <dir>  Make a repository in dir from a bundle")
+	fmt.Println("  export <file.csv>           Write the versions history as CSV (- for stdout)")
+	fmt.Println("  completion bash|zsh         Print a script completing commands and labels")
+	fmt.Println("Exit status:")
+	fmt.Println("  0 success, 1 error, 2 wrong usage, 3 not found (label, version, file or")
+	fmt.Println("  repository), 4 integrity problem or repository locked")
+	fmt.Println("Environment:")
+	fmt.Println("  MSMANAGER_DIR               Data directory to use instead of ./msmanager-data")
+	fmt.Println("  MSMANAGER_PASSPHRASE        Passphrase of encrypted archives, instead of asking")
+	os.Exit(code)
 }
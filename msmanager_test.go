@@ -0,0 +1,2545 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+ * Most tests run msmanager itself: with MSMANAGER_TEST_MAIN set the
+ * test binary runs main instead of the tests, so each command gets
+ * its own process, exit code and output, as from a shell. The rest
+ * call the functions directly on a repository in a temp directory.
+ */
+
+const testMainEnv = "MSMANAGER_TEST_MAIN"
+
+const testAuthor = "author@example.com"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(testMainEnv) != "" {
+		main()
+		os.Exit(ExitOK)
+	}
+	os.Exit(m.Run())
+}
+
+type result struct {
+	stdout string
+	stderr string
+	code   int
+}
+
+func testEnv() []string {
+	/* The environment of the tests, without what would change how msmanager runs */
+	var env []string
+	for _, e := range os.Environ() {
+		name, _, _ := strings.Cut(e, "=")
+		if strings.HasPrefix(name, "MSMANAGER_") || name == "EDITOR" || name == "VISUAL" {
+			continue
+		}
+		env = append(env, e)
+	}
+	return append(env, testMainEnv+"=1")
+}
+
+func runWith(t *testing.T, dir, input string, env []string, args ...string) result {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Dir = dir
+	cmd.Env = append(testEnv(), env...)
+	cmd.Stdin = strings.NewReader(input)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	code := ExitOK
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		code = exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return result{stdout.String(), stderr.String(), code}
+}
+
+func run(t *testing.T, dir, input string, args ...string) result {
+	t.Helper()
+	return runWith(t, dir, input, nil, args...)
+}
+
+func msm(t *testing.T, dir string, args ...string) string {
+	/* Run a command that must succeed, and return its output */
+	t.Helper()
+	r := run(t, dir, "", args...)
+	if r.code != ExitOK {
+		t.Fatalf("msmanager %s: exit %d\n%s%s", strings.Join(args, " "), r.code, r.stdout, r.stderr)
+	}
+	return r.stdout
+}
+
+func msmFails(t *testing.T, dir string, code int, args ...string) result {
+	/* Run a command that must fail with code */
+	t.Helper()
+	r := run(t, dir, "", args...)
+	if r.code != code {
+		t.Fatalf("msmanager %s: exit %d, want %d\n%s%s", strings.Join(args, " "), r.code, code, r.stdout, r.stderr)
+	}
+	return r
+}
+
+func newTestRepo(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	msm(t, dir, "init")
+	return dir
+}
+
+func track(t *testing.T, dir, label, basename string, flags ...string) {
+	t.Helper()
+	msm(t, dir, append(append([]string{"track"}, flags...), label, basename)...)
+}
+
+func update(t *testing.T, dir, label, file, content string) string {
+	/* Write content to file and update label with it, returning the version file */
+	t.Helper()
+	writeFile(t, filepath.Join(dir, file), content)
+	msm(t, dir, "--author", testAuthor, "--yes", "update", "-m", "note of "+file, label, file)
+	return latestFile(t, dir, label)
+}
+
+func latestFile(t *testing.T, dir, label string) string {
+	t.Helper()
+	return strings.TrimSpace(msm(t, dir, "latest", label))
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+func history(t *testing.T, dir string, args ...string) []VersionRecord {
+	t.Helper()
+	var records []VersionRecord
+	out := msm(t, dir, append([]string{"hist", "--json"}, args...)...)
+	if err := json.Unmarshal([]byte(out), &records); err != nil {
+		t.Fatalf("hist --json: %v\n%s", err, out)
+	}
+	return records
+}
+
+func versionsOf(t *testing.T, dir, label string) []VersionRecord {
+	/* The rows of label past its track */
+	t.Helper()
+	var versions []VersionRecord
+	for _, r := range history(t, dir) {
+		if r.Label == label && r.Version > 0 {
+			versions = append(versions, r)
+		}
+	}
+	return versions
+}
+
+func openTestRepo(t *testing.T, dir string) *Repo {
+	/* The repository in dir, to call functions on in the test process */
+	t.Helper()
+	repo := newRepo(dir, filepath.Join(dir, DataDirName))
+	repo.config = repo.readConfig()
+	return repo
+}
+
+func withStdin(t *testing.T, input string) {
+	/* Answer the questions of the test process with input */
+	t.Helper()
+	saved := stdin
+	stdin = bufio.NewReader(strings.NewReader(input))
+	t.Cleanup(func() { stdin = saved })
+}
+
+func captureStdout(t *testing.T, f func()) string {
+	/* What f prints on the standard output of the test process */
+	t.Helper()
+	return capture(t, &os.Stdout, f)
+}
+
+func captureStderr(t *testing.T, f func()) string {
+	t.Helper()
+	return capture(t, &os.Stderr, f)
+}
+
+func capture(t *testing.T, file **os.File, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := *file
+	*file = w
+	done := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(r)
+		done <- b
+	}()
+	f()
+	*file = saved
+	w.Close()
+	return string(<-done)
+}
+
+func withQuiet(t *testing.T) {
+	t.Helper()
+	saved := quiet
+	quiet = true
+	t.Cleanup(func() { quiet = saved })
+}
+
+func TestArchiveVersion(t *testing.T) {
+	withQuiet(t)
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	repo := openTestRepo(t, dir)
+	repo.lock()
+	defer repo.unlock()
+
+	input := filepath.Join(dir, "draft.txt")
+	writeFile(t, input, "first draft\n")
+	v, err := repo.archiveVersion("paper", input, testAuthor, "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.versionNumber != 1 || v.author != testAuthor || v.note != "first" || v.parent != "none" {
+		t.Errorf("version 1: got %+v", v)
+	}
+	if exists(input) {
+		t.Errorf("%s still there, it should be renamed to %s", input, v.file)
+	}
+	if got := readFile(t, repo.workPath(v.file)); got != "first draft\n" {
+		t.Errorf("%s holds %q", v.file, got)
+	}
+	if sum, err := archiveSha1(repo.archivePath(v.id)); err != nil || sum != v.id {
+		t.Errorf("archive of %s: sha1 %s, %v", v.id, sum, err)
+	}
+
+	writeFile(t, input, "second draft\n")
+	v2, err := repo.archiveVersion("paper", input, testAuthor, "second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v2.versionNumber != 2 || v2.parent != v.id {
+		t.Errorf("version 2: got number %d, parent %s", v2.versionNumber, v2.parent)
+	}
+	if exists(repo.workPath(v.file)) {
+		t.Errorf("unchanged previous version %s not removed", v.file)
+	}
+
+	versions := repo.readVersionsTable()
+	last := versions[len(versions)-1]
+	if last.id != v2.id || last.file != v2.file || last.note != "second" {
+		t.Errorf("last row of the table: got %+v", last)
+	}
+}
+
+func TestArchiveVersionRefusesSameContent(t *testing.T) {
+	withQuiet(t)
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	repo := openTestRepo(t, dir)
+	repo.lock()
+	defer repo.unlock()
+
+	input := filepath.Join(dir, "draft.txt")
+	writeFile(t, input, "same\n")
+	if _, err := repo.archiveVersion("paper", input, testAuthor, ""); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, input, "same\n")
+	if _, err := repo.archiveVersion("paper", input, testAuthor, ""); err == nil {
+		t.Error("same content archived twice as versions of one label")
+	}
+	if !exists(input) {
+		t.Error("input removed although the update failed")
+	}
+	if n := len(repo.readVersionsTable()); n != 2 {
+		t.Errorf("%d rows in the table, want the track and one version", n)
+	}
+}
+
+func TestArchiveVersionUnknownLabel(t *testing.T) {
+	withQuiet(t)
+	dir := newTestRepo(t)
+	repo := openTestRepo(t, dir)
+	input := filepath.Join(dir, "draft.txt")
+	writeFile(t, input, "text\n")
+	if _, err := repo.archiveVersion("nope", input, testAuthor, ""); err == nil {
+		t.Error("archived a version of a label that is not tracked")
+	}
+}
+
+func TestLabelsVerbose(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	update(t, dir, "paper", "a.txt", "one\n")
+	update(t, dir, "paper", "b.txt", "two\n")
+
+	last := versionsOf(t, dir, "paper")[1]
+	want := strings.Join([]string{"paper", "paper", "2", last.Date, testAuthor}, " ")
+	for _, line := range strings.Split(msm(t, dir, "labels", "--verbose"), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 && fields[0] == "paper" && strings.Join(fields, " ") != want {
+			t.Errorf("paper row: got %q, want %q", fields, want)
+		}
+	}
+}
+
+func TestLabelsVerboseJSON(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	update(t, dir, "paper", "a.txt", "one\n")
+	update(t, dir, "paper", "b.txt", "two\n")
+
+	var records []LabelRecord
+	if err := json.Unmarshal([]byte(msm(t, dir, "labels", "--json", "--verbose")), &records); err != nil {
+		t.Fatal(err)
+	}
+	last := versionsOf(t, dir, "paper")[1]
+	if len(records) != 1 || records[0].Version == nil || *records[0].Version != 2 || records[0].Updated != last.Date || records[0].Author != testAuthor {
+		t.Errorf("labels --json --verbose: got %+v, want version 2 of %s by %s", records, last.Date, testAuthor)
+	}
+}
+
+func TestLabelsWithoutVersions(t *testing.T) {
+	/* A label never updated has no latest version, not the row of its track */
+	dir := newTestRepo(t)
+	track(t, dir, "empty", "empty")
+
+	var records []LabelRecord
+	if err := json.Unmarshal([]byte(msm(t, dir, "labels", "--json", "--verbose")), &records); err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Version != nil || records[0].Updated != "" || records[0].Author != "" {
+		t.Errorf("labels --json --verbose: got %+v, want no latest version", records)
+	}
+	want := "empty empty - - -"
+	for _, line := range strings.Split(msm(t, dir, "labels", "--verbose"), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 && fields[0] == "empty" && strings.Join(fields, " ") != want {
+			t.Errorf("empty row: got %q, want %q", fields, want)
+		}
+	}
+}
+
+func TestVersionNumbersPerLabel(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	track(t, dir, "thesis", "thesis")
+	update(t, dir, "paper", "a.txt", "paper 1\n")
+	update(t, dir, "thesis", "b.txt", "thesis 1\n")
+	update(t, dir, "paper", "a.txt", "paper 2\n")
+	update(t, dir, "thesis", "b.txt", "thesis 2\n")
+
+	for _, label := range []string{"paper", "thesis"} {
+		versions := versionsOf(t, dir, label)
+		if len(versions) != 2 || versions[0].Version != 1 || versions[1].Version != 2 {
+			t.Errorf("%s: got versions %+v, want 1 and 2", label, versions)
+		}
+	}
+}
+
+func TestNamesWithSpacesAndUnicode(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "tesis doctoral", "Capítulo Uno")
+	update(t, dir, "tesis doctoral", "Chapter One ü.docx", "contenido\tcon tab\n")
+
+	versions := versionsOf(t, dir, "tesis doctoral")
+	if len(versions) != 1 || versions[0].OrigFile != "Chapter One ü.docx" || versions[0].File != "Capítulo Uno_1_FD.docx" {
+		t.Fatalf("got %+v", versions)
+	}
+	writeFile(t, filepath.Join(dir, "segundo borrador.docx"), "otro\n")
+	msm(t, dir, "--author", testAuthor, "--yes", "update", "-m", "a note\twith a tab\nand a newline", "tesis doctoral", "segundo borrador.docx")
+	if versions := versionsOf(t, dir, "tesis doctoral"); len(versions) != 2 || versions[1].Note != "a note\twith a tab\nand a newline" {
+		t.Fatalf("note not kept as it was: %+v", versions)
+	}
+
+	msm(t, dir, "restore", "-o", "vuelta ü.docx", "tesis doctoral", "1")
+	if got := readFile(t, filepath.Join(dir, "vuelta ü.docx")); got != "contenido\tcon tab\n" {
+		t.Errorf("restored %q", got)
+	}
+}
+
+func TestDeleteLabel(t *testing.T) {
+	dir := newTestRepo(t)
+	repo := openTestRepo(t, dir)
+	track(t, dir, "paper", "paper")
+	track(t, dir, "copy", "copy")
+	for i, content := range []string{"one\n", "two\n", "three\n"} {
+		update(t, dir, "paper", "draft.txt", content)
+		if i == 1 {
+			/* The same content as version 2 of paper */
+			update(t, dir, "copy", "copy.txt", content)
+		}
+	}
+	versions := versionsOf(t, dir, "paper")
+	if len(versions) != 3 {
+		t.Fatalf("%d versions of paper", len(versions))
+	}
+
+	if r := run(t, dir, "n\n", "delete", "paper"); !strings.Contains(r.stdout, "3 versions and 2 archives") || !strings.Contains(r.stdout, "Abort") {
+		t.Errorf("delete without confirming:\n%s", r.stdout)
+	}
+	if len(versionsOf(t, dir, "paper")) != 3 {
+		t.Fatal("declined delete removed versions")
+	}
+
+	msm(t, dir, "delete", "--force", "paper")
+	if _, ok := repo.readLabelsMap()["paper"]; ok {
+		t.Error("paper still in the labels-table")
+	}
+	if n := len(versionsOf(t, dir, "paper")); n != 0 {
+		t.Errorf("%d rows of paper left", n)
+	}
+	for i, v := range versions {
+		shared := i == 1
+		if exists(repo.archivePath(v.ID)) != shared {
+			t.Errorf("archive of version %d there: %v, shared with copy: %v", v.Version, !shared, shared)
+		}
+	}
+	msm(t, dir, "restore", "-o", "copy-back.txt", "copy", "1")
+	if got := readFile(t, filepath.Join(dir, "copy-back.txt")); got != "two\n" {
+		t.Errorf("copy restored %q after paper was deleted", got)
+	}
+	msmFails(t, dir, ExitNotFound, "delete", "--force", "paper")
+}
+
+func TestRenameLabel(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "draft", "paper")
+	update(t, dir, "draft", "a.txt", "one\n")
+	update(t, dir, "draft", "a.txt", "two\n")
+	before := versionsOf(t, dir, "draft")
+
+	msm(t, dir, "rename", "draft", "nature-submission")
+	after := versionsOf(t, dir, "nature-submission")
+	if len(after) != len(before) {
+		t.Fatalf("%d versions under the new name, want %d", len(after), len(before))
+	}
+	for i := range after {
+		if after[i].ID != before[i].ID || after[i].File != before[i].File {
+			t.Errorf("version %d changed: %+v, was %+v", i+1, after[i], before[i])
+		}
+	}
+	if got := history(t, dir, "--label", "nature-submission"); len(got) != 3 {
+		t.Errorf("hist --label gives %d rows, want the track and 2 versions", len(got))
+	}
+	if file := update(t, dir, "nature-submission", "b.txt", "three\n"); file != "paper_3_FD.txt" {
+		t.Errorf("update after rename made %s", file)
+	}
+
+	track(t, dir, "other", "other")
+	msmFails(t, dir, ExitError, "rename", "other", "nature-submission")
+	msmFails(t, dir, ExitNotFound, "rename", "draft", "again")
+}
+
+func TestDiffVersions(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	update(t, dir, "paper", "a.txt", "intro\nold method\nend\n")
+	update(t, dir, "paper", "a.txt", "intro\nnew method\nend\n")
+	update(t, dir, "paper", "a.txt", "intro\nnew method\nend\nappendix\n")
+
+	out := msm(t, dir, "diff", "paper", "1", "2")
+	for _, want := range []string{"--- paper_1_FD.txt", "+++ paper_2_FD.txt", "-old method", "+new method", " intro"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("diff 1 2 has no %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "appendix") {
+		t.Errorf("diff 1 2 shows version 3:\n%s", out)
+	}
+
+	/* v2 defaults to the latest */
+	for _, args := range [][]string{{"diff", "paper", "2"}, {"diff", "paper", "2", "latest"}} {
+		if out := msm(t, dir, args...); !strings.Contains(out, "+++ paper_3_FD.txt") || !strings.Contains(out, "+appendix") || strings.Contains(out, "-new method") {
+			t.Errorf("%s:\n%s", strings.Join(args, " "), out)
+		}
+	}
+	msmFails(t, dir, ExitNotFound, "diff", "paper", "1", "9")
+}
+
+func TestRestoreByIDAndVersion(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	update(t, dir, "paper", "a.txt", "one\n")
+	update(t, dir, "paper", "a.txt", "two\n")
+	versions := versionsOf(t, dir, "paper")
+
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{versions[0].ID}, "one\n"},
+		{[]string{"paper", "1"}, "one\n"},
+		{[]string{"paper", "2"}, "two\n"},
+		{[]string{"paper", "latest"}, "two\n"},
+	} {
+		out := filepath.Join(dir, "out.txt")
+		msm(t, dir, append([]string{"restore", "--force", "-o", out}, tt.args...)...)
+		if got := readFile(t, out); got != tt.want {
+			t.Errorf("restore %s: got %q, want %q", strings.Join(tt.args, " "), got, tt.want)
+		}
+	}
+	msmFails(t, dir, ExitNotFound, "restore", "paper", "3")
+	msmFails(t, dir, ExitNotFound, "restore", "nope", "1")
+	msmFails(t, dir, ExitNotFound, "restore", strings.Repeat("0", 40))
+}
+
+func TestRestoreDoesNotOverwrite(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	update(t, dir, "paper", "a.txt", "one\n")
+	restored := filepath.Join(dir, "restored_a.txt")
+
+	if out := msm(t, dir, "restore", "paper", "1"); !strings.Contains(out, "restored_a.txt") {
+		t.Errorf("restore does not tell the path written:\n%s", out)
+	}
+	writeFile(t, restored, "edited\n")
+	r := msmFails(t, dir, ExitError, "restore", "paper", "1")
+	if !strings.Contains(r.stderr, "already exists") {
+		t.Errorf("second restore: %s", r.stderr)
+	}
+	if got := readFile(t, restored); got != "edited\n" {
+		t.Errorf("second restore overwrote the file: %q", got)
+	}
+	msm(t, dir, "restore", "--force", "paper", "1")
+	if got := readFile(t, restored); got != "one\n" {
+		t.Errorf("restore --force wrote %q", got)
+	}
+}
+
+func TestVerifyArchives(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	update(t, dir, "paper", "a.txt", "one\n")
+	update(t, dir, "paper", "a.txt", "two\n")
+	if out := msm(t, dir, "verify"); strings.Contains(out, "problems found") {
+		t.Errorf("verify on a sound repository:\n%s", out)
+	}
+
+	repo := openTestRepo(t, dir)
+	versions := versionsOf(t, dir, "paper")
+	writeFile(t, repo.archivePath(versions[0].ID), "not an archive")
+	if err := os.Remove(repo.archivePath(versions[1].ID)); err != nil {
+		t.Fatal(err)
+	}
+
+	r := msmFails(t, dir, ExitIntegrity, "verify")
+	for _, want := range []string{"paper 1 " + versions[0].ID, "paper 2 " + versions[1].ID, "2 problems found."} {
+		if !strings.Contains(r.stdout, want) {
+			t.Errorf("verify has no %q:\n%s", want, r.stdout)
+		}
+	}
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	track(t, dir, "empty", "nothing yet")
+	update(t, dir, "paper", "a.txt", "one\n")
+	writeFile(t, filepath.Join(dir, "b.txt"), "two\n")
+	msm(t, dir, "--author", testAuthor, "--yes", "update", "-m", `a "quoted" note`, "paper", "b.txt")
+	repo := openTestRepo(t, dir)
+
+	var want []VersionRecord
+	for _, v := range repo.readVersionsTable() {
+		want = append(want, v.record())
+	}
+	if got := history(t, dir); !reflect.DeepEqual(got, want) {
+		t.Errorf("hist --json:\n%+v\nwant\n%+v", got, want)
+	}
+
+	var labels []LabelRecord
+	out := msm(t, dir, "labels", "--json")
+	if err := json.Unmarshal([]byte(out), &labels); err != nil {
+		t.Fatalf("labels --json: %v\n%s", err, out)
+	}
+	if want := repo.readLabels(); !reflect.DeepEqual(labels, want) {
+		t.Errorf("labels --json:\n%+v\nwant\n%+v", labels, want)
+	}
+
+	/* An empty repository gives empty lists, not null */
+	empty := newTestRepo(t)
+	for _, cmd := range []string{"hist", "labels"} {
+		if out := strings.TrimSpace(msm(t, empty, cmd, "--json")); out != "[]" {
+			t.Errorf("%s --json on an empty repository: %s", cmd, out)
+		}
+	}
+}
+
+func TestExportCSV(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	update(t, dir, "paper", "a.txt", "one\n")
+	writeFile(t, filepath.Join(dir, "b.txt"), "two\n")
+	msm(t, dir, "--author", testAuthor, "--yes", "update", "-m", "a note, with \"quotes\"", "paper", "b.txt")
+	repo := openTestRepo(t, dir)
+
+	header := strings.Fields(VersionsHeader + " " + ProvenanceHeader)
+	want := [][]string{header}
+	for _, v := range repo.readVersionsTable() {
+		want = append(want, v.fields())
+	}
+
+	msm(t, dir, "export", "versions.csv")
+	for name, out := range map[string]string{
+		"versions.csv": readFile(t, filepath.Join(dir, "versions.csv")),
+		"-":            msm(t, dir, "export", "-"),
+	} {
+		got, err := csv.NewReader(strings.NewReader(out)).ReadAll()
+		if err != nil {
+			t.Fatalf("export %s: %v\n%s", name, err, out)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("export %s:\n%q\nwant\n%q", name, got, want)
+		}
+		if len(got) != 4 || got[3][slices.Index(header, "NOTE")] != "a note, with \"quotes\"" {
+			t.Errorf("export %s: the note did not survive:\n%q", name, got)
+		}
+	}
+	msmFails(t, dir, ExitUsage, "export")
+}
+
+func TestUpdateNote(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	writeFile(t, filepath.Join(dir, "a.txt"), "one\n")
+	msm(t, dir, "--author", testAuthor, "--yes", "update", "-m", "addressed reviewer 2", "paper", "a.txt")
+
+	/* Piped in after the author, when there is no -m */
+	writeFile(t, filepath.Join(dir, "a.txt"), "two\n")
+	if r := run(t, dir, testAuthor+"\nsecond round\nof comments\n", "update", "paper", "a.txt"); r.code != ExitOK {
+		t.Fatalf("piped update: exit %d\n%s%s", r.code, r.stdout, r.stderr)
+	}
+	update(t, dir, "paper", "a.txt", "three\n")
+
+	notes := func() []string {
+		var notes []string
+		for _, v := range versionsOf(t, dir, "paper") {
+			notes = append(notes, v.Note)
+		}
+		return notes
+	}
+	want := []string{"addressed reviewer 2", "second round\nof comments", "note of a.txt"}
+	if got := notes(); !slices.Equal(got, want) {
+		t.Fatalf("notes %q, want %q", got, want)
+	}
+
+	msm(t, dir, "--yes", "undo")
+	if got := notes(); !slices.Equal(got, want[:2]) {
+		t.Errorf("notes after undo %q, want %q", got, want[:2])
+	}
+	msm(t, dir, "restore", "-o", filepath.Join(dir, "out.txt"), "paper", "1")
+	if got := notes(); !slices.Equal(got, want[:2]) {
+		t.Errorf("notes after restore %q, want %q", got, want[:2])
+	}
+	if out := msm(t, dir, "hist", "paper"); !strings.Contains(out, "addressed reviewer 2") {
+		t.Errorf("hist does not show the note:\n%s", out)
+	}
+}
+
+func TestLogLabel(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	track(t, dir, "other", "other")
+	for _, content := range []string{"one\n", "two\n", "three\n"} {
+		update(t, dir, "paper", "a.txt", content)
+		update(t, dir, "other", "b.txt", content)
+	}
+
+	versionsIn := func(out string) []string {
+		/* The VERSION column of each row, checking the LABEL column */
+		lines := strings.Split(strings.TrimSpace(out), "\n")
+		if !strings.HasPrefix(lines[0], "DATE") {
+			t.Fatalf("log has no header:\n%s", out)
+		}
+		var versions []string
+		for _, line := range lines[1:] {
+			field := strings.Fields(line)
+			if field[2] != "paper" {
+				t.Errorf("log paper shows a row of %s: %s", field[2], line)
+			}
+			versions = append(versions, field[3])
+		}
+		return versions
+	}
+	if got := versionsIn(msm(t, dir, "log", "paper")); !slices.Equal(got, []string{"0", "1", "2", "3"}) {
+		t.Errorf("log paper: versions %v", got)
+	}
+	for n, want := range map[string][]string{"2": {"2", "3"}, "1": {"3"}, "10": {"0", "1", "2", "3"}} {
+		if got := versionsIn(msm(t, dir, "log", "-n", n, "paper")); !slices.Equal(got, want) {
+			t.Errorf("log -n %s paper: versions %v, want %v", n, got, want)
+		}
+	}
+	msmFails(t, dir, ExitNotFound, "log", "nope")
+	msmFails(t, dir, ExitUsage, "log")
+}
+
+func TestStatus(t *testing.T) {
+	dir := newTestRepo(t)
+	for _, label := range []string{"clean", "modified", "missing", "empty"} {
+		track(t, dir, label, label)
+	}
+	update(t, dir, "clean", "a.txt", "a\n")
+	modified := update(t, dir, "modified", "b.txt", "b\n")
+	missing := update(t, dir, "missing", "c.txt", "c\n")
+	writeFile(t, filepath.Join(dir, modified), "b, edited\n")
+	if err := os.Remove(filepath.Join(dir, missing)); err != nil {
+		t.Fatal(err)
+	}
+
+	var records []StatusRecord
+	out := msm(t, dir, "status", "--json")
+	if err := json.Unmarshal([]byte(out), &records); err != nil {
+		t.Fatalf("status --json: %v\n%s", err, out)
+	}
+	want := map[string]string{"clean": "clean", "modified": "modified", "missing": "missing", "empty": "no versions"}
+	if len(records) != len(want) {
+		t.Errorf("status has %d labels, want %d:\n%s", len(records), len(want), out)
+	}
+	for _, r := range records {
+		if r.Status != want[r.Label] {
+			t.Errorf("status of %s is %q, want %q", r.Label, r.Status, want[r.Label])
+		}
+	}
+
+	out = msm(t, dir, "status")
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n")[1:] {
+		field := strings.Fields(line)
+		if got := strings.Join(field[2:], " "); got != want[field[0]] {
+			t.Errorf("status of %s is %q, want %q", field[0], got, want[field[0]])
+		}
+	}
+}
+
+func TestMissingArguments(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	for _, args := range [][]string{
+		{"--yes", "update"},
+		{"--yes", "update", "paper"},
+		{"restore"},
+		{"restore", "paper", "1", "extra"},
+		{"track", "paper"},
+		{"rename", "paper"},
+	} {
+		r := run(t, dir, "", args...)
+		if r.code != ExitUsage {
+			t.Errorf("%s: exit %d, want %d\n%s%s", strings.Join(args, " "), r.code, ExitUsage, r.stdout, r.stderr)
+		}
+		if strings.Contains(r.stderr, "panic") || strings.Contains(r.stderr, "goroutine") {
+			t.Errorf("%s panics:\n%s", strings.Join(args, " "), r.stderr)
+		}
+	}
+	if len(versionsOf(t, dir, "paper")) != 0 {
+		t.Errorf("a command with missing arguments made a version")
+	}
+}
+
+func readTree(t *testing.T, root string) map[string]string {
+	/* The files under root by their path in it, with their content */
+	t.Helper()
+	tree := make(map[string]string)
+	err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		tree[rel] = readFile(t, path)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+func TestDirectoryVersions(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "supp", "supp")
+	figs := filepath.Join(dir, "figs")
+	writeFile(t, filepath.Join(figs, "a.txt"), "a\n")
+	writeFile(t, filepath.Join(figs, "sub", "b.csv"), "x,y\n1,2\n")
+	want := readTree(t, figs)
+
+	msm(t, dir, "--author", testAuthor, "--yes", "update", "supp", "figs")
+	file := latestFile(t, dir, "supp")
+	if got := readTree(t, filepath.Join(dir, file)); !reflect.DeepEqual(got, want) {
+		t.Errorf("version directory %s: %v, want %v", file, got, want)
+	}
+
+	out := filepath.Join(dir, "out")
+	msm(t, dir, "restore", "-o", out, "supp", "1")
+	if got := readTree(t, out); !reflect.DeepEqual(got, want) {
+		t.Errorf("restored tree: %v, want %v", got, want)
+	}
+
+	/* The same tree elsewhere has the same id, so it is no new version */
+	copied := filepath.Join(dir, "copy")
+	for rel, content := range want {
+		writeFile(t, filepath.Join(copied, rel), content)
+	}
+	r := run(t, dir, "", "--author", testAuthor, "--yes", "update", "supp", "copy")
+	if r.code == ExitOK || len(versionsOf(t, dir, "supp")) != 1 {
+		t.Errorf("an identical tree made a new version:\n%s%s", r.stdout, r.stderr)
+	}
+
+	/* A changed tree is a new version, and the old one still restores */
+	writeFile(t, filepath.Join(copied, "sub", "b.csv"), "x,y\n1,3\n")
+	msm(t, dir, "--author", testAuthor, "--yes", "update", "supp", "copy")
+	if v := versionsOf(t, dir, "supp"); len(v) != 2 || v[0].ID == v[1].ID {
+		t.Fatalf("versions after a change: %+v", v)
+	}
+	out = filepath.Join(dir, "out1")
+	msm(t, dir, "restore", "-o", out, "supp", "1")
+	if got := readTree(t, out); !reflect.DeepEqual(got, want) {
+		t.Errorf("version 1 after version 2: %v, want %v", got, want)
+	}
+	msm(t, dir, "verify")
+}
+
+func TestUpdateDryRun(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	first := update(t, dir, "paper", "a.txt", "one\n")
+	writeFile(t, filepath.Join(dir, "a.txt"), "two\n")
+	before := readTree(t, dir)
+
+	out := msm(t, dir, "--author", testAuthor, "--yes", "update", "--dry-run", "paper", "a.txt")
+	for _, want := range []string{"paper_2_FD.txt", "Remove : " + first} {
+		if !strings.Contains(out, want) {
+			t.Errorf("dry run has no %q:\n%s", want, out)
+		}
+	}
+	if after := readTree(t, dir); !reflect.DeepEqual(after, before) {
+		t.Errorf("dry run changed the files:\n%v\nwant\n%v", after, before)
+	}
+
+	/* It still tells about content that is already archived */
+	writeFile(t, filepath.Join(dir, "a.txt"), "one\n")
+	before = readTree(t, dir)
+	r := run(t, dir, "", "--author", testAuthor, "--yes", "update", "--dry-run", "paper", "a.txt")
+	if r.code == ExitOK {
+		t.Errorf("dry run of archived content succeeds:\n%s", r.stdout)
+	}
+	if after := readTree(t, dir); !reflect.DeepEqual(after, before) {
+		t.Errorf("dry run of archived content changed the files")
+	}
+}
+
+func TestUndoAsksFirst(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	update(t, dir, "paper", "a.txt", "one\n")
+	second := update(t, dir, "paper", "a.txt", "two\n")
+	repo := openTestRepo(t, dir)
+	before := readTree(t, dir)
+
+	withStdin(t, "n\n")
+	var done bool
+	out := captureStdout(t, func() { done = undoLast(repo, false, false, false) })
+	if done {
+		t.Errorf("undo answered no was done")
+	}
+	for _, want := range []string{
+		`Undo version 2 of label "paper" by ` + testAuthor,
+		"remove archive " + repo.archivePath(versionsOf(t, dir, "paper")[1].ID),
+		"rename " + second + " ---> a.txt",
+		"restore previous version paper_1_FD.txt",
+		"Undo? (y/n): Abort.",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("undo has no %q:\n%s", want, out)
+		}
+	}
+	if after := readTree(t, dir); !reflect.DeepEqual(after, before) {
+		t.Errorf("undo answered no changed the files")
+	}
+
+	withStdin(t, "y\n")
+	captureStdout(t, func() { done = undoLast(repo, false, false, false) })
+	if !done || len(versionsOf(t, dir, "paper")) != 1 {
+		t.Errorf("undo answered yes: done %v, %d versions", done, len(versionsOf(t, dir, "paper")))
+	}
+	if got := readFile(t, filepath.Join(dir, "a.txt")); got != "two\n" {
+		t.Errorf("a.txt after undo: %q", got)
+	}
+
+	/* --force asks nothing */
+	withStdin(t, "")
+	captureStdout(t, func() { done = undoLast(repo, true, false, false) })
+	if !done || len(versionsOf(t, dir, "paper")) != 0 {
+		t.Errorf("undo with force: done %v, %d versions", done, len(versionsOf(t, dir, "paper")))
+	}
+}
+
+func TestUndoEmptyTable(t *testing.T) {
+	dir := newTestRepo(t)
+	repo := openTestRepo(t, dir)
+
+	withStdin(t, "")
+	var done bool
+	out := captureStdout(t, func() { done = undoLast(repo, false, false, false) })
+	if done || !strings.Contains(out, "Nothing to undo.") {
+		t.Errorf("undo on an empty table: done %v\n%s", done, out)
+	}
+
+	/* Also with the tables gone back to no rows at all */
+	writeFile(t, repo.versionsTable, "")
+	r := run(t, dir, "", "undo")
+	if r.code != ExitOK || !strings.Contains(r.stdout, "Nothing to undo.") {
+		t.Errorf("undo with no rows: exit %d\n%s%s", r.code, r.stdout, r.stderr)
+	}
+}
+
+func TestEmptyRepository(t *testing.T) {
+	dir := newTestRepo(t)
+	for _, args := range [][]string{{"undo"}, {"hist"}, {"labels"}, {"status"}, {"verify"}, {"archives"}, {"info"}, {"gc"}} {
+		r := run(t, dir, "", args...)
+		if r.code != ExitOK || r.stderr != "" {
+			t.Errorf("%s after init: exit %d\n%s%s", args[0], r.code, r.stdout, r.stderr)
+		}
+	}
+	if out := msm(t, dir, "undo"); !strings.Contains(out, "Nothing to undo.") {
+		t.Errorf("undo after init:\n%s", out)
+	}
+
+	/* A label with no versions yet */
+	track(t, dir, "paper", "paper")
+	for _, args := range [][]string{{"latest", "paper"}, {"restore", "paper", "latest"}, {"diff", "paper"}} {
+		r := msmFails(t, dir, ExitNotFound, args...)
+		if !strings.Contains(r.stderr, "has no versions yet") {
+			t.Errorf("%s: %s", strings.Join(args, " "), r.stderr)
+		}
+	}
+
+	repo := openTestRepo(t, dir)
+	if n := repo.getLastVersionNumber("paper"); n != 0 {
+		t.Errorf("getLastVersionNumber of a label with no versions: %d", n)
+	}
+	if file, err := repo.isLastVersionChanged("paper"); file != "none" || err != nil {
+		t.Errorf("isLastVersionChanged of a label with no versions: %q, %v", file, err)
+	}
+	if out := captureStdout(t, func() { repo.restoreLastVersion("paper") }); !strings.Contains(out, "No previous version") {
+		t.Errorf("restoreLastVersion of a label with no versions:\n%s", out)
+	}
+}
+
+func TestUnattendedUpdate(t *testing.T) {
+	/*
+	 * Run with a stdin that is not a terminal and never ends, like
+	 * in a CI job: reading it would hang until the timeout.
+	 */
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	unattended := func(args ...string) result {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		defer w.Close()
+		cmd := exec.CommandContext(ctx, os.Args[0], args...)
+		cmd.Dir = dir
+		cmd.Env = testEnv()
+		cmd.Stdin = r
+		var stdout, stderr bytes.Buffer
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		err = cmd.Run()
+		if ctx.Err() != nil {
+			t.Fatalf("msmanager %s waits for input", strings.Join(args, " "))
+		}
+		code := ExitOK
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			code = exitErr.ExitCode()
+		}
+		return result{stdout.String(), stderr.String(), code}
+	}
+
+	writeFile(t, filepath.Join(dir, "a.txt"), "one\n")
+	r := unattended("--yes", "update", "paper", "a.txt")
+	if r.code != ExitError || !strings.Contains(r.stderr, "no author email") {
+		t.Errorf("--yes with no author: exit %d\n%s", r.code, r.stderr)
+	}
+
+	if r := unattended("--yes", "--author", testAuthor, "update", "paper", "a.txt"); r.code != ExitOK {
+		t.Fatalf("--yes --author: exit %d\n%s", r.code, r.stderr)
+	}
+	msm(t, dir, "config", "author", "config@example.com")
+	writeFile(t, filepath.Join(dir, "a.txt"), "two\n")
+	if r := unattended("--yes", "update", "paper", "a.txt"); r.code != ExitOK {
+		t.Fatalf("--yes with the config author: exit %d\n%s", r.code, r.stderr)
+	}
+	var authors []string
+	for _, v := range versionsOf(t, dir, "paper") {
+		authors = append(authors, v.Author)
+	}
+	if want := []string{testAuthor, "config@example.com"}; !slices.Equal(authors, want) {
+		t.Errorf("authors %q, want %q", authors, want)
+	}
+
+	/* Undo asks too, and --yes answers it */
+	if r := unattended("--yes", "undo"); r.code != ExitOK || len(versionsOf(t, dir, "paper")) != 1 {
+		t.Errorf("--yes undo: exit %d\n%s%s", r.code, r.stdout, r.stderr)
+	}
+}
+
+func TestUpdateRefusesVersionFile(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	first := update(t, dir, "paper", "a.txt", "one\n")
+	update(t, dir, "paper", "a.txt", "two\n")
+	msm(t, dir, "restore", "-o", first, "paper", "1")
+	writeFile(t, filepath.Join(dir, first), "one, slightly changed\n")
+
+	r := run(t, dir, "", "--author", testAuthor, "--yes", "update", "paper", first)
+	if r.code == ExitOK || !strings.Contains(r.stdout+r.stderr, first) {
+		t.Errorf("update with %s: exit %d\n%s%s", first, r.code, r.stdout, r.stderr)
+	}
+	if n := len(versionsOf(t, dir, "paper")); n != 2 {
+		t.Errorf("%d versions after the refused update, want 2", n)
+	}
+	if got := readFile(t, filepath.Join(dir, first)); got != "one, slightly changed\n" {
+		t.Errorf("%s was touched: %q", first, got)
+	}
+}
+
+func TestVersionSize(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	for _, content := range []string{"short\n", strings.Repeat("a longer manuscript\n", 100)} {
+		update(t, dir, "paper", "a.txt", content)
+		versions := versionsOf(t, dir, "paper")
+		if v := versions[len(versions)-1]; v.Size == nil || *v.Size != int64(len(content)) {
+			t.Errorf("version %d: size %v, want %d", v.Version, v.Size, len(content))
+		}
+	}
+	if out := msm(t, dir, "hist", "paper"); !strings.Contains(out, " 2000 ") {
+		t.Errorf("hist does not show the size:\n%s", out)
+	}
+
+	/* Rows from before sizes were recorded show - */
+	repo := openTestRepo(t, dir)
+	err := editTable(repo.versionsTable, func(field []string) []string {
+		field[9] = "-"
+		return field
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range versionsOf(t, dir, "paper") {
+		if v.Size != nil {
+			t.Errorf("version %d without a size: %d", v.Version, *v.Size)
+		}
+	}
+}
+
+func TestGC(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	update(t, dir, "paper", "a.txt", "one\n")
+	update(t, dir, "paper", "a.txt", "two\n")
+	repo := openTestRepo(t, dir)
+	orphan := repo.archivePath(strings.Repeat("ab", 20))
+	if err := compress(strings.NewReader("left over\n"), orphan, "gzip", -1, nil); err != nil {
+		t.Fatal(err)
+	}
+	size := int64(len(readFile(t, orphan)))
+
+	if out := msm(t, dir, "gc", "--dry-run"); !strings.Contains(out, "1 orphaned archives") || !exists(orphan) {
+		t.Errorf("gc --dry-run:\n%s", out)
+	}
+	if r := run(t, dir, "n\n", "gc"); !exists(orphan) || !strings.Contains(r.stdout, "Abort.") {
+		t.Errorf("gc answered no:\n%s", r.stdout)
+	}
+	out := msm(t, dir, "--yes", "gc")
+	if exists(orphan) || !strings.Contains(out, fmt.Sprintf("Reclaimed %d bytes.", size)) {
+		t.Errorf("gc:\n%s", out)
+	}
+	for _, v := range versionsOf(t, dir, "paper") {
+		if !exists(repo.archivePath(v.ID)) {
+			t.Errorf("gc removed the archive of version %d", v.Version)
+		}
+	}
+	if out := msm(t, dir, "gc"); !strings.Contains(out, "No orphaned archives.") {
+		t.Errorf("second gc:\n%s", out)
+	}
+}
+
+func TestRestoreOutput(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	update(t, dir, "paper", "a.txt", "one\n")
+
+	if out := msm(t, dir, "restore", "-o", "-", "paper", "1"); out != "one\n" {
+		t.Errorf("restore to stdout: %q", out)
+	}
+	msm(t, dir, "restore", "-o", "named.txt", "paper", "1")
+	if got := readFile(t, filepath.Join(dir, "named.txt")); got != "one\n" {
+		t.Errorf("restore to named.txt: %q", got)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "out"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	msm(t, dir, "restore", "-o", "out", "paper", "1")
+	if got := readFile(t, filepath.Join(dir, "out", "a.txt")); got != "one\n" {
+		t.Errorf("restore into a directory: %q", got)
+	}
+}
+
+func TestShow(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	update(t, dir, "paper", "a.txt", "Título\nsecond line\n")
+	writeFile(t, filepath.Join(dir, "b.dat"), "\x00\xff\xfe")
+	msm(t, dir, "--author", testAuthor, "--yes", "update", "paper", "b.dat")
+	id := versionsOf(t, dir, "paper")[0].ID
+
+	for _, args := range [][]string{{"show", "paper", "1"}, {"show", id}} {
+		if out := msm(t, dir, args...); out != "Título\nsecond line\n" {
+			t.Errorf("%s: %q", strings.Join(args, " "), out)
+		}
+	}
+	if r := msmFails(t, dir, ExitError, "show", "paper", "2"); r.stdout != "" || !strings.Contains(r.stderr, "not a text file") {
+		t.Errorf("show of binary content:\n%q\n%s", r.stdout, r.stderr)
+	}
+	if out := msm(t, dir, "show", "--force", "paper", "2"); out != "\x00\xff\xfe" {
+		t.Errorf("show --force: %q", out)
+	}
+	if exists(filepath.Join(dir, "restored_a.txt")) {
+		t.Errorf("show left a file behind")
+	}
+}
+
+func TestTrackWithFile(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "empty", "empty")
+	if v := history(t, dir, "empty"); len(v) != 1 || v[0].Version != 0 {
+		t.Errorf("track without a file: %+v", v)
+	}
+
+	writeFile(t, filepath.Join(dir, "a.txt"), "one\n")
+	msm(t, dir, "--author", testAuthor, "--yes", "track", "paper", "paper", "a.txt")
+	v := history(t, dir, "paper")
+	if len(v) != 2 || v[0].Version != 0 || v[1].Version != 1 || v[1].OrigFile != "a.txt" {
+		t.Fatalf("track with a file: %+v", v)
+	}
+	if got := readFile(t, filepath.Join(dir, latestFile(t, dir, "paper"))); got != "one\n" {
+		t.Errorf("version 1 of the track: %q", got)
+	}
+
+	/* A file that cannot be archived leaves no label behind */
+	msmFails(t, dir, ExitNotFound, "--author", testAuthor, "--yes", "track", "other", "other", "missing.txt")
+	if labels := openTestRepo(t, dir).readLabelsMap(); len(labels) != 2 {
+		t.Errorf("labels after a failed track: %v", labels)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	track(t, dir, "thesis", "thesis")
+	writeFile(t, filepath.Join(dir, "a.txt"), "one\n")
+	writeFile(t, filepath.Join(dir, "b.txt"), "two\n")
+	writeFile(t, filepath.Join(dir, "manifest"), "# label\tfile\tauthor\tnote\n"+
+		"paper\ta.txt\t"+testAuthor+"\tfirst draft\n"+
+		"paper\tmissing.txt\t"+testAuthor+"\n"+
+		"thesis\tb.txt\tother@example.com\n")
+
+	r := run(t, dir, "", "--yes", "batch", "manifest")
+	if r.code != ExitError {
+		t.Errorf("batch with a bad line: exit %d", r.code)
+	}
+	for _, want := range []string{"1: OK: paper a.txt", "2: FAIL:", "3: OK: thesis b.txt", "2 succeeded, 1 failed."} {
+		if !strings.Contains(r.stdout, want) {
+			t.Errorf("batch has no %q:\n%s", want, r.stdout)
+		}
+	}
+	paper, thesis := versionsOf(t, dir, "paper"), versionsOf(t, dir, "thesis")
+	if len(paper) != 1 || paper[0].Note != "first draft" || paper[0].Author != testAuthor {
+		t.Errorf("paper after batch: %+v", paper)
+	}
+	if len(thesis) != 1 || thesis[0].Author != "other@example.com" {
+		t.Errorf("thesis after batch: %+v", thesis)
+	}
+
+	/* --fail-fast stops at the bad line, from a .csv manifest */
+	writeFile(t, filepath.Join(dir, "c.txt"), "three\n")
+	writeFile(t, filepath.Join(dir, "d.txt"), "four\n")
+	writeFile(t, filepath.Join(dir, "manifest.csv"), "paper,c.txt,"+testAuthor+",\"with, comma\"\n"+
+		"paper,missing.txt,"+testAuthor+"\n"+
+		"thesis,d.txt,"+testAuthor+"\n")
+	r = run(t, dir, "", "--yes", "batch", "--fail-fast", "manifest.csv")
+	if r.code != ExitError || !strings.Contains(r.stdout, "1 succeeded, 1 failed.") || strings.Contains(r.stdout, "3: ") {
+		t.Errorf("batch --fail-fast: exit %d\n%s", r.code, r.stdout)
+	}
+	if v := versionsOf(t, dir, "paper"); len(v) != 2 || v[1].Note != "with, comma" {
+		t.Errorf("paper after batch --fail-fast: %+v", v)
+	}
+	if len(versionsOf(t, dir, "thesis")) != 1 {
+		t.Errorf("batch --fail-fast went past the bad line")
+	}
+	msm(t, dir, "verify")
+}
+
+func TestHistDateRange(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	track(t, dir, "other", "other")
+	days := []string{"2024-01-01", "2024-02-15", "2024-03-31", "2024-04-01"}
+	for _, content := range days {
+		update(t, dir, "paper", "a.txt", content+"\n")
+		update(t, dir, "other", "b.txt", content+"\n")
+	}
+
+	/* Date each version by its content */
+	repo := openTestRepo(t, dir)
+	err := editTable(repo.versionsTable, func(field []string) []string {
+		if v, _ := strconv.Atoi(field[3]); v > 0 {
+			field[0] = days[v-1]
+		} else {
+			field[0] = "2023-12-31"
+		}
+		return field
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dates := func(args ...string) []string {
+		t.Helper()
+		var dates []string
+		for _, r := range history(t, dir, args...) {
+			dates = append(dates, r.Label+" "+r.Date)
+		}
+		return dates
+	}
+	for _, tt := range []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"--since", "2024-01-01", "--until", "2024-03-31", "paper"}, []string{"paper 2024-01-01", "paper 2024-02-15", "paper 2024-03-31"}},
+		{[]string{"--since", "2024-02-15", "--until", "2024-02-15", "--label", "other"}, []string{"other 2024-02-15"}},
+		{[]string{"--since", "2024-04-01"}, []string{"paper 2024-04-01", "other 2024-04-01"}},
+		{[]string{"--until", "2023-12-31"}, []string{"paper 2023-12-31", "other 2023-12-31"}},
+		{[]string{"--since", "2025-01-01"}, nil},
+		{[]string{"--since", "2024-03-01", "--until", "2024-02-01"}, nil},
+	} {
+		if got := dates(tt.args...); !slices.Equal(got, tt.want) {
+			t.Errorf("hist %s: %q, want %q", strings.Join(tt.args, " "), got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"2024-13-01", "01/02/2024", "yesterday"} {
+		r := msmFails(t, dir, ExitUsage, "hist", "--since", bad)
+		if !strings.Contains(r.stderr, "expected YYYY-MM-DD") {
+			t.Errorf("--since %s: %s", bad, r.stderr)
+		}
+	}
+	msmFails(t, dir, ExitUsage, "hist", "--until", "2024-02-30")
+}
+
+func TestHistFormat(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	update(t, dir, "paper", "a.txt", "one\n")
+	v := versionsOf(t, dir, "paper")[0]
+
+	if out := msm(t, dir, "hist", "--format", "{{.Label}} v{{.Version}} is {{.File}} ({{.Note}})", "paper"); !strings.HasSuffix(out, "paper v1 is paper_1_FD.txt (note of a.txt)\n") {
+		t.Errorf("custom format:\n%s", out)
+	}
+	want := fmt.Sprintf("paper v1 by %s on %s\n", testAuthor, v.Date)
+	if out := msm(t, dir, "hist", "--format", "short", "paper"); !strings.HasSuffix(out, want) {
+		t.Errorf("--format short:\n%s\nwant a last line %q", out, want)
+	}
+	if out := msm(t, dir, "hist", "--format", "oneline", "paper"); !strings.Contains(out, v.Time+" paper 1 paper_1_FD.txt note of a.txt") {
+		t.Errorf("--format oneline:\n%s", out)
+	}
+
+	for _, bad := range []string{"{{.Nope}}", "{{.Label"} {
+		r := run(t, dir, "", "hist", "--format", bad)
+		if r.code == ExitOK || !strings.Contains(r.stderr, "invalid --format") {
+			t.Errorf("--format %s: exit %d\n%s", bad, r.code, r.stderr)
+		}
+	}
+}
+
+func TestDedupAcrossLabels(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	track(t, dir, "copy", "copy")
+	update(t, dir, "paper", "a.txt", "same content\n")
+	repo := openTestRepo(t, dir)
+	id := versionsOf(t, dir, "paper")[0].ID
+	before, err := os.Stat(repo.archivePath(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	/* Another label reuses the archive as it is */
+	update(t, dir, "copy", "b.txt", "same content\n")
+	if v := versionsOf(t, dir, "copy"); len(v) != 1 || v[0].ID != id {
+		t.Fatalf("copy after the update: %+v", v)
+	}
+	after, err := os.Stat(repo.archivePath(id))
+	if err != nil || !os.SameFile(before, after) || !after.ModTime().Equal(before.ModTime()) {
+		t.Errorf("the archive was written again")
+	}
+	if archives := archiveNames(t, repo.archivesDir); len(archives) != 1 {
+		t.Errorf("archives %v, want one", archives)
+	}
+
+	/* The same label with the same content is refused */
+	writeFile(t, filepath.Join(dir, "c.txt"), "same content\n")
+	r := run(t, dir, "", "--author", testAuthor, "--yes", "update", "paper", "c.txt")
+	if r.code == ExitOK || !strings.Contains(r.stderr, "the same file was used before") {
+		t.Errorf("same content for the same label: exit %d\n%s", r.code, r.stderr)
+	}
+	if len(versionsOf(t, dir, "paper")) != 1 || !exists(filepath.Join(dir, "c.txt")) {
+		t.Errorf("the refused update changed something")
+	}
+
+	/* The archive stays while a label uses it */
+	msm(t, dir, "--yes", "undo")
+	if !exists(repo.archivePath(id)) {
+		t.Errorf("undo of copy removed the archive of paper")
+	}
+}
+
+func TestInfo(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	track(t, dir, "thesis", "thesis")
+	update(t, dir, "paper", "a.txt", "one\n")
+	update(t, dir, "paper", "a.txt", "two\n")
+	update(t, dir, "thesis", "b.txt", "two\n")
+	repo := openTestRepo(t, dir)
+	var size int64
+	for _, v := range versionsOf(t, dir, "paper") {
+		size += int64(len(readFile(t, repo.archivePath(v.ID))))
+	}
+	today := versionsOf(t, dir, "paper")[0].Date
+
+	out := msm(t, dir, "info")
+	for _, want := range []string{
+		"Root    : " + dir,
+		"Labels  : 2",
+		"Versions: 3",
+		fmt.Sprintf("Archives: 2 (%d bytes)", size),
+		"Activity: " + today + " to " + today,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("info has no %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestTrackDuplicateBasename(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "manuscript")
+	r := msmFails(t, dir, ExitError, "track", "other", "manuscript")
+	if !strings.Contains(r.stderr, `basename "manuscript" is already used by label "paper"`) {
+		t.Errorf("track with a used basename: %s", r.stderr)
+	}
+	if _, ok := openTestRepo(t, dir).readLabelsMap()["other"]; ok {
+		t.Errorf("the refused label was tracked")
+	}
+	track(t, dir, "other", "manuscript", "--allow-duplicate-basename")
+	if got := openTestRepo(t, dir).readLabelsMap()["other"]; got != "manuscript" {
+		t.Errorf("--allow-duplicate-basename: basename %q", got)
+	}
+}
+
+func TestUndoSteps(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	for _, content := range []string{"one\n", "two\n", "three\n"} {
+		update(t, dir, "paper", "a.txt", content)
+	}
+
+	msm(t, dir, "--yes", "undo", "2")
+	v := versionsOf(t, dir, "paper")
+	if len(v) != 1 || latestFile(t, dir, "paper") != "paper_1_FD.txt" {
+		t.Fatalf("after undo 2: %+v", v)
+	}
+	if got := readFile(t, filepath.Join(dir, "paper_1_FD.txt")); got != "one\n" {
+		t.Errorf("version 1 file after undo 2: %q", got)
+	}
+	msm(t, dir, "verify")
+
+	/* It stops before the track, leaving the label */
+	out := msm(t, dir, "--yes", "undo", "5")
+	if !strings.Contains(out, `Stop at the track of label "paper"`) {
+		t.Errorf("undo 5:\n%s", out)
+	}
+	if h := history(t, dir, "paper"); len(h) != 1 || h[0].Version != 0 {
+		t.Errorf("after undo 5: %+v", h)
+	}
+	msmFails(t, dir, ExitUsage, "undo", "0")
+	msmFails(t, dir, ExitUsage, "undo", "two")
+}
+
+func TestParentChain(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	track(t, dir, "other", "other")
+	for _, content := range []string{"one\n", "two\n", "three\n"} {
+		update(t, dir, "paper", "a.txt", content)
+		update(t, dir, "other", "b.txt", "other "+content)
+	}
+
+	for _, label := range []string{"paper", "other"} {
+		parent := "none"
+		for _, v := range versionsOf(t, dir, label) {
+			if v.Parent != parent {
+				t.Errorf("%s %d: parent %s, want %s", label, v.Version, v.Parent, parent)
+			}
+			parent = v.ID
+		}
+	}
+	msm(t, dir, "verify")
+
+	/* A parent that is not the version before breaks the chain */
+	repo := openTestRepo(t, dir)
+	err := editTable(repo.versionsTable, func(field []string) []string {
+		if field[2] == "paper" && field[3] == "3" {
+			field[10] = "none"
+		}
+		return field
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := msmFails(t, dir, ExitIntegrity, "verify")
+	if !strings.Contains(r.stdout, "paper 3") || !strings.Contains(r.stdout, "parent is none, expected "+versionsOf(t, dir, "paper")[1].ID) {
+		t.Errorf("verify of a broken chain:\n%s", r.stdout)
+	}
+}
+
+func TestFind(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	track(t, dir, "copy", "copy")
+	first := update(t, dir, "paper", "a.txt", "one\n")
+	update(t, dir, "copy", "b.txt", "one\n")
+	update(t, dir, "paper", "a.txt", "two\n")
+
+	loose := filepath.Join(dir, "loose.txt")
+	writeFile(t, loose, "one\n")
+	out := msm(t, dir, "find", "loose.txt")
+	for _, want := range []string{"paper  1", first, "copy   1", "copy_1_FD.txt"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("find has no %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "paper_2") {
+		t.Errorf("find shows a version with other content:\n%s", out)
+	}
+
+	writeFile(t, loose, "one, modified\n")
+	r := msmFails(t, dir, ExitNotFound, "find", "loose.txt")
+	if !strings.Contains(r.stdout, "loose.txt: not tracked") {
+		t.Errorf("find of a modified copy:\n%s", r.stdout)
+	}
+	msmFails(t, dir, ExitNotFound, "find", "missing.txt")
+}
+
+func TestUpdateWithPreviousFileGone(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	first := update(t, dir, "paper", "a.txt", "one\n")
+	if err := os.Remove(filepath.Join(dir, first)); err != nil {
+		t.Fatal(err)
+	}
+
+	writeFile(t, filepath.Join(dir, "a.txt"), "two\n")
+	out := msm(t, dir, "--author", testAuthor, "--yes", "update", "paper", "a.txt")
+	if !strings.Contains(out, first+" is not there, nothing to remove.") {
+		t.Errorf("update does not tell the previous file is gone:\n%s", out)
+	}
+	if v := versionsOf(t, dir, "paper"); len(v) != 2 {
+		t.Errorf("%d versions, want 2", len(v))
+	}
+	if got := readFile(t, filepath.Join(dir, latestFile(t, dir, "paper"))); got != "two\n" {
+		t.Errorf("version 2 file: %q", got)
+	}
+}
+
+func TestFilenameTemplate(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper", "--template", "{initials}-{basename}-v{version}{ext}")
+	track(t, dir, "dated", "dated", "--template", "{date}_{basename}_{version}{ext}")
+	update(t, dir, "paper", "a.docx", "one\n")
+	update(t, dir, "dated", "b.txt", "one\n")
+
+	if got := latestFile(t, dir, "paper"); got != "FD-paper-v1.docx" {
+		t.Errorf("paper version file %q", got)
+	}
+	v := versionsOf(t, dir, "dated")[0]
+	if want := v.Date + "_dated_1.txt"; v.File != want {
+		t.Errorf("dated version file %q, want %q", v.File, want)
+	}
+	if !exists(filepath.Join(dir, "FD-paper-v1.docx")) {
+		t.Errorf("no FD-paper-v1.docx")
+	}
+
+	for _, bad := range []string{"{basename}_{journal}{ext}", "{basename}{ext}", "{basename}_{version}/{ext}", "{basename_{version}"} {
+		msmFails(t, dir, ExitError, "track", "--template", bad, "bad", "bad")
+	}
+	if _, ok := openTestRepo(t, dir).readLabelsMap()["bad"]; ok {
+		t.Errorf("a label was tracked with a bad template")
+	}
+
+	if got := versionName("", "paper", 3, "FD", "2024-01-02", "draft.tex"); got != "paper_3_FD.tex" {
+		t.Errorf("default template: %q", got)
+	}
+	if got := versionName("{basename}_{version}", "supp", 2, "FD", "2024-01-02", "figs/"); got != "supp_2/" {
+		t.Errorf("template for a directory: %q", got)
+	}
+}
+
+func TestUpdateFromPipe(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	writeFile(t, filepath.Join(dir, "a.txt"), "one\n")
+	if r := run(t, dir, "jane@example.com\naddressed reviewer 2\n", "update", "paper", "a.txt"); r.code != ExitOK {
+		t.Fatalf("update from a pipe: exit %d\n%s%s", r.code, r.stdout, r.stderr)
+	}
+	v := versionsOf(t, dir, "paper")
+	if len(v) != 1 || v[0].Author != "jane@example.com" || v[0].Note != "addressed reviewer 2" {
+		t.Errorf("update from a pipe: %+v", v)
+	}
+
+	/* -m is kept over the piped note, and a bad first line is refused */
+	writeFile(t, filepath.Join(dir, "a.txt"), "two\n")
+	if r := run(t, dir, "jane@example.com\npiped\n", "update", "-m", "flag", "paper", "a.txt"); r.code != ExitOK {
+		t.Fatalf("update -m from a pipe: exit %d\n%s", r.code, r.stderr)
+	}
+	if v := versionsOf(t, dir, "paper"); v[1].Note != "flag" {
+		t.Errorf("note with -m and a pipe: %q", v[1].Note)
+	}
+	writeFile(t, filepath.Join(dir, "a.txt"), "three\n")
+	r := run(t, dir, "a note without an author\n", "update", "paper", "a.txt")
+	if r.code == ExitOK || !strings.Contains(r.stderr, "invalid author email") {
+		t.Errorf("update with no author on the first line: exit %d\n%s", r.code, r.stderr)
+	}
+	if len(versionsOf(t, dir, "paper")) != 2 {
+		t.Errorf("the refused update made a version")
+	}
+}
+
+func TestHistAuthorFilter(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	track(t, dir, "other", "other")
+	for i, author := range []string{"jane@example.com", "john@example.com", "jane@example.com"} {
+		writeFile(t, filepath.Join(dir, "a.txt"), fmt.Sprintf("paper %d\n", i))
+		msm(t, dir, "--author", author, "--yes", "update", "paper", "a.txt")
+	}
+	writeFile(t, filepath.Join(dir, "b.txt"), "other\n")
+	msm(t, dir, "--author", "jane@lab.org", "--yes", "update", "other", "b.txt")
+
+	rows := func(args ...string) []string {
+		t.Helper()
+		var rows []string
+		for _, r := range history(t, dir, args...) {
+			rows = append(rows, fmt.Sprintf("%s %d", r.Label, r.Version))
+		}
+		return rows
+	}
+	for _, tt := range []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"--author", "jane@example.com"}, []string{"paper 1", "paper 3"}},
+		{[]string{"--author", "JANE@example.com"}, nil},
+		{[]string{"--author", "jane"}, nil},
+		{[]string{"--author-contains", "jane"}, []string{"paper 1", "paper 3", "other 1"}},
+		{[]string{"--author-contains", "jane", "--label", "other"}, []string{"other 1"}},
+		{[]string{"--author", "john@example.com", "--since", "2000-01-01", "paper"}, []string{"paper 2"}},
+		{[]string{"--author", "nobody@example.com"}, nil},
+	} {
+		if got := rows(tt.args...); !slices.Equal(got, tt.want) {
+			t.Errorf("hist %s: %q, want %q", strings.Join(tt.args, " "), got, tt.want)
+		}
+	}
+	if out := msm(t, dir, "hist", "--author", "nobody@example.com"); strings.Count(out, "\n") != 1 {
+		t.Errorf("hist with no matching rows:\n%s", out)
+	}
+}
+
+func TestUpdateOutsideRepository(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	outside := filepath.Join(t.TempDir(), "draft.txt")
+	writeFile(t, outside, "one\n")
+
+	/* Refused by default, leaving the file where it is */
+	r := msmFails(t, dir, ExitUsage, "--author", testAuthor, "--yes", "update", "paper", outside)
+	if !strings.Contains(r.stderr, "is outside the repository") || !exists(outside) {
+		t.Errorf("update from outside: %s", r.stderr)
+	}
+
+	/* With outside move, the version file is made in the repository root */
+	msm(t, dir, "config", "outside", "move")
+	msm(t, dir, "--author", testAuthor, "--yes", "update", "paper", outside)
+	if got := readFile(t, filepath.Join(dir, "paper_1_FD.txt")); got != "one\n" {
+		t.Errorf("version file in the root: %q", got)
+	}
+	if exists(outside) || exists(filepath.Join(filepath.Dir(outside), "paper_1_FD.txt")) {
+		t.Errorf("the version file was left outside the repository")
+	}
+	msmFails(t, dir, ExitError, "config", "outside", "somewhere")
+}
+
+func TestLatest(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	track(t, dir, "empty", "empty")
+	for _, content := range []string{"one\n", "two\n", "three\n"} {
+		update(t, dir, "paper", "a.txt", content)
+	}
+
+	if out := msm(t, dir, "latest", "paper"); out != "paper_3_FD.txt\n" {
+		t.Errorf("latest paper: %q", out)
+	}
+	if out := msm(t, dir, "latest", "--id", "paper"); out != versionsOf(t, dir, "paper")[2].ID+"\n" {
+		t.Errorf("latest --id paper: %q", out)
+	}
+	for _, args := range [][]string{{"latest", "empty"}, {"latest", "--id", "empty"}} {
+		if r := msmFails(t, dir, ExitNotFound, args...); r.stdout != "" {
+			t.Errorf("%s printed %q", strings.Join(args, " "), r.stdout)
+		}
+	}
+	msmFails(t, dir, ExitNotFound, "latest", "nope")
+}
+
+func TestUpdatePicksLabel(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	track(t, dir, "thesis", "thesis")
+	writeFile(t, filepath.Join(dir, "a.txt"), "one\n")
+	repo := openTestRepo(t, dir)
+
+	/* The picker is only offered on a terminal, which /dev/null passes for */
+	tty, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tty.Close()
+	savedStdin, savedYes, savedAuthor := os.Stdin, assumeYes, authorFlag
+	os.Stdin, assumeYes, authorFlag = tty, true, testAuthor
+	t.Cleanup(func() { os.Stdin, assumeYes, authorFlag = savedStdin, savedYes, savedAuthor })
+	t.Chdir(dir)
+
+	withStdin(t, "2\n")
+	out := captureStdout(t, func() { updateLabel(repo, []string{"msmanager", "update", "a.txt"}) })
+	if !strings.Contains(out, "  1  paper\n  2  thesis\n") {
+		t.Errorf("the picker does not list the labels:\n%s", out)
+	}
+	if v := versionsOf(t, dir, "thesis"); len(v) != 1 || v[0].OrigFile != "a.txt" {
+		t.Errorf("thesis after picking it: %+v", v)
+	}
+
+	/* With no file either, it is asked after the label */
+	writeFile(t, filepath.Join(dir, "b.txt"), "two\n")
+	withStdin(t, "paper\nb.txt\n")
+	captureStdout(t, func() { updateLabel(repo, []string{"msmanager", "update"}) })
+	if v := versionsOf(t, dir, "paper"); len(v) != 1 || v[0].OrigFile != "b.txt" {
+		t.Errorf("paper after picking it: %+v", v)
+	}
+
+	/* Piped, there is nobody to pick */
+	r := run(t, dir, "", "--yes", "--author", testAuthor, "update", "b.txt")
+	if r.code != ExitUsage || strings.Contains(r.stdout, "thesis") {
+		t.Errorf("update with no label from a pipe: exit %d\n%s%s", r.code, r.stdout, r.stderr)
+	}
+}
+
+func TestQuiet(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	writeFile(t, filepath.Join(dir, "a.txt"), "one\n")
+
+	r := run(t, dir, "", "--quiet", "--yes", "--author", testAuthor, "update", "paper", "a.txt")
+	if r.code != ExitOK || r.stdout != "" || r.stderr != "" {
+		t.Errorf("quiet update: exit %d\n%q\n%q", r.code, r.stdout, r.stderr)
+	}
+	if len(versionsOf(t, dir, "paper")) != 1 {
+		t.Errorf("quiet update made no version")
+	}
+	for _, args := range [][]string{{"track", "other", "other"}, {"--yes", "undo"}, {"restore", "paper", "1"}} {
+		if r := run(t, dir, "", append([]string{"--quiet"}, args...)...); r.code != ExitOK || r.stdout != "" {
+			t.Errorf("quiet %s: exit %d\n%s", strings.Join(args, " "), r.code, r.stdout)
+		}
+	}
+
+	/* Data asked for is still printed, and errors too */
+	if out := msm(t, dir, "--quiet", "latest", "paper"); out != "paper_1_FD.txt\n" {
+		t.Errorf("quiet latest: %q", out)
+	}
+	r = run(t, dir, "", "--quiet", "--yes", "--author", testAuthor, "update", "nope", "a.txt")
+	if r.code != ExitNotFound || !strings.Contains(r.stderr, `no such label "nope"`) {
+		t.Errorf("quiet update of a missing label: exit %d\n%s", r.code, r.stderr)
+	}
+}
+
+func TestCheckout(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	update(t, dir, "paper", "a.txt", "one\n")
+	update(t, dir, "paper", "a.txt", "two\n")
+
+	msm(t, dir, "--author", testAuthor, "--yes", "checkout", "paper", "1")
+	v := versionsOf(t, dir, "paper")
+	if len(v) != 3 || v[2].ID != v[0].ID || v[2].Parent != v[1].ID || v[2].Note != "checkout of version 1" {
+		t.Fatalf("versions after checkout: %+v", v)
+	}
+	if got := readFile(t, filepath.Join(dir, "paper_3_FD.txt")); got != "one\n" {
+		t.Errorf("checked out file: %q", got)
+	}
+	if exists(filepath.Join(dir, "paper_2_FD.txt")) {
+		t.Errorf("the version 2 file is still there")
+	}
+	if archives := archiveNames(t, openTestRepo(t, dir).archivesDir); len(archives) != 2 {
+		t.Errorf("checkout made a new archive: %v", archives)
+	}
+	r := run(t, dir, "", "--author", testAuthor, "--yes", "checkout", "paper", "1")
+	if r.code == ExitOK || !strings.Contains(r.stderr, "is the current content already") {
+		t.Errorf("checkout of the current content: exit %d\n%s", r.code, r.stderr)
+	}
+
+	/* A modified current file is only replaced when told to */
+	writeFile(t, filepath.Join(dir, "paper_3_FD.txt"), "my edits\n")
+	if r := run(t, dir, "n\n", "--author", testAuthor, "checkout", "paper", "2"); !strings.Contains(r.stdout, "Abort.") {
+		t.Errorf("checkout answered no:\n%s", r.stdout)
+	}
+	if got := readFile(t, filepath.Join(dir, "paper_3_FD.txt")); got != "my edits\n" || len(versionsOf(t, dir, "paper")) != 3 {
+		t.Errorf("checkout answered no replaced the file")
+	}
+	msm(t, dir, "--author", testAuthor, "checkout", "--force", "paper", "2")
+	if got := readFile(t, filepath.Join(dir, "paper_4_FD.txt")); got != "two\n" {
+		t.Errorf("checkout --force: %q", got)
+	}
+
+	/* Undo removes the checked out file, and puts the version before back */
+	msm(t, dir, "--yes", "undo")
+	if exists(filepath.Join(dir, "paper_4_FD.txt")) || readFile(t, filepath.Join(dir, "paper_3_FD.txt")) != "one\n" {
+		t.Errorf("undo of a checkout")
+	}
+}
+
+func TestRestoredTemplate(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	update(t, dir, "paper", "draft.tex", "one\n")
+	update(t, dir, "paper", "draft.tex", "two\n")
+
+	for _, tt := range []struct{ template, want string }{
+		{"{label}_v{version}_{origfile}", "paper_v1_draft.tex"},
+		{"{origfile}", "draft.tex"},
+		{"old-{file}", "old-paper_1_FD.tex"},
+	} {
+		msm(t, dir, "config", "restored", tt.template)
+		msm(t, dir, "restore", "paper", "1")
+		if got := readFile(t, filepath.Join(dir, tt.want)); got != "one\n" {
+			t.Errorf("restored with %s: %q", tt.template, got)
+		}
+	}
+	for _, bad := range []string{"", "restored_{label}", "{origfile}/x", "{nope}_{origfile}", "{origfile"} {
+		msmFails(t, dir, ExitError, "config", "restored", bad)
+	}
+
+	/* Placeholders can be empty, which is only found out at restore */
+	v := &Version{origFile: "a.txt", file: "paper_1_FD.txt", label: "paper", versionNumber: 1}
+	if got, err := restoredFilename(DefaultRestoredTemplate, v); err != nil || got != "restored_a.txt" {
+		t.Errorf("default restored name: %q, %v", got, err)
+	}
+	v.origFile = ""
+	if got, err := restoredFilename("{origfile}", v); err == nil {
+		t.Errorf("restored name from an empty origfile: %q", got)
+	}
+}
+
+func TestUnsafeNames(t *testing.T) {
+	dir := newTestRepo(t)
+	before := readTree(t, dir)
+	for _, name := range []string{"../../etc", "a/b", `a\b`, ".hidden", "..", "", "-rf", "hist", "tab\there", "new\nline"} {
+		r := run(t, dir, "", "track", name, "paper")
+		if r.code != ExitUsage {
+			t.Errorf("track label %q: exit %d\n%s", name, r.code, r.stderr)
+		}
+		r = run(t, dir, "", "track", "paper", name)
+		if r.code != ExitUsage {
+			t.Errorf("track basename %q: exit %d\n%s", name, r.code, r.stderr)
+		}
+	}
+	if after := readTree(t, dir); !reflect.DeepEqual(after, before) {
+		t.Errorf("a refused track changed the repository")
+	}
+	if exists(filepath.Join(filepath.Dir(dir), "etc")) {
+		t.Errorf("a file was made outside the repository")
+	}
+
+	track(t, dir, "paper", "paper")
+	msmFails(t, dir, ExitUsage, "rename", "paper", "../out")
+	msmFails(t, dir, ExitUsage, "set-basename", "paper", "sub/name")
+	track(t, dir, "Año 2024 (v2)", "Memoria de tesis")
+}
+
+func TestRepoFlag(t *testing.T) {
+	project := newTestRepo(t)
+	elsewhere := t.TempDir()
+	msm(t, elsewhere, "--repo", project, "track", "paper", "paper")
+	writeFile(t, filepath.Join(project, "a.txt"), "one\n")
+	msm(t, elsewhere, "--repo", project, "--author", testAuthor, "--yes", "update", "paper", filepath.Join(project, "a.txt"))
+
+	if got := readFile(t, filepath.Join(project, "paper_1_FD.txt")); got != "one\n" {
+		t.Errorf("version file in the repository: %q", got)
+	}
+	if out := msm(t, elsewhere, "--repo", project, "hist", "paper"); !strings.Contains(out, "paper_1_FD.txt") {
+		t.Errorf("hist through --repo:\n%s", out)
+	}
+	if out := msm(t, project, "latest", "paper"); out != "paper_1_FD.txt\n" {
+		t.Errorf("latest from the repository itself: %q", out)
+	}
+	if exists(filepath.Join(elsewhere, DataDirName)) || exists(filepath.Join(elsewhere, "paper_1_FD.txt")) {
+		t.Errorf("--repo wrote into the working directory")
+	}
+
+	/* --repo goes to that directory and nowhere else, not to a parent */
+	sub := filepath.Join(project, "sub")
+	writeFile(t, filepath.Join(sub, "x"), "")
+	r := msmFails(t, elsewhere, ExitNotFound, "--repo", sub, "hist")
+	if !strings.Contains(r.stdout+r.stderr, "No repository at "+sub) {
+		t.Errorf("--repo without a repository:\n%s%s", r.stdout, r.stderr)
+	}
+
+	/* init --repo makes a repository there */
+	fresh := t.TempDir()
+	msm(t, elsewhere, "--repo", fresh, "init")
+	if !exists(filepath.Join(fresh, DataDirName)) {
+		t.Errorf("init --repo made no %s", DataDirName)
+	}
+}
+
+func batchManifest(t testing.TB, dir string) string {
+	/*
+	 * Write the input files of a manifest of updates to three labels
+	 * into dir: content shared between labels, content given twice
+	 * to one label, and a missing file among them.
+	 */
+	var lines []string
+	for i := range 24 {
+		label := []string{"paper", "thesis", "grant"}[i%3]
+		file := filepath.Join(dir, fmt.Sprintf("in%02d.dat", i))
+		content := append(randomContent(1<<14), byte(i/2))
+		if err := os.WriteFile(file, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, joinFields(label, file, testAuthor, fmt.Sprintf("line %d", i+1)))
+	}
+	lines = append(lines, joinFields("paper", filepath.Join(dir, "in00.dat"), testAuthor))
+	lines = append(lines, joinFields("thesis", filepath.Join(dir, "missing.dat"), testAuthor))
+	manifest := filepath.Join(dir, "manifest")
+	if err := os.WriteFile(manifest, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return manifest
+}
+
+func TestBatchJobs(t *testing.T) {
+	/* The same manifest with one worker and with many gives the same repository */
+	type outcome struct {
+		stdout   string
+		rows     []string
+		archives []string
+	}
+	var outcomes []outcome
+	for _, jobs := range []string{"1", "8"} {
+		dir := newTestRepo(t)
+		for _, label := range []string{"paper", "thesis", "grant"} {
+			track(t, dir, label, label, "--allow-duplicate-basename")
+		}
+		r := run(t, dir, "", "--yes", "batch", "--jobs", jobs, batchManifest(t, dir))
+		if r.code != ExitError {
+			t.Fatalf("batch --jobs %s: exit %d\n%s", jobs, r.code, r.stderr)
+		}
+
+		var o outcome
+		o.stdout = strings.ReplaceAll(r.stdout, dir, "DIR")
+		for _, v := range openTestRepo(t, dir).readVersionsTable() {
+			/* Leave out the columns of when and where */
+			o.rows = append(o.rows, strings.ReplaceAll(joinFields(v.label, strconv.Itoa(v.versionNumber), v.origFile, v.file, v.author, v.id, v.note, strconv.FormatInt(v.size, 10), v.parent), dir, "DIR"))
+		}
+		o.archives = archiveNames(t, filepath.Join(dir, DataDirName, "archives"))
+		slices.Sort(o.archives)
+		outcomes = append(outcomes, o)
+	}
+
+	one, many := outcomes[0], outcomes[1]
+	if !strings.Contains(one.stdout, "24 succeeded, 2 failed.") {
+		t.Errorf("batch --jobs 1:\n%s", one.stdout)
+	}
+	if many.stdout != one.stdout {
+		t.Errorf("batch output with 8 jobs:\n%s\nwith 1:\n%s", many.stdout, one.stdout)
+	}
+	if !slices.Equal(many.rows, one.rows) {
+		t.Errorf("rows with 8 jobs:\n%s\nwith 1:\n%s", strings.Join(many.rows, "\n"), strings.Join(one.rows, "\n"))
+	}
+	if !slices.Equal(many.archives, one.archives) || len(one.archives) != 12 {
+		t.Errorf("archives with 8 jobs %q, with 1 %q", many.archives, one.archives)
+	}
+}
+
+func BenchmarkPrepareBatch(b *testing.B) {
+	dir := b.TempDir()
+	repo := newRepo(dir, filepath.Join(dir, DataDirName))
+	quiet = true
+	defer func() { quiet = false }()
+	initDB(repo)
+	repo.config = repo.readConfig()
+	for _, label := range []string{"paper", "thesis", "grant"} {
+		repo.writeToLabelsMap(label, label, "", "")
+	}
+	lines, err := readLines(batchManifest(b, dir))
+	if err != nil {
+		b.Fatal(err)
+	}
+	var records [][]string
+	for _, line := range lines {
+		records = append(records, splitFields(line))
+	}
+
+	for _, jobs := range []int{1, 8} {
+		b.Run(fmt.Sprintf("jobs=%d", jobs), func(b *testing.B) {
+			for range b.N {
+				b.StopTimer()
+				os.RemoveAll(repo.archivesDir)
+				os.Mkdir(repo.archivesDir, 0755)
+				b.StartTimer()
+				repo.prepareBatch(records, jobs)
+			}
+		})
+	}
+}
+
+func TestHistSort(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "beta", "beta")
+	track(t, dir, "alpha", "alpha")
+	repo := openTestRepo(t, dir)
+	err := editTable(repo.versionsTable, func(field []string) []string {
+		field[0], field[1], field[6] = "2023-12-31", "00:00:00", testAuthor
+		return field
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []Version{
+		{date: "2024-03-01", time: "10:00:00", label: "beta", versionNumber: 9, author: "c@example.com"},
+		{date: "2024-01-01", time: "12:00:00", label: "alpha", versionNumber: 10, author: "a@example.com"},
+		{date: "2024-02-01", time: "10:00:00", label: "beta", versionNumber: 10, author: "b@example.com"},
+		{date: "2024-01-01", time: "09:00:00", label: "alpha", versionNumber: 2, author: "c@example.com"},
+		{date: "2024-01-01", time: "12:00:00", label: "beta", versionNumber: 11, author: "a@example.com"},
+	} {
+		v.origFile, v.file, v.id, v.mtime = "in.txt", v.label+".txt", strings.Repeat("0", 40), time.Unix(0, 0)
+		repo.writeToVersionsTable(v)
+	}
+
+	for _, c := range []struct {
+		args []string
+		want string
+	}{
+		{nil, "beta:0 alpha:0 beta:9 alpha:10 beta:10 alpha:2 beta:11"},
+		{[]string{"--reverse"}, "beta:11 alpha:2 beta:10 alpha:10 beta:9 alpha:0 beta:0"},
+		{[]string{"--sort", "date"}, "beta:0 alpha:0 alpha:2 alpha:10 beta:11 beta:10 beta:9"},
+		{[]string{"--sort", "label"}, "alpha:0 alpha:10 alpha:2 beta:0 beta:9 beta:10 beta:11"},
+		{[]string{"--sort", "version"}, "beta:0 alpha:0 alpha:2 beta:9 alpha:10 beta:10 beta:11"},
+		{[]string{"--sort", "author"}, "alpha:10 beta:11 beta:0 alpha:0 beta:10 beta:9 alpha:2"},
+		{[]string{"--sort", "version", "--reverse"}, "beta:11 beta:10 alpha:10 beta:9 alpha:2 alpha:0 beta:0"},
+	} {
+		var got []string
+		for _, r := range history(t, dir, c.args...) {
+			got = append(got, fmt.Sprintf("%s:%d", r.Label, r.Version))
+		}
+		if strings.Join(got, " ") != c.want {
+			t.Errorf("hist %s: %s, want %s", strings.Join(c.args, " "), strings.Join(got, " "), c.want)
+		}
+	}
+
+	msmFails(t, dir, ExitUsage, "hist", "--sort", "size")
+}
+
+func TestPreviousVersionFile(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	first := update(t, dir, "paper", "a.txt", "one\n")
+
+	/* By default the unchanged previous file goes, and says so */
+	writeFile(t, filepath.Join(dir, "b.txt"), "two\n")
+	out := msm(t, dir, "--author", testAuthor, "--yes", "update", "paper", "b.txt")
+	if !strings.Contains(out, "Remove previous version "+first+", it is in the archive\n") || exists(filepath.Join(dir, first)) {
+		t.Errorf("update removing %s:\n%s", first, out)
+	}
+
+	/* Kept when asked to, in the dry run too */
+	msm(t, dir, "config", "previous", "keep")
+	second := latestFile(t, dir, "paper")
+	writeFile(t, filepath.Join(dir, "c.txt"), "three\n")
+	if out := msm(t, dir, "--author", testAuthor, "update", "--dry-run", "paper", "c.txt"); !strings.Contains(out, "Keep   : "+second+"\n") {
+		t.Errorf("update --dry-run keeping %s:\n%s", second, out)
+	}
+	out = msm(t, dir, "--author", testAuthor, "--yes", "update", "paper", "c.txt")
+	if !strings.Contains(out, "Keep previous version "+second+"\n") || readFile(t, filepath.Join(dir, second)) != "two\n" {
+		t.Errorf("update keeping %s:\n%s", second, out)
+	}
+
+	/* And checkout of another version leaves the current one */
+	third := latestFile(t, dir, "paper")
+	msm(t, dir, "--author", testAuthor, "--yes", "checkout", "paper", "1")
+	if !exists(filepath.Join(dir, third)) || readFile(t, filepath.Join(dir, latestFile(t, dir, "paper"))) != "one\n" {
+		t.Errorf("checkout with previous keep removed %s", third)
+	}
+
+	msmFails(t, dir, ExitError, "config", "previous", "trash")
+}
+
+func TestVerbose(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	first := update(t, dir, "paper", "a.txt", "one\n")
+	writeFile(t, filepath.Join(dir, "b.txt"), "two\n")
+
+	r := run(t, dir, "", "--verbose", "--author", testAuthor, "--yes", "update", "paper", "b.txt")
+	if r.code != ExitOK {
+		t.Fatalf("update --verbose: exit %d\n%s", r.code, r.stderr)
+	}
+	second := versionsOf(t, dir, "paper")[1]
+	for _, step := range []string{
+		"repository at .",
+		"b.txt: id " + second.ID + ", 4 bytes, version 2 after " + second.Parent + ", file " + second.File,
+		"compress b.txt into " + filepath.Join(DataDirName, "archives") + "/",
+		second.ID + ".gz with gzip",
+		"rename b.txt to " + second.File,
+		"remove " + first,
+		"add version 2 of \"paper\"",
+	} {
+		if !strings.Contains(r.stderr, step) {
+			t.Errorf("update --verbose does not log %q:\n%s", step, r.stderr)
+		}
+	}
+	stamp := regexp.MustCompile(`^msmanager: \d{4}/\d\d/\d\d \d\d:\d\d:\d\d\.\d{6} `)
+	for _, line := range strings.Split(strings.TrimSpace(r.stderr), "\n") {
+		if !stamp.MatchString(line) {
+			t.Errorf("log line without a timestamp: %q", line)
+		}
+	}
+
+	/* Quiet on stderr by default */
+	writeFile(t, filepath.Join(dir, "c.txt"), "three\n")
+	if r := run(t, dir, "", "--author", testAuthor, "--yes", "update", "paper", "c.txt"); r.stderr != "" {
+		t.Errorf("update without --verbose wrote to stderr:\n%s", r.stderr)
+	}
+}
+
+func TestSetBasename(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	track(t, dir, "other", "other")
+	update(t, dir, "paper", "a.txt", "one\n")
+	update(t, dir, "paper", "a.txt", "two\n")
+	files := func() []string {
+		var files []string
+		for _, v := range versionsOf(t, dir, "paper") {
+			files = append(files, v.File)
+		}
+		return files
+	}
+
+	/* With --rename, the rows and the file that is there */
+	out := msm(t, dir, "set-basename", "--rename", "paper", "draft")
+	if want := []string{"draft_1_FD.txt", "draft_2_FD.txt"}; !slices.Equal(files(), want) {
+		t.Errorf("files after set-basename --rename: %q, want %q", files(), want)
+	}
+	if !strings.Contains(out, "Rename: paper_2_FD.txt ---> draft_2_FD.txt\n") || readFile(t, filepath.Join(dir, "draft_2_FD.txt")) != "two\n" || exists(filepath.Join(dir, "paper_2_FD.txt")) {
+		t.Errorf("set-basename --rename:\n%s", out)
+	}
+	if file := update(t, dir, "paper", "a.txt", "three\n"); file != "draft_3_FD.txt" {
+		t.Errorf("update after set-basename made %s", file)
+	}
+
+	/* Without it, only new versions */
+	msm(t, dir, "set-basename", "paper", "article")
+	if file := update(t, dir, "paper", "a.txt", "four\n"); file != "article_4_FD.txt" {
+		t.Errorf("update after set-basename made %s", file)
+	}
+	if want := []string{"draft_1_FD.txt", "draft_2_FD.txt", "draft_3_FD.txt", "article_4_FD.txt"}; !slices.Equal(files(), want) {
+		t.Errorf("files after set-basename: %q, want %q", files(), want)
+	}
+
+	/* Names the template did not make with the old basename stay */
+	out = msm(t, dir, "set-basename", "--rename", "paper", "final")
+	if want := []string{"draft_1_FD.txt", "draft_2_FD.txt", "draft_3_FD.txt", "final_4_FD.txt"}; !slices.Equal(files(), want) {
+		t.Errorf("files after set-basename --rename: %q, want %q", files(), want)
+	}
+	if !strings.Contains(out, "draft_3_FD.txt is not named by the template, keep its name\n") {
+		t.Errorf("set-basename --rename:\n%s", out)
+	}
+
+	/* Collisions change nothing */
+	msmFails(t, dir, ExitError, "set-basename", "paper", "other")
+	msmFails(t, dir, ExitError, "set-basename", "paper", "final")
+	writeFile(t, filepath.Join(dir, "taken_4_FD.txt"), "in the way\n")
+	msmFails(t, dir, ExitError, "set-basename", "--rename", "paper", "taken")
+	if got := strings.Fields(msm(t, dir, "labels")); !slices.Contains(got, "final") || slices.Contains(got, "taken") {
+		t.Errorf("labels after failed set-basename: %q", got)
+	}
+	if !exists(filepath.Join(dir, "final_4_FD.txt")) {
+		t.Errorf("a failed set-basename moved final_4_FD.txt")
+	}
+	msmFails(t, dir, ExitNotFound, "set-basename", "nope", "name")
+}
+
+func TestSetBasenameTemplate(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "slides", "slides", "--template", "{initials}_{basename}_{version}{ext}")
+	track(t, dir, "report", "report", "--template", "{basename}-{date}-v{version}{ext}")
+	update(t, dir, "slides", "a.pdf", "one\n")
+	update(t, dir, "report", "b.txt", "two\n")
+
+	msm(t, dir, "set-basename", "--rename", "slides", "talk")
+	if file := latestFile(t, dir, "slides"); file != "FD_talk_1.pdf" || !exists(filepath.Join(dir, file)) {
+		t.Errorf("slides after set-basename --rename: %s", file)
+	}
+	date := versionsOf(t, dir, "report")[0].Date
+	msm(t, dir, "set-basename", "--rename", "report", "summary")
+	if file := latestFile(t, dir, "report"); file != "summary-"+date+"-v1.txt" || !exists(filepath.Join(dir, file)) {
+		t.Errorf("report after set-basename --rename: %s", file)
+	}
+}
+
+func TestRestoreMtime(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	when := time.Date(2021, 3, 4, 15, 16, 17, 0, time.Local)
+	writeFile(t, filepath.Join(dir, "a.txt"), "one\n")
+	if err := os.Chtimes(filepath.Join(dir, "a.txt"), when, when); err != nil {
+		t.Fatal(err)
+	}
+	msm(t, dir, "--author", testAuthor, "--yes", "update", "paper", "a.txt")
+	update(t, dir, "paper", "b.txt", "two\n")
+
+	mtime := func(path string) time.Time {
+		t.Helper()
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.ModTime()
+	}
+	out := filepath.Join(t.TempDir(), "out.txt")
+	msm(t, dir, "restore", "-o", out, "paper", "1")
+	if got := mtime(out); !got.Equal(when) {
+		t.Errorf("restored file has mtime %v, want %v", got, when)
+	}
+	msm(t, dir, "--author", testAuthor, "--yes", "checkout", "paper", "1")
+	if got := mtime(filepath.Join(dir, latestFile(t, dir, "paper"))); !got.Equal(when) {
+		t.Errorf("checked out file has mtime %v, want %v", got, when)
+	}
+}
+
+func TestTrackFrom(t *testing.T) {
+	dir := newTestRepo(t)
+	boilerplate := filepath.Join(t.TempDir(), "article.tex")
+	writeFile(t, boilerplate, "\\documentclass{article}\n")
+
+	msm(t, dir, "--author", testAuthor, "--yes", "track", "--from", boilerplate, "paper", "paper")
+	v := versionsOf(t, dir, "paper")
+	if len(v) != 1 || v[0].OrigFile != "paper.tex" || v[0].File != "paper_1_FD.tex" {
+		t.Fatalf("track --from: %+v", v)
+	}
+	if got := readFile(t, filepath.Join(dir, "paper_1_FD.tex")); got != "\\documentclass{article}\n" {
+		t.Errorf("version 1 of a track --from: %q", got)
+	}
+	if got := readFile(t, boilerplate); got != "\\documentclass{article}\n" {
+		t.Errorf("the template after track --from: %q", got)
+	}
+
+	/* Nothing is tracked when the template can't be used */
+	writeFile(t, filepath.Join(dir, "other.txt"), "in the way\n")
+	msmFails(t, dir, ExitUsage, "--author", testAuthor, "track", "--from", boilerplate, "other", "other", "other.txt")
+	msmFails(t, dir, ExitUsage, "--author", testAuthor, "track", "--from", dir, "other", "other")
+	msmFails(t, dir, ExitNotFound, "--author", testAuthor, "track", "--from", filepath.Join(dir, "missing.tex"), "other", "other")
+	msmFails(t, dir, ExitError, "--author", testAuthor, "track", "--from", filepath.Join(dir, "other.txt"), "other", "other")
+	if labels := openTestRepo(t, dir).readLabelsMap(); len(labels) != 1 {
+		t.Errorf("labels after failed tracks: %v", labels)
+	}
+}
+
+func TestReservedNames(t *testing.T) {
+	dir := newTestRepo(t)
+	for _, args := range [][]string{
+		{"track", "-n", "foo"},
+		{"track", "--", "-n", "foo"},
+		{"track", "--", "paper", "-paper"},
+		{"track", "update", "update"},
+		{"track", "paper", "hist"},
+	} {
+		msmFails(t, dir, ExitUsage, args...)
+	}
+	r := msmFails(t, dir, ExitUsage, "track", "--", "-n", "foo")
+	if !strings.Contains(r.stderr, `label "-n" can't start with a dash`) || !strings.Contains(r.stderr, `"--"`) {
+		t.Errorf("track of a dash-leading label: %s", r.stderr)
+	}
+	if r := msmFails(t, dir, ExitUsage, "track", "labels", "labels"); !strings.Contains(r.stderr, "is the name of a command") {
+		t.Errorf("track of a command name: %s", r.stderr)
+	}
+	if labels := openTestRepo(t, dir).readLabelsMap(); len(labels) != 0 {
+		t.Errorf("labels after refused tracks: %v", labels)
+	}
+
+	/* Nor can a label become one */
+	track(t, dir, "paper", "paper")
+	msmFails(t, dir, ExitUsage, "rename", "paper", "-paper")
+	msmFails(t, dir, ExitUsage, "rename", "paper", "restore")
+	msmFails(t, dir, ExitUsage, "set-basename", "paper", "-v")
+}
+
+func TestHistLabel(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	track(t, dir, "paper-2", "paper2")
+	update(t, dir, "paper", "a.txt", "one\n")
+	update(t, dir, "paper-2", "b.txt", "two\n")
+	update(t, dir, "paper", "a.txt", "three\n")
+
+	labels := func(args ...string) []string {
+		t.Helper()
+		var labels []string
+		for _, r := range history(t, dir, args...) {
+			labels = append(labels, fmt.Sprintf("%s:%d", r.Label, r.Version))
+		}
+		return labels
+	}
+	want := []string{"paper:0", "paper:1", "paper:2"}
+	for _, args := range [][]string{{"--label", "paper"}, {"paper"}} {
+		if got := labels(args...); !slices.Equal(got, want) {
+			t.Errorf("hist %s: %q, want %q", strings.Join(args, " "), got, want)
+		}
+	}
+	if got := labels("--label", "paper-2", "--author", testAuthor); !slices.Equal(got, []string{"paper-2:1"}) {
+		t.Errorf("hist --label paper-2 --author: %q", got)
+	}
+
+	r := msmFails(t, dir, ExitNotFound, "hist", "--label", "papr")
+	if !strings.Contains(r.stderr, `no such label "papr"`) || r.stdout != "" {
+		t.Errorf("hist of a mistyped label:\n%s%s", r.stdout, r.stderr)
+	}
+	msmFails(t, dir, ExitNotFound, "hist", "papr")
+	msmFails(t, dir, ExitUsage, "hist", "--label", "paper", "paper-2")
+}
+
+func TestUndoKeepsTakenName(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	first := update(t, dir, "paper", "a.txt", "one\n")
+	writeFile(t, filepath.Join(dir, "a.txt"), "mine\n")
+
+	out := msm(t, dir, "--yes", "undo")
+	if !strings.Contains(out, "rename "+first+" ---> a.undo.txt, as a.txt exists\n") || !strings.Contains(out, "Rename: "+first+" ---> a.undo.txt\n") {
+		t.Errorf("undo with a.txt taken:\n%s", out)
+	}
+	if readFile(t, filepath.Join(dir, "a.txt")) != "mine\n" || readFile(t, filepath.Join(dir, "a.undo.txt")) != "one\n" {
+		t.Errorf("undo overwrote a.txt or lost the version")
+	}
+
+	/* The next free name, and again */
+	update(t, dir, "paper", "b.txt", "two\n")
+	writeFile(t, filepath.Join(dir, "b.txt"), "mine too\n")
+	writeFile(t, filepath.Join(dir, "b.undo.txt"), "and this\n")
+	msm(t, dir, "--yes", "undo")
+	if readFile(t, filepath.Join(dir, "b.undo.txt")) != "and this\n" || readFile(t, filepath.Join(dir, "b.undo2.txt")) != "two\n" {
+		t.Errorf("undo with b.txt and b.undo.txt taken")
+	}
+
+	/* A version file gone is told, and the row still goes */
+	gone := update(t, dir, "paper", "c.txt", "three\n")
+	if err := os.Remove(filepath.Join(dir, gone)); err != nil {
+		t.Fatal(err)
+	}
+	r := run(t, dir, "", "--yes", "undo")
+	if r.code != ExitOK || !strings.Contains(r.stderr, gone+" is not there, nothing to rename.") {
+		t.Errorf("undo of a version whose file is gone: exit %d\n%s", r.code, r.stderr)
+	}
+	if v := versionsOf(t, dir, "paper"); len(v) != 0 {
+		t.Errorf("versions after the undos: %+v", v)
+	}
+}
+
+func TestDiffWorking(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	file := update(t, dir, "paper", "a.txt", "intro\nold method\nend\n")
+
+	if out := msm(t, dir, "diff", "paper"); out != "No changes.\n" {
+		t.Errorf("diff of an unchanged file:\n%s", out)
+	}
+
+	writeFile(t, filepath.Join(dir, file), "intro\nnew method\nend\n")
+	out := msm(t, dir, "diff", "paper")
+	for _, want := range []string{"--- " + file + " (archived)", "+++ " + file, "-old method", "+new method", " intro"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("diff of a changed file has no %q:\n%s", want, out)
+		}
+	}
+
+	if err := os.Remove(filepath.Join(dir, file)); err != nil {
+		t.Fatal(err)
+	}
+	if r := msmFails(t, dir, ExitNotFound, "diff", "paper"); !strings.Contains(r.stderr, "version file "+file+" is missing") {
+		t.Errorf("diff of a missing file: %s", r.stderr)
+	}
+}
+
+func TestProvenance(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	update(t, dir, "paper", "a.txt", "one\n")
+
+	host, err := os.Hostname()
+	if err != nil {
+		t.Skip("no hostname:", err)
+	}
+	u, err := user.Current()
+	if err != nil {
+		t.Skip("no current user:", err)
+	}
+	v := versionsOf(t, dir, "paper")
+	if len(v) != 1 || v[0].Host != host || v[0].User != u.Username {
+		t.Errorf("provenance of a version: %+v, want host %q and user %q", v, host, u.Username)
+	}
+
+	/* Shown with hist --verbose only */
+	if out := msm(t, dir, "hist"); strings.Contains(out, "HOST") {
+		t.Errorf("hist shows the provenance:\n%s", out)
+	}
+	out := msm(t, dir, "hist", "--verbose")
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if header := strings.Fields(lines[0]); !slices.Equal(header[len(header)-2:], []string{"HOST", "USER"}) {
+		t.Errorf("hist --verbose header: %q", lines[0])
+	}
+	if fields := strings.Fields(lines[len(lines)-1]); len(fields) < 2 || fields[len(fields)-2] != host || fields[len(fields)-1] != u.Username {
+		t.Errorf("hist --verbose row: %q", lines[len(lines)-1])
+	}
+}
+
+func TestLabelsJSON(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "tesis doctoral", "tesis final")
+	track(t, dir, "paper", "paper")
+	track(t, dir, "slides", "my talk", "--template", "{basename} v{version}{ext}")
+
+	var records []LabelRecord
+	out := msm(t, dir, "labels", "--json")
+	if err := json.Unmarshal([]byte(out), &records); err != nil {
+		t.Fatalf("labels --json: %v\n%s", err, out)
+	}
+	got := make(map[string]string)
+	for _, r := range records {
+		got[r.Label] = r.Basename
+	}
+	if want := openTestRepo(t, dir).readLabelsMap(); !reflect.DeepEqual(got, want) || len(records) != len(want) {
+		t.Errorf("labels --json: %v, want %v", got, want)
+	}
+	if records[2].Template != "{basename} v{version}{ext}" || records[0].Template != "" {
+		t.Errorf("templates in labels --json: %+v", records)
+	}
+}
+
+func TestRestoreAll(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "manuscript")
+	update(t, dir, "paper", "a.tex", "one\n")
+	update(t, dir, "paper", "a.tex", "two\n")
+	update(t, dir, "paper", "b.md", "three\n")
+
+	out := msm(t, dir, "restore", "--all", "-o", "review", "paper")
+	if !strings.Contains(out, `3 versions of label "paper" restored into review.`) {
+		t.Errorf("restore --all:\n%s", out)
+	}
+	want := map[string]string{"manuscript_v1.tex": "one\n", "manuscript_v2.tex": "two\n", "manuscript_v3.md": "three\n"}
+	if got := readTree(t, filepath.Join(dir, "review")); !reflect.DeepEqual(got, want) {
+		t.Errorf("restore --all wrote %v, want %v", got, want)
+	}
+
+	/* Only over existing files with --force */
+	writeFile(t, filepath.Join(dir, "review", "manuscript_v2.tex"), "my notes\n")
+	msmFails(t, dir, ExitError, "restore", "--all", "-o", "review", "paper")
+	if got := readFile(t, filepath.Join(dir, "review", "manuscript_v2.tex")); got != "my notes\n" {
+		t.Errorf("restore --all overwrote a file without --force: %q", got)
+	}
+	msm(t, dir, "restore", "--all", "--force", "-o", "review", "paper")
+	if got := readFile(t, filepath.Join(dir, "review", "manuscript_v2.tex")); got != "two\n" {
+		t.Errorf("restore --all --force: %q", got)
+	}
+
+	track(t, dir, "empty", "empty")
+	msmFails(t, dir, ExitNotFound, "restore", "--all", "empty")
+	msmFails(t, dir, ExitNotFound, "restore", "--all", "nope")
+}
+
+func TestUpdateSeveralFiles(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	writeFile(t, filepath.Join(dir, "paper.tex"), "text\n")
+	writeFile(t, filepath.Join(dir, "figs", "fig1.png"), "figure\n")
+	msm(t, dir, "--author", testAuthor, "--yes", "update", "paper", "paper.tex", "figs/fig1.png")
+
+	/* One version, a directory with both */
+	want := map[string]string{"paper.tex": "text\n", "fig1.png": "figure\n"}
+	v := versionsOf(t, dir, "paper")
+	if len(v) != 1 {
+		t.Fatalf("versions after updating with two files: %+v", v)
+	}
+	if got := readTree(t, filepath.Join(dir, v[0].File)); !reflect.DeepEqual(got, want) {
+		t.Errorf("version file %s holds %v", v[0].File, got)
+	}
+	if exists(filepath.Join(dir, "paper.tex")) || exists(filepath.Join(dir, "figs", "fig1.png")) {
+		t.Errorf("the input files are still there")
+	}
+	out := filepath.Join(t.TempDir(), "out")
+	msm(t, dir, "restore", "-o", out, "paper", "1")
+	if got := readTree(t, out); !reflect.DeepEqual(got, want) {
+		t.Errorf("restore of the version of two files: %v", got)
+	}
+
+	/* Refused files are left where they are */
+	writeFile(t, filepath.Join(dir, "a", "notes.txt"), "a\n")
+	writeFile(t, filepath.Join(dir, "b", "notes.txt"), "b\n")
+	msmFails(t, dir, ExitUsage, "--author", testAuthor, "--yes", "update", "paper", "a/notes.txt", "b/notes.txt")
+	msmFails(t, dir, ExitNotFound, "--author", testAuthor, "--yes", "update", "paper", "a/notes.txt", "missing.txt")
+	if readFile(t, filepath.Join(dir, "a", "notes.txt")) != "a\n" || readFile(t, filepath.Join(dir, "b", "notes.txt")) != "b\n" {
+		t.Errorf("refused updates moved the input files")
+	}
+}
+
+func TestUndoSeveralFiles(t *testing.T) {
+	/* Undo puts each file back, beside one that took its name since */
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	writeFile(t, filepath.Join(dir, "paper.tex"), "text\n")
+	writeFile(t, filepath.Join(dir, "figs", "fig1.png"), "figure\n")
+	msm(t, dir, "--author", testAuthor, "--yes", "update", "paper", "paper.tex", "figs/fig1.png")
+	v := versionsOf(t, dir, "paper")
+
+	writeFile(t, filepath.Join(dir, "paper.tex"), "mine\n")
+	msm(t, dir, "--yes", "undo")
+	if got := readFile(t, filepath.Join(dir, "paper.tex")); got != "mine\n" {
+		t.Errorf("undo overwrote paper.tex with %q", got)
+	}
+	if readFile(t, filepath.Join(dir, "paper.undo.tex")) != "text\n" || readFile(t, filepath.Join(dir, "figs", "fig1.png")) != "figure\n" {
+		t.Errorf("undo did not put the files back")
+	}
+	if exists(filepath.Join(dir, v[0].File)) {
+		t.Errorf("undo left %s", v[0].File)
+	}
+}
+
+func TestAmend(t *testing.T) {
+	dir := newTestRepo(t)
+	msmFails(t, dir, ExitNotFound, "amend", "-m", "nothing yet")
+	track(t, dir, "paper", "paper")
+	msmFails(t, dir, ExitUsage, "amend", "-m", "a track")
+	update(t, dir, "paper", "a.txt", "one\n")
+	update(t, dir, "paper", "a.txt", "two\n")
+	repo := openTestRepo(t, dir)
+	rows := func() [][]string {
+		t.Helper()
+		lines, err := readLines(repo.versionsTable)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rows [][]string
+		for _, line := range lines[1:] {
+			rows = append(rows, splitFields(line))
+		}
+		return rows
+	}
+	before := rows()
+
+	out := msm(t, dir, "amend", "--author", "jane@example.com", "-m", "fixed the abstract")
+	if !strings.Contains(out, "author: "+testAuthor+" --> jane@example.com") {
+		t.Errorf("amend:\n%s", out)
+	}
+	after := rows()
+	if !reflect.DeepEqual(after[:2], before[:2]) {
+		t.Errorf("amend changed rows before the last:\n%q\nwas\n%q", after[:2], before[:2])
+	}
+	last, was := after[2], before[2]
+	if last[6] != "jane@example.com" || last[8] != "fixed the abstract" {
+		t.Errorf("amended row: %q", last)
+	}
+	last[6], last[8] = was[6], was[8]
+	if !slices.Equal(last, was) {
+		t.Errorf("amend changed more than the author and note:\n%q\nwas\n%q", last, was)
+	}
+
+	/* A known author by number, and the note left as it is */
+	msm(t, dir, "config", "author", "add", "bob@example.com")
+	msm(t, dir, "amend", "--author", "1")
+	if v := versionsOf(t, dir, "paper")[1]; v.Author != "bob@example.com" || v.Note != "fixed the abstract" {
+		t.Errorf("after amend --author 1: %+v", v)
+	}
+	msm(t, dir, "amend", "-m", "")
+	if v := versionsOf(t, dir, "paper")[1]; v.Note != "" {
+		t.Errorf("after amend -m \"\": %+v", v)
+	}
+
+	msmFails(t, dir, ExitUsage, "amend")
+	msmFails(t, dir, ExitUsage, "amend", "--author", "not an email")
+	msm(t, dir, "verify")
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+/*
+ * The oplog records the commands undo can reverse, last one at the end:
+ *
+ *	track   LABEL
+ *	update  LABEL VERSION [FILE...]
+ *	checkout LABEL VERSION
+ *	restore FILE BACKUP
+ *
+ * BACKUP is where restore moved the file it overwrote, or "none".
+ * The FILEs of an update are where the files an update of several
+ * came from, so undo can put each back instead of their directory.
+ * Track, update and checkout are undone from the versions-table, the
+ * oplog is only needed to tell a checkout from an update, and that a
+ * restore came after them. An entry is only taken for the last row
+ * of the table if it names that row, and commands that remove rows
+ * remove their entries too. Repositories from before the oplog have
+ * none, and undo goes by the table alone.
+ */
+
+const OplogSize = 100
+
+type Op struct {
+	name string
+	args []string
+}
+
+func (repo *Repo) readOplog() []string {
+	lines, err := readLines(repo.oplogFile)
+	if err != nil && !os.IsNotExist(err) {
+		fail(err)
+	}
+	return lines
+}
+
+func (repo *Repo) logOp(name string, args ...string) {
+	lines := append(repo.readOplog(), joinFields(append([]string{name}, args...)...))
+	if len(lines) > OplogSize {
+		lines = lines[len(lines)-OplogSize:]
+	}
+	if err := writeLines(repo.oplogFile, lines); err != nil {
+		fail(err)
+	}
+}
+
+func (repo *Repo) lastOp() *Op {
+	/* Blank lines, as an edit by hand can leave, are no entries */
+	lines := repo.readOplog()
+	for i := len(lines) - 1; i >= 0; i-- {
+		if field := splitFields(lines[i]); len(field) > 0 {
+			return &Op{name: field[0], args: field[1:]}
+		}
+	}
+	return nil
+}
+
+func (repo *Repo) popOp() {
+	/* Remove the entry lastOp returns, and the blank lines after it */
+	lines := repo.readOplog()
+	for len(lines) > 0 && len(splitFields(lines[len(lines)-1])) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return
+	}
+	if err := writeLines(repo.oplogFile, lines[:len(lines)-1]); err != nil {
+		fail(err)
+	}
+}
+
+func (op *Op) made(v *Version) bool {
+	/* Tell if op is the one that added row v to the versions-table */
+	switch op.name {
+	case "track":
+		return v.versionNumber == 0 && len(op.args) > 0 && op.args[0] == v.label
+	case "update", "checkout":
+		return v.versionNumber > 0 && len(op.args) > 1 && op.args[0] == v.label && op.args[1] == strconv.Itoa(v.versionNumber)
+	}
+	return false
+}
+
+func (repo *Repo) editOplog(edit func(op Op) *Op) {
+	/* Rewrite the oplog replacing each entry with what edit returns, or removing it on nil */
+	var lines []string
+	for _, line := range repo.readOplog() {
+		field := splitFields(line)
+		if len(field) == 0 {
+			continue
+		}
+		if op := edit(Op{name: field[0], args: field[1:]}); op != nil {
+			lines = append(lines, joinFields(append([]string{op.name}, op.args...)...))
+		}
+	}
+	if err := writeLines(repo.oplogFile, lines); err != nil {
+		fail(err)
+	}
+}
+
+func (repo *Repo) backupFile(path string) (string, error) {
+	/* Move path out of the way into the undo directory, so undo can put it back */
+	dir := filepath.Join(repo.dataDir, "undo")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	backup, err := filepath.Abs(filepath.Join(dir, fmt.Sprintf("%d_%s", time.Now().UnixNano(), filepath.Base(path))))
+	if err != nil {
+		return "", err
+	}
+	return backup, os.Rename(path, backup)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestOplogEntries(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	first := update(t, dir, "paper", "a.txt", "one\n")
+	msm(t, dir, "restore", "paper", "1")
+	repo := openTestRepo(t, dir)
+
+	got := repo.readOplog()
+	want := []string{
+		joinFields("track", "paper"),
+		joinFields("update", "paper", "1"),
+		joinFields("restore", filepath.Join(dir, "restored_a.txt"), "none"),
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("oplog %q, want %q", got, want)
+	}
+	if op := repo.lastOp(); op.name != "restore" || len(op.args) != 2 || op.args[1] != "none" {
+		t.Errorf("last op: %+v", op)
+	}
+
+	v := repo.readVersionsTable()
+	for _, tt := range []struct {
+		op   Op
+		row  *Version
+		want bool
+	}{
+		{Op{"track", []string{"paper"}}, v[0], true},
+		{Op{"track", []string{"paper"}}, v[1], false},
+		{Op{"update", []string{"paper", "1"}}, v[1], true},
+		{Op{"checkout", []string{"paper", "1"}}, v[1], true},
+		{Op{"update", []string{"paper", "2"}}, v[1], false},
+		{Op{"update", []string{"other", "1"}}, v[1], false},
+		{Op{"restore", []string{first, "none"}}, v[1], false},
+	} {
+		if got := tt.op.made(tt.row); got != tt.want {
+			t.Errorf("%s %q made %s %d: %v, want %v", tt.op.name, tt.op.args, tt.row.label, tt.row.versionNumber, got, tt.want)
+		}
+	}
+}
+
+func TestOplogBlankLines(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	update(t, dir, "paper", "a.txt", "one\n")
+	repo := openTestRepo(t, dir)
+
+	/* Blank lines left at the end are gone over, and go with the entry before them */
+	f, err := os.OpenFile(repo.oplogFile, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("\n  \n")
+	f.Close()
+	if op := repo.lastOp(); op == nil || op.name != "update" {
+		t.Fatalf("last op before blank lines: %+v", op)
+	}
+	repo.popOp()
+	if op := repo.lastOp(); op == nil || op.name != "track" {
+		t.Errorf("last op after pop: %+v", op)
+	}
+
+	/* An oplog of blank lines has no entries */
+	writeFile(t, repo.oplogFile, "\n\n")
+	if op := repo.lastOp(); op != nil {
+		t.Errorf("last op of a blank oplog: %+v", op)
+	}
+	msm(t, dir, "--yes", "undo")
+	if v := versionsOf(t, dir, "paper"); len(v) != 0 {
+		t.Errorf("versions after undo with a blank oplog: %+v", v)
+	}
+}
+
+func TestUndoRestore(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	update(t, dir, "paper", "a.txt", "one\n")
+	update(t, dir, "paper", "a.txt", "two\n")
+	restored := filepath.Join(dir, "restored_a.txt")
+
+	/* A restore to a new file: undo removes it, and leaves the versions */
+	msm(t, dir, "restore", "paper", "1")
+	msm(t, dir, "--yes", "undo")
+	if exists(restored) || len(versionsOf(t, dir, "paper")) != 2 {
+		t.Errorf("undo of a restore: file left %v, %d versions", exists(restored), len(versionsOf(t, dir, "paper")))
+	}
+
+	/* A restore over a file: undo puts the file back */
+	writeFile(t, restored, "my edits\n")
+	msm(t, dir, "restore", "--force", "paper", "1")
+	if got := readFile(t, restored); got != "one\n" {
+		t.Fatalf("restore --force wrote %q", got)
+	}
+	out := msm(t, dir, "--yes", "undo")
+	if !strings.Contains(out, "Undo restore of") {
+		t.Errorf("undo does not tell it undoes the restore:\n%s", out)
+	}
+	if got := readFile(t, restored); got != "my edits\n" {
+		t.Errorf("undo of restore --force: %q", got)
+	}
+
+	/* With the restores undone, the next undo is of the last update */
+	msm(t, dir, "--yes", "undo")
+	if v := versionsOf(t, dir, "paper"); len(v) != 1 {
+		t.Errorf("undo after the restores: %d versions", len(v))
+	}
+	if got := readFile(t, restored); got != "my edits\n" {
+		t.Errorf("undo of the update touched %s", restored)
+	}
+}
+
+func TestUndoAfterCheckoutOfDeletedLabel(t *testing.T) {
+	/*
+	 * The checkout of a label that was deleted since must not make
+	 * undo take the next update of another label for a checkout,
+	 * removing its file instead of renaming it back.
+	 */
+	dir := newTestRepo(t)
+	track(t, dir, "draft", "draft")
+	track(t, dir, "paper", "paper")
+	update(t, dir, "draft", "a.txt", "one\n")
+	update(t, dir, "draft", "a.txt", "two\n")
+	msm(t, dir, "--author", testAuthor, "--yes", "checkout", "draft", "1")
+	msm(t, dir, "--yes", "delete", "draft")
+	if ops := openTestRepo(t, dir).readOplog(); slices.ContainsFunc(ops, func(op string) bool { return strings.Contains(op, "draft") }) {
+		t.Errorf("delete left oplog entries of the label: %q", ops)
+	}
+
+	update(t, dir, "paper", "b.txt", "mine\n")
+	msm(t, dir, "--yes", "undo")
+	if got := readFile(t, filepath.Join(dir, "b.txt")); got != "mine\n" {
+		t.Errorf("b.txt after undo: %q", got)
+	}
+	if exists(filepath.Join(dir, "paper_1_FD.txt")) || len(versionsOf(t, dir, "paper")) != 0 {
+		t.Errorf("undo left version 1 of paper")
+	}
+}
+
+func TestRepairDropsOplogEntries(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	update(t, dir, "paper", "a.txt", "one\n")
+	update(t, dir, "paper", "a.txt", "two\n")
+	msm(t, dir, "--author", testAuthor, "--yes", "checkout", "paper", "1")
+	repo := openTestRepo(t, dir)
+	if err := os.Remove(repo.archivePath(versionsOf(t, dir, "paper")[0].ID)); err != nil {
+		t.Fatal(err)
+	}
+
+	msm(t, dir, "--yes", "fsck", "--repair")
+	if v := versionsOf(t, dir, "paper"); len(v) != 1 || v[0].Version != 2 {
+		t.Fatalf("versions after fsck --repair: %+v", v)
+	}
+	for _, op := range repo.readOplog() {
+		if strings.HasPrefix(op, joinFields("checkout", "paper")) || op == joinFields("update", "paper", "1") {
+			t.Errorf("fsck --repair left the oplog entry %q of a removed row", op)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+/*
+ * Compressing a big input can take long enough to look like a hang,
+ * so inputs over ProgressThreshold report how far they are on stderr
+ * every progressInterval, on one line rewritten in place on a
+ * terminal and on a line each otherwise. --quiet leaves it out.
+ */
+
+const ProgressThreshold = 64 << 20
+
+const progressInterval = time.Second
+
+type progressReader struct {
+	r      io.ReadCloser
+	name   string
+	total  int64
+	done   int64
+	last   time.Time
+	inline bool
+	ended  bool
+}
+
+func withProgress(r io.ReadCloser, name string, total int64) io.ReadCloser {
+	/* r, telling how much of total is read if it is worth it */
+	if quiet || total < ProgressThreshold {
+		return r
+	}
+	return &progressReader{r: r, name: name, total: total, last: time.Now(), inline: isTerminal(os.Stderr)}
+}
+
+func (p *progressReader) Close() error {
+	return p.r.Close()
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.done += int64(n)
+	/* Once all of it is read, it is only told at the end */
+	if err == io.EOF && !p.ended {
+		p.ended = true
+		p.print(true)
+	} else if now := time.Now(); !p.ended && p.done < p.total && now.Sub(p.last) >= progressInterval {
+		p.last = now
+		p.print(false)
+	}
+	return n, err
+}
+
+func (p *progressReader) print(end bool) {
+	/* Directories are archived with tar headers, a bit over their total */
+	percent := min(p.done*100/p.total, 100)
+	line := fmt.Sprintf("Compress %s: %.1f of %.1f MB (%d%%)", p.name, float64(p.done)/(1<<20), float64(p.total)/(1<<20), percent)
+	switch {
+	case !p.inline:
+		fmt.Fprintln(os.Stderr, line)
+	case end:
+		fmt.Fprintf(os.Stderr, "\r%s\n", line)
+	default:
+		fmt.Fprintf(os.Stderr, "\r%s", line)
+	}
+}
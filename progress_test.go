@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWithProgress(t *testing.T) {
+	small := io.NopCloser(strings.NewReader("small"))
+	if r := withProgress(small, "small.txt", 5); r != small {
+		t.Errorf("progress for an input under the threshold")
+	}
+	big := io.NopCloser(strings.NewReader("big"))
+	if r := withProgress(big, "big.dat", ProgressThreshold); r == big {
+		t.Errorf("no progress for an input at the threshold")
+	}
+	withQuiet(t)
+	if r := withProgress(big, "big.dat", ProgressThreshold); r != big {
+		t.Errorf("progress with --quiet")
+	}
+}
+
+func TestProgressReports(t *testing.T) {
+	/* A big input read a quarter at a time, with an interval between reads */
+	total := int64(4 << 20)
+	p := &progressReader{r: io.NopCloser(io.LimitReader(zeros{}, total)), name: "data.bin", total: total}
+	out := captureStderr(t, func() {
+		buf := make([]byte, total/4)
+		for {
+			p.last = time.Now().Add(-progressInterval)
+			if _, err := io.ReadFull(p, buf); err != nil {
+				break
+			}
+		}
+	})
+
+	want := []string{
+		"Compress data.bin: 1.0 of 4.0 MB (25%)",
+		"Compress data.bin: 2.0 of 4.0 MB (50%)",
+		"Compress data.bin: 3.0 of 4.0 MB (75%)",
+		"Compress data.bin: 4.0 of 4.0 MB (100%)",
+	}
+	for _, line := range want {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("progress does not report %q:\n%s", line, out)
+		}
+	}
+	if n := strings.Count(out, "(100%)"); n != 1 {
+		t.Errorf("the end is reported %d times:\n%s", n, out)
+	}
+
+	/* Within the interval, nothing */
+	p = &progressReader{r: io.NopCloser(io.LimitReader(zeros{}, total)), name: "data.bin", total: total, last: time.Now()}
+	out = captureStderr(t, func() {
+		buf := make([]byte, total/4)
+		for range 3 {
+			io.ReadFull(p, buf)
+		}
+	})
+	if out != "" {
+		t.Errorf("progress within the interval:\n%s", out)
+	}
+}
+
+func TestProgressPaths(t *testing.T) {
+	/* Batch and deltas read big inputs as update does, and tell so once */
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	big := func(name string, extra string) {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		writeFile(t, path, extra)
+		if err := os.Truncate(path, ProgressThreshold+int64(len(extra))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	told := func(what string, r result, name string) {
+		t.Helper()
+		if r.code != ExitOK || strings.Count(r.stderr, "Compress "+name+": ") != 1 || !strings.Contains(r.stderr, "(100%)") {
+			t.Errorf("%s: exit %d\n%s", what, r.code, r.stderr)
+		}
+	}
+
+	big("a.dat", "one")
+	writeFile(t, filepath.Join(dir, "manifest"), joinFields("paper", "a.dat", testAuthor)+"\n")
+	told("batch", run(t, dir, "", "--yes", "batch", "manifest"), "a.dat")
+
+	msm(t, dir, "config", "delta", "3")
+	big("b.dat", "two")
+	told("update with deltas", run(t, dir, "", "--author", testAuthor, "--yes", "update", "paper", "b.dat"), "b.dat")
+	if _, delta := archiveBase(openTestRepo(t, dir).archivePath(versionsOf(t, dir, "paper")[1].ID)); !delta {
+		t.Errorf("version 2 is not a delta")
+	}
+}
+
+type zeros struct{}
+
+func (zeros) Read(b []byte) (int, error) {
+	clear(b)
+	return len(b), nil
+}
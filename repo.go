@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+const DataDirName = "msmanager-data"
+
+const LockTimeout = 5 * time.Second
+
+/* Environment variable to use a data directory other than the default */
+const DataDirEnv = "MSMANAGER_DIR"
+
+/*
+ * Repo holds the paths of a repository, all relative to the
+ * current directory, and its configuration.
+ */
+type Repo struct {
+	root          string
+	dataDir       string
+	archivesDir   string
+	labelsTable   string
+	versionsTable string
+	configFile    string
+	authorsFile   string
+	oplogFile     string
+	cryptFile     string
+	config        Config
+	lockFile      *os.File
+
+	/* Content ids worked out ahead by batch, by label and input path */
+	sums map[string]string
+
+	/* The versions-table as last read, see readVersionsTable */
+	versions []*Version
+
+	/* Times the versions-table was read from disk */
+	tableReads int
+
+	/* Versions added by the command, for the post-update hook */
+	added []Version
+}
+
+func newRepo(root, dataDir string) *Repo {
+	return &Repo{
+		root:          root,
+		dataDir:       dataDir,
+		archivesDir:   filepath.Join(dataDir, "archives"),
+		labelsTable:   filepath.Join(dataDir, "labels-table"),
+		versionsTable: filepath.Join(dataDir, "versions-table"),
+		configFile:    filepath.Join(dataDir, "config"),
+		authorsFile:   filepath.Join(dataDir, "authors"),
+		oplogFile:     filepath.Join(dataDir, "oplog"),
+		cryptFile:     filepath.Join(dataDir, "crypt"),
+		config:        defaultConfig(),
+	}
+}
+
+func newRepoHere() *Repo {
+	/*
+	 * The repository "init" creates: in the current directory,
+	 * the one given with --repo, or wherever MSMANAGER_DIR says.
+	 */
+	if repoFlag != "" {
+		return newRepo(repoFlag, filepath.Join(repoFlag, DataDirName))
+	}
+	if dir := os.Getenv(DataDirEnv); dir != "" {
+		return newRepo(".", dir)
+	}
+	return newRepo(".", DataDirName)
+}
+
+func openRepo() (*Repo, error) {
+	/*
+	 * With --repo, the repository is in that directory and nowhere
+	 * else. If MSMANAGER_DIR is set, that is the data directory and the
+	 * version files live in the current directory. Otherwise, like git,
+	 * look for the data directory in the current directory and then
+	 * in each parent up to the root.
+	 */
+	var repo *Repo
+	if repoFlag != "" {
+		dataDir := filepath.Join(repoFlag, DataDirName)
+		if fi, err := os.Stat(dataDir); err != nil || !fi.IsDir() {
+			return nil, fmt.Errorf("No repository at %s, it has no %s", repoFlag, DataDirName)
+		}
+		repo = newRepo(repoFlag, dataDir)
+	} else if dir := os.Getenv(DataDirEnv); dir != "" {
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			return nil, fmt.Errorf("No repository at %s=%s", DataDirEnv, dir)
+		}
+		repo = newRepo(".", dir)
+	} else {
+		root, err := findRepoRoot()
+		if err != nil {
+			return nil, err
+		}
+		repo = newRepo(root, filepath.Join(root, DataDirName))
+	}
+
+	repo.config = repo.readConfig()
+	repo.migrate()
+	repo.shardArchives()
+	return repo, nil
+}
+
+func findRepoRoot() (string, error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+
+	for dir := cwd; ; dir = filepath.Dir(dir) {
+		if fi, err := os.Stat(filepath.Join(dir, DataDirName)); err == nil && fi.IsDir() {
+			return filepath.Rel(cwd, dir)
+		}
+		if dir == filepath.Dir(dir) {
+			return "", fmt.Errorf("No repository in current or parent directories")
+		}
+	}
+}
+
+func (repo *Repo) lock() {
+	/*
+	 * Commands that change the tables take an exclusive flock on
+	 * msmanager-data/lock. The kernel drops it when the process exits,
+	 * so a crash or log.Fatal never leaves the repository locked.
+	 */
+	if err := repo.tryLock(); isReadOnly(err) {
+		fail(fmt.Errorf("repository is read-only: %w", err))
+	} else if err != nil {
+		fail(err)
+	}
+}
+
+func (repo *Repo) tryLock() error {
+	/*
+	 * Like lock, returning the error instead. Creating the lock file
+	 * fails on a read-only repository, which can still be read.
+	 */
+	f, err := os.OpenFile(filepath.Join(repo.dataDir, "lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(LockTimeout)
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			/* Others may have written the tables before the lock was ours */
+			repo.lockFile = f
+			repo.tableChanged()
+			debugf("locked %s", f.Name())
+			return nil
+		}
+		if err != syscall.EWOULDBLOCK || time.Now().After(deadline) {
+			f.Close()
+			return integrityError("repository is locked by another process")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func isReadOnly(err error) bool {
+	return errors.Is(err, syscall.EROFS) || errors.Is(err, fs.ErrPermission)
+}
+
+func (repo *Repo) unlock() {
+	if repo.lockFile != nil {
+		repo.lockFile.Close()
+		repo.lockFile = nil
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFindRepoFromSubdirectory(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	sub := filepath.Join(dir, "chapters", "one")
+	writeFile(t, filepath.Join(sub, "a.txt"), "one\n")
+
+	msm(t, sub, "--author", testAuthor, "--yes", "update", "paper", "a.txt")
+	file := latestFile(t, sub, "paper")
+	if got := readFile(t, filepath.Join(dir, file)); got != "one\n" {
+		t.Errorf("the version file is not at the root: %q", got)
+	}
+	if out := msm(t, sub, "labels"); !strings.Contains(out, "paper") {
+		t.Errorf("labels from %s:\n%s", sub, out)
+	}
+	if exists(filepath.Join(sub, DataDirName)) {
+		t.Errorf("a data directory was made in %s", sub)
+	}
+
+	r := msmFails(t, t.TempDir(), ExitNotFound, "labels")
+	if !strings.Contains(r.stdout, "No repository") {
+		t.Errorf("outside a repository:\n%s", r.stdout)
+	}
+}
+
+func TestDataDirFromEnvironment(t *testing.T) {
+	work := t.TempDir()
+	data := filepath.Join(t.TempDir(), "elsewhere")
+	env := []string{DataDirEnv + "=" + data}
+	msmEnv := func(args ...string) string {
+		t.Helper()
+		r := runWith(t, work, "", env, args...)
+		if r.code != ExitOK {
+			t.Fatalf("msmanager %s: exit %d\n%s%s", strings.Join(args, " "), r.code, r.stdout, r.stderr)
+		}
+		return r.stdout
+	}
+
+	msmEnv("init")
+	msmEnv("track", "paper", "paper")
+	writeFile(t, filepath.Join(work, "a.txt"), "one\n")
+	msmEnv("--author", testAuthor, "--yes", "update", "paper", "a.txt")
+
+	if exists(filepath.Join(work, DataDirName)) {
+		t.Errorf("init made %s in the working directory", DataDirName)
+	}
+	repo := newRepo(work, data)
+	if v := repo.readVersionsTable(); len(v) != 2 || v[1].label != "paper" {
+		t.Errorf("the versions-table in %s has %d rows", data, len(v))
+	}
+	file := strings.TrimSpace(msmEnv("latest", "paper"))
+	if got := readFile(t, filepath.Join(work, file)); got != "one\n" {
+		t.Errorf("version file %s: %q", file, got)
+	}
+
+	/* Without the variable the same directory is no repository */
+	msmFails(t, work, ExitNotFound, "labels")
+	r := runWith(t, work, "", []string{DataDirEnv + "=" + filepath.Join(work, "none")}, "labels")
+	if r.code != ExitNotFound || !strings.Contains(r.stdout, DataDirEnv) {
+		t.Errorf("%s pointing nowhere: exit %d\n%s", DataDirEnv, r.code, r.stdout)
+	}
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	const n = 6
+	for i := range n {
+		writeFile(t, filepath.Join(dir, fmt.Sprintf("f%d.txt", i)), fmt.Sprintf("content %d\n", i))
+	}
+
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := run(t, dir, "", "--author", testAuthor, "--yes", "update", "paper", fmt.Sprintf("f%d.txt", i))
+			if r.code != ExitOK {
+				t.Errorf("update f%d.txt: exit %d\n%s%s", i, r.code, r.stdout, r.stderr)
+			}
+		}()
+	}
+	wg.Wait()
+
+	versions := versionsOf(t, dir, "paper")
+	if len(versions) != n {
+		t.Fatalf("%d versions, want %d", len(versions), n)
+	}
+	ids := make(map[string]bool)
+	for i, v := range versions {
+		if v.Version != i+1 {
+			t.Errorf("row %d is version %d", i, v.Version)
+		}
+		ids[v.ID] = true
+	}
+	if len(ids) != n {
+		t.Errorf("%d distinct archives, want %d", len(ids), n)
+	}
+	msm(t, dir, "verify")
+}
+
+func TestUpdateWaitsForLock(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	writeFile(t, filepath.Join(dir, "a.txt"), "one\n")
+
+	holder := openTestRepo(t, dir)
+	if err := holder.tryLock(); err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(300*time.Millisecond, holder.unlock)
+
+	start := time.Now()
+	msm(t, dir, "--author", testAuthor, "--yes", "update", "paper", "a.txt")
+	if time.Since(start) < 300*time.Millisecond {
+		t.Errorf("update did not wait for the lock")
+	}
+	if len(versionsOf(t, dir, "paper")) != 1 {
+		t.Errorf("update after the lock was released made no version")
+	}
+}
+
+func TestReadOnlyRepository(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can write to read-only directories")
+	}
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	update(t, dir, "paper", "a.txt", "one\n")
+	dataDir := filepath.Join(dir, DataDirName)
+	os.Remove(filepath.Join(dataDir, "lock"))
+
+	setMode := func(dirMode, fileMode os.FileMode) {
+		t.Helper()
+		err := filepath.WalkDir(dataDir, func(path string, d os.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				return os.Chmod(path, dirMode)
+			}
+			return os.Chmod(path, fileMode)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	setMode(0555, 0444)
+	t.Cleanup(func() { setMode(0755, 0644) })
+
+	for _, args := range [][]string{{"hist"}, {"labels"}, {"log", "paper"}, {"info", "paper"}, {"verify"}} {
+		if r := run(t, dir, "", args...); r.code != ExitOK {
+			t.Errorf("%s in a read-only repository: exit %d\n%s", strings.Join(args, " "), r.code, r.stderr)
+		}
+	}
+	if exists(filepath.Join(dataDir, "lock")) {
+		t.Errorf("reading a read-only repository made a lock file")
+	}
+
+	writeFile(t, filepath.Join(dir, "b.txt"), "two\n")
+	r := run(t, dir, "", "--author", testAuthor, "--yes", "update", "paper", "b.txt")
+	if r.code != ExitError || !strings.Contains(r.stderr, "repository is read-only") {
+		t.Errorf("update in a read-only repository: exit %d\n%s", r.code, r.stderr)
+	}
+	if got := readFile(t, filepath.Join(dir, "b.txt")); got != "two\n" {
+		t.Errorf("the input of a failed update: %q", got)
+	}
+}
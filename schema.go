@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/*
+ * The tables start with a marker line with the schema they follow:
+ *
+ *	#schema	2
+ *
+ * Schema 1 is a table without marker, as written before it existed:
+ * versions-table rows with 8 to 11 columns, separated by spaces in
+ * the oldest ones. Schema 2 rows are tab separated, and versions-table
+ * rows always have all of DATE TIME LABEL VERSION ORIGFILE FILE AUTHOR
+ * ID NOTE SIZE PARENT, schema 3 adds MTIME to them and schema 4 HOST
+ * and USER. Tables are upgraded when a repository is opened.
+ */
+
+const SchemaVersion = 4
+
+func schemaMarker() string {
+	return joinFields("#schema", strconv.Itoa(SchemaVersion))
+}
+
+func isMarker(line string) bool {
+	return strings.HasPrefix(line, "#schema\t")
+}
+
+func tableSchema(lines []string) int {
+	if len(lines) > 0 {
+		if field := splitFields(lines[0]); len(field) == 2 && field[0] == "#schema" {
+			if n, err := strconv.Atoi(field[1]); err == nil {
+				return n
+			}
+		}
+	}
+	return 1
+}
+
+func checkSchema(table string, lines []string) error {
+	/* Rows of a newer schema would be misread, so they are not read at all */
+	if n := tableSchema(lines); n > SchemaVersion {
+		return fmt.Errorf("%s has schema %d, and this msmanager reads up to %d: the repository was created by a newer msmanager, please upgrade", table, n, SchemaVersion)
+	}
+	return nil
+}
+
+func (repo *Repo) migrate() {
+	/*
+	 * Rewrite tables older than SchemaVersion, and refuse newer
+	 * ones. A repository that can't be written to is still read,
+	 * with the old schema.
+	 */
+	var old []string
+	for _, table := range []string{repo.labelsTable, repo.versionsTable} {
+		lines, err := readLines(table)
+		if err != nil {
+			fail(err)
+		}
+		if err := checkSchema(table, lines); err != nil {
+			fail(err)
+		}
+		if tableSchema(lines) < SchemaVersion {
+			old = append(old, table)
+		}
+	}
+	if len(old) == 0 {
+		return
+	}
+
+	if err := repo.tryLock(); isReadOnly(err) {
+		fmt.Fprintf(os.Stderr, "Can't upgrade the tables of a read-only repository, reading them as they are.\n")
+		return
+	} else if err != nil {
+		fail(err)
+	}
+	defer repo.unlock()
+
+	for _, table := range old {
+		lines, err := readLines(table)
+		if err != nil {
+			fail(err)
+		}
+		if tableSchema(lines) >= SchemaVersion {
+			continue
+		}
+
+		upgraded := []string{schemaMarker()}
+		if table == repo.versionsTable {
+			for _, v := range repo.readVersionsTable() {
+				upgraded = append(upgraded, joinFields(v.fields()...))
+			}
+		} else {
+			for _, line := range lines {
+				if isMarker(line) {
+					continue
+				}
+				if field := splitFields(line); len(field) > 0 {
+					upgraded = append(upgraded, joinFields(field...))
+				}
+			}
+		}
+
+		if err := writeLines(table, upgraded); err != nil {
+			fmt.Fprintf(os.Stderr, "Can't upgrade %s: %v\n", table, err)
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "Upgrade %s to schema %d.\n", table, SchemaVersion)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMigrateSchema1(t *testing.T) {
+	/* A repository as the first msmanager wrote it: no markers, space separated rows */
+	dir := newTestRepo(t)
+	repo := openTestRepo(t, dir)
+	writeFile(t, repo.labelsTable, "paper paper\nthesis thesis\n")
+	writeFile(t, repo.versionsTable, strings.Join([]string{
+		"2023-05-01 10:00 paper 0 none none none none",
+		"2023-05-02 11:30 paper 1 a.txt paper_1_FD.txt jane@example.com 1111111111111111111111111111111111111111",
+		"2023-05-03 09:15 thesis 0 none none none none",
+	}, "\n")+"\n")
+
+	r := run(t, dir, "", "hist", "--json")
+	if r.code != ExitOK || !strings.Contains(r.stderr, "to schema 4") {
+		t.Fatalf("hist of a schema 1 repository: exit %d\n%s", r.code, r.stderr)
+	}
+	v := history(t, dir)
+	if len(v) != 3 || v[1].Label != "paper" || v[1].Version != 1 || v[1].Author != "jane@example.com" || v[1].Time != "11:30" {
+		t.Fatalf("rows after the upgrade: %+v", v)
+	}
+	if v[1].Note != "" || v[1].Size != nil || v[1].Parent != "-" {
+		t.Errorf("columns missing from schema 1: note %q, size %v, parent %q", v[1].Note, v[1].Size, v[1].Parent)
+	}
+
+	for _, table := range []string{repo.versionsTable, repo.labelsTable} {
+		lines := strings.Split(strings.TrimSpace(readFile(t, table)), "\n")
+		if lines[0] != schemaMarker() || tableSchema(lines) != SchemaVersion {
+			t.Errorf("%s starts with %q", table, lines[0])
+		}
+		for _, line := range lines[1:] {
+			if strings.Contains(line, " ") || !strings.Contains(line, "\t") {
+				t.Errorf("%s has a row not in the new format: %q", table, line)
+			}
+		}
+	}
+	if n := len(splitFields(strings.Split(readFile(t, repo.versionsTable), "\n")[2])); n != 14 {
+		t.Errorf("upgraded row has %d columns", n)
+	}
+
+	/* Upgraded once, read as is after */
+	if r := run(t, dir, "", "labels"); r.stderr != "" || !strings.Contains(r.stdout, "thesis") {
+		t.Errorf("labels after the upgrade:\n%s%s", r.stdout, r.stderr)
+	}
+}
+
+func TestNewerSchemaRefused(t *testing.T) {
+	dir := newTestRepo(t)
+	repo := openTestRepo(t, dir)
+	writeFile(t, repo.versionsTable, joinFields("#schema", "99")+"\n")
+	r := msmFails(t, dir, ExitError, "hist")
+	if !strings.Contains(r.stderr, "created by a newer msmanager") {
+		t.Errorf("hist of a newer schema: %s", r.stderr)
+	}
+	if got := readFile(t, repo.versionsTable); got != joinFields("#schema", "99")+"\n" {
+		t.Errorf("the newer table was rewritten: %q", got)
+	}
+}
+
+func TestMigrateSchema3(t *testing.T) {
+	/* Tables with a marker already, which the upgrade replaces */
+	dir := newTestRepo(t)
+	repo := openTestRepo(t, dir)
+	writeFile(t, repo.labelsTable, joinFields("#schema", "3")+"\n"+joinFields("paper", "paper")+"\n")
+	writeFile(t, repo.versionsTable, joinFields("#schema", "3")+"\n"+
+		joinFields("2023-05-01", "10:00:00", "paper", "0", "none", "none", "none", "none", "", "-", "-", "-")+"\n")
+
+	if r := run(t, dir, "", "labels"); r.code != ExitOK || !strings.Contains(r.stdout, "paper") {
+		t.Fatalf("labels of a schema 3 repository: exit %d\n%s%s", r.code, r.stdout, r.stderr)
+	}
+	for _, table := range []string{repo.labelsTable, repo.versionsTable} {
+		lines := strings.Split(strings.TrimSpace(readFile(t, table)), "\n")
+		if lines[0] != schemaMarker() {
+			t.Errorf("%s starts with %q", table, lines[0])
+		}
+		for _, line := range lines[1:] {
+			if isMarker(line) {
+				t.Errorf("%s has a second marker %q", table, line)
+			}
+		}
+	}
+	if v := history(t, dir); len(v) != 1 || v[0].Label != "paper" {
+		t.Errorf("rows after the upgrade: %+v", v)
+	}
+}
+
+func TestInitWritesSchema(t *testing.T) {
+	dir := newTestRepo(t)
+	repo := openTestRepo(t, dir)
+	for _, table := range []string{repo.labelsTable, repo.versionsTable} {
+		if got := readFile(t, table); got != schemaMarker()+"\n" {
+			t.Errorf("%s after init: %q", table, got)
+		}
+	}
+
+	/* A newer labels-table is refused as well, by commands that write too */
+	writeFile(t, repo.labelsTable, joinFields("#schema", "5")+"\n"+joinFields("paper", "paper", "", "", "extra")+"\n")
+	writeFile(t, filepath.Join(dir, "a.txt"), "one\n")
+	r := msmFails(t, dir, ExitError, "--author", testAuthor, "--yes", "update", "paper", "a.txt")
+	if !strings.Contains(r.stderr, "labels-table has schema 5") || !strings.Contains(r.stderr, "please upgrade") {
+		t.Errorf("update with a newer labels-table: %s", r.stderr)
+	}
+	if got := readFile(t, repo.versionsTable); got != schemaMarker()+"\n" || !exists(filepath.Join(dir, "a.txt")) {
+		t.Errorf("update with a newer labels-table changed the repository")
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+)
+
+/*
+ * Labels tracked with --text hold text files, whose line endings
+ * depend on the editor and system they were last saved with. Their
+ * content is hashed and archived with every CRLF or lone CR turned
+ * into LF, so the same text has the same id whatever its newlines.
+ * Version files come back with the newlines set by config eol.
+ * Other labels, and directories, are archived byte for byte.
+ */
+
+const TextMode = "text"
+
+type lfReader struct {
+	r *bufio.Reader
+}
+
+func (t lfReader) Read(p []byte) (n int, err error) {
+	for n < len(p) {
+		c, err := t.r.ReadByte()
+		if err != nil {
+			return n, err
+		}
+		if c == '\r' {
+			if next, err := t.r.Peek(1); err == nil && next[0] == '\n' {
+				t.r.ReadByte()
+			}
+			c = '\n'
+		}
+		p[n] = c
+		n++
+	}
+	return n, nil
+}
+
+type crlfWriter struct {
+	w io.Writer
+}
+
+func (c crlfWriter) Write(p []byte) (int, error) {
+	if _, err := c.w.Write(bytes.ReplaceAll(p, []byte("\n"), []byte("\r\n"))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+type textReader struct {
+	io.Reader
+	io.Closer
+}
+
+func (repo *Repo) isText(label string) bool {
+	for _, l := range repo.readLabels() {
+		if l.Label == label {
+			return l.Mode == TextMode
+		}
+	}
+	return false
+}
+
+func (repo *Repo) openInput(label, path string) (io.ReadCloser, error) {
+	/* The content of path as it is archived for label */
+	r, err := openContent(path)
+	if err != nil || isDir(path) || !repo.isText(label) {
+		return r, err
+	}
+	return textReader{lfReader{bufio.NewReader(r)}, r}, nil
+}
+
+func (repo *Repo) inputSha1(label, path string) (string, error) {
+	if sum, ok := repo.sums[label+"\x00"+path]; ok {
+		delete(repo.sums, label+"\x00"+path)
+		return sum, nil
+	}
+	r, err := repo.openInput(label, path)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	return readerSha1(r)
+}
+
+func textSha1(path string) (string, error) {
+	/* The id path would have in a text label */
+	r, err := openContent(path)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	return readerSha1(lfReader{bufio.NewReader(r)})
+}
+
+func (repo *Repo) inflateVersion(v *Version, dest string) error {
+	/*
+	 * Write the file of v to dest, with the newlines of the config
+	 * for text labels and the modification time the input file had.
+	 */
+	if err := repo.writeVersion(v, dest); err != nil {
+		return err
+	}
+	if v.mtime.IsZero() {
+		return nil
+	}
+	return os.Chtimes(dest, v.mtime, v.mtime)
+}
+
+func (repo *Repo) writeVersion(v *Version, dest string) error {
+	if v.isDir() || !repo.isText(v.label) || repo.config.eol == "lf" {
+		return inflate(repo.archivePath(v.id), dest, v.isDir())
+	}
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	return repo.decompressVersion(v, out)
+}
+
+func (repo *Repo) decompressVersion(v *Version, w io.Writer) error {
+	/* The content of v on w, with the newlines of the config for text labels */
+	if !v.isDir() && repo.isText(v.label) && repo.config.eol == "crlf" {
+		w = crlfWriter{w}
+	}
+	return decompressTo(repo.archivePath(v.id), w)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLineEndings(t *testing.T) {
+	for _, in := range []string{"one\ntwo\n", "one\r\ntwo\r\n", "one\rtwo\r", "one\r\ntwo\n"} {
+		b, err := io.ReadAll(lfReader{bufio.NewReader(strings.NewReader(in))})
+		if err != nil || string(b) != "one\ntwo\n" {
+			t.Errorf("lfReader of %q: %q, %v", in, b, err)
+		}
+	}
+	var out bytes.Buffer
+	if _, err := (crlfWriter{&out}).Write([]byte("one\ntwo\n")); err != nil || out.String() != "one\r\ntwo\r\n" {
+		t.Errorf("crlfWriter: %q, %v", out.String(), err)
+	}
+}
+
+func TestTextModeIDs(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "text", "text", "--text")
+	track(t, dir, "binary", "binary")
+	update(t, dir, "text", "lf.txt", "one\ntwo\n")
+	update(t, dir, "binary", "lf.bin", "one\ntwo\n")
+
+	/* Only the newlines changed: the same text, but other bytes */
+	writeFile(t, filepath.Join(dir, "crlf.txt"), "one\r\ntwo\r\n")
+	r := run(t, dir, "", "--author", testAuthor, "--yes", "update", "text", "crlf.txt")
+	if r.code == ExitOK || !strings.Contains(r.stderr, "the same file was used before") {
+		t.Errorf("text update with CRLF of the same text: exit %d\n%s", r.code, r.stderr)
+	}
+	update(t, dir, "binary", "crlf.bin", "one\r\ntwo\r\n")
+	text, binary := versionsOf(t, dir, "text"), versionsOf(t, dir, "binary")
+	if len(text) != 1 || len(binary) != 2 || binary[0].ID == binary[1].ID {
+		t.Fatalf("versions: text %+v, binary %+v", text, binary)
+	}
+	repo := openTestRepo(t, dir)
+	if sum, _ := repo.inputSha1("text", filepath.Join(dir, "crlf.txt")); sum != text[0].ID {
+		t.Errorf("text id of the CRLF file %s, want %s", sum, text[0].ID)
+	}
+
+	/* Files written from text archives get the newlines of config eol */
+	msm(t, dir, "config", "eol", "crlf")
+	update(t, dir, "text", "lf.txt", "one\ntwo\nthree\n")
+	msm(t, dir, "--author", testAuthor, "--yes", "checkout", "text", "1")
+	if got := readFile(t, filepath.Join(dir, latestFile(t, dir, "text"))); got != "one\r\ntwo\r\n" {
+		t.Errorf("checkout of a text version with eol crlf: %q", got)
+	}
+	msm(t, dir, "restore", "-o", "out.txt", "text", "1")
+	if got := readFile(t, filepath.Join(dir, "out.txt")); got != "one\r\ntwo\r\n" {
+		t.Errorf("restore of a text version with eol crlf: %q", got)
+	}
+	if got := msm(t, dir, "restore", "-o", "-", "text", "1"); got != "one\r\ntwo\r\n" {
+		t.Errorf("restore to stdout of a text version with eol crlf: %q", got)
+	}
+	if got := msm(t, dir, "show", "text", "1"); got != "one\r\ntwo\r\n" {
+		t.Errorf("show of a text version with eol crlf: %q", got)
+	}
+	msm(t, dir, "restore", "-o", "out.bin", "binary", "1")
+	if got := readFile(t, filepath.Join(dir, "out.bin")); got != "one\ntwo\n" {
+		t.Errorf("restore of a binary version: %q", got)
+	}
+}
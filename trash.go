@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/*
+ * With config trash on, or undo --no-archive-delete, the archives
+ * undo and delete would remove go to msmanager-data/trash instead,
+ * and the rows of the versions they held to trash/table, so an undo
+ * made by mistake can still be recovered from. "trash" lists them,
+ * "trash restore" writes a version out again and "trash empty"
+ * removes them for good. A delta goes there as a full archive: the
+ * archive it is based on may be gone by the time it is needed.
+ */
+
+func (repo *Repo) trashDir() string {
+	return filepath.Join(repo.dataDir, "trash")
+}
+
+func (repo *Repo) trashPath(v *Version) string {
+	/* Where the archive of v is in the trash, laid out and named like in archives */
+	return archivePathIn(repo.trashDir(), v.id, repo.archiveSuffix(v.origFile))
+}
+
+func (repo *Repo) trashTable() string {
+	return filepath.Join(repo.trashDir(), "table")
+}
+
+func (repo *Repo) removeArchive(v *Version, trash bool) error {
+	/* Remove the archive of v, or with trash move it to the trash */
+	archive := repo.archivePath(v.id)
+	if !trash {
+		debugf("remove archive %s", archive)
+		return os.Remove(archive)
+	}
+
+	dest := repo.trashPath(v)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	debugf("move archive %s to %s", archive, dest)
+	if _, err := os.Stat(dest); err == nil {
+		os.Remove(archive)
+	} else if _, delta := archiveBase(archive); delta {
+		content, err := readArchive(archive)
+		if err != nil {
+			return err
+		}
+		seal, err := repo.sealer()
+		if err != nil {
+			return err
+		}
+		if err := writeArchive(dest, nil, bytes.NewReader(content), repo.config.compression, repo.config.level, seal); err != nil {
+			return err
+		}
+		os.Remove(archive)
+	} else if err := os.Rename(archive, dest); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(repo.trashTable()); os.IsNotExist(err) {
+		if err := writeLines(repo.trashTable(), []string{schemaMarker()}); err != nil {
+			return err
+		}
+	}
+	return appendLine(repo.trashTable(), joinFields(v.fields()...))
+}
+
+func (repo *Repo) readTrash() []*Version {
+	lines, err := readLines(repo.trashTable())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		fail(err)
+	}
+	if err := checkSchema(repo.trashTable(), lines); err != nil {
+		fail(err)
+	}
+	var trashed []*Version
+	schema := tableSchema(lines)
+	for i, line := range lines {
+		if isMarker(line) || strings.TrimSpace(line) == "" {
+			continue
+		}
+		v := new(Version)
+		if err := v.parse(line, schema); err != nil {
+			fail(integrityError("%s:%d: %v", repo.trashTable(), i+1, err))
+		}
+		trashed = append(trashed, v)
+	}
+	return trashed
+}
+
+func trashCommand(repo *Repo, args []string) {
+	if len(args) < 3 || args[2] == "list" {
+		listTrash(repo)
+		return
+	}
+	switch args[2] {
+	case "restore":
+		restoreTrash(repo, args[1:])
+	case "empty":
+		emptyTrash(repo, args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown trash command %q.\n", args[2])
+		usage(ExitUsage)
+	}
+}
+
+func listTrash(repo *Repo) {
+	var rows [][]string
+	for _, v := range repo.readTrash() {
+		rows = append(rows, []string{v.id, v.label, strconv.Itoa(v.versionNumber), v.file, formatSize(v.size)})
+	}
+	if len(rows) == 0 {
+		inform("The trash is empty.\n")
+		return
+	}
+	printRows("ID LABEL VERSION FILE SIZE", rows)
+}
+
+func restoreTrash(repo *Repo, args []string) {
+	/* Write out a version from the trash, under its original name if free */
+	fs := flag.NewFlagSet("trash restore", flag.ExitOnError)
+	output := fs.String("o", "", "write the version to this path")
+	args = parseArgs(fs, args[2:])
+
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "Missing arguments.\n")
+		usage(ExitUsage)
+		return
+	}
+
+	if !isSha1(args[0]) {
+		fail(usageError("%q is not a valid ID", args[0]))
+	}
+	var found *Version
+	for _, v := range repo.readTrash() {
+		if v.id == args[0] {
+			found = v
+		}
+	}
+	if found == nil {
+		fail(notFoundError("no version %s in the trash", args[0]))
+	}
+
+	dest := *output
+	if dest == "" {
+		dest = repo.workPath(repo.freeName(found.origFile))
+	} else if _, err := os.Lstat(dest); err == nil {
+		fail(fmt.Errorf("%s already exists", dest))
+	}
+	if err := inflate(repo.trashPath(found), dest, found.isDir()); err != nil {
+		fail(err)
+	}
+	inform("Version %d of label %q restored from the trash: %s\n", found.versionNumber, found.label, dest)
+}
+
+func emptyTrash(repo *Repo, args []string) {
+	fs := flag.NewFlagSet("trash empty", flag.ExitOnError)
+	force := fs.Bool("force", false, "don't ask for confirmation")
+	parseArgs(fs, args[2:])
+
+	repo.lock()
+	defer repo.unlock()
+
+	trashed := repo.readTrash()
+	if len(trashed) == 0 {
+		inform("The trash is empty.\n")
+		return
+	}
+	inform("%d versions in the trash.\n", len(trashed))
+	if !*force && !askYesNo(stdin, "Remove them for good?") {
+		fmt.Println("Abort.")
+		return
+	}
+	if err := os.RemoveAll(repo.trashDir()); err != nil {
+		fail(err)
+	}
+	inform("Empty the trash.\n")
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUndoToTrash(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	update(t, dir, "paper", "a.txt", "one\n")
+	update(t, dir, "paper", "b.txt", "two\n")
+	repo := openTestRepo(t, dir)
+	v := versionsOf(t, dir, "paper")[1]
+	archive := repo.archivePath(v.ID)
+
+	if out := msm(t, dir, "undo", "--force", "--no-archive-delete"); !strings.Contains(out, v.ID+".gz to the trash") {
+		t.Errorf("undo --no-archive-delete:\n%s", out)
+	}
+	if exists(archive) || !exists(repo.trashPath(&Version{id: v.ID, origFile: v.OrigFile})) {
+		t.Errorf("the archive of the undone version is not in the trash")
+	}
+	if out := msm(t, dir, "trash"); !strings.Contains(out, v.ID) || !strings.Contains(out, v.File) {
+		t.Errorf("trash list:\n%s", out)
+	}
+
+	/* Recovered next to the original name the undo put back */
+	msm(t, dir, "trash", "restore", v.ID)
+	if got := readFile(t, filepath.Join(dir, "b.undo.txt")); got != "two\n" {
+		t.Errorf("restored from the trash: %q", got)
+	}
+	msm(t, dir, "trash", "restore", v.ID)
+	if got := readFile(t, filepath.Join(dir, "b.undo2.txt")); got != "two\n" {
+		t.Errorf("restored from the trash again: %q", got)
+	}
+	msmFails(t, dir, ExitError, "trash", "restore", "-o", "b.txt", v.ID)
+
+	/* With config trash on, without the flag; deleted labels too */
+	msm(t, dir, "config", "trash", "on")
+	first := versionsOf(t, dir, "paper")[0]
+	msm(t, dir, "--yes", "delete", "paper")
+	if trashed := repo.readTrash(); len(trashed) != 2 || trashed[1].id != first.ID {
+		t.Errorf("trash after delete: %+v", trashed)
+	}
+	msm(t, dir, "verify")
+
+	/* Emptied only when confirmed, for good */
+	if out := run(t, dir, "n\n", "trash", "empty").stdout; !strings.Contains(out, "2 versions in the trash.") || !strings.Contains(out, "Abort.") {
+		t.Errorf("trash empty answered no:\n%s", out)
+	}
+	if len(repo.readTrash()) != 2 {
+		t.Errorf("trash empty answered no removed the trash")
+	}
+	msm(t, dir, "trash", "empty", "--force")
+	if exists(repo.trashDir()) {
+		t.Errorf("trash empty left %s", repo.trashDir())
+	}
+	msmFails(t, dir, ExitNotFound, "trash", "restore", v.ID)
+	if out := msm(t, dir, "trash"); out != "The trash is empty.\n" {
+		t.Errorf("trash list after empty:\n%s", out)
+	}
+}
+
+func TestDeltaToTrash(t *testing.T) {
+	/* A delta goes to the trash whole, as its base may go */
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	msm(t, dir, "config", "delta", "5")
+	content := randomContent(1 << 14)
+	update(t, dir, "paper", "a.dat", string(content))
+	update(t, dir, "paper", "a.dat", string(content)+"more\n")
+	repo := openTestRepo(t, dir)
+	v := versionsOf(t, dir, "paper")[1]
+	if _, delta := archiveBase(repo.archivePath(v.ID)); !delta {
+		t.Fatalf("version 2 is not a delta")
+	}
+
+	msm(t, dir, "undo", "--force", "--no-archive-delete")
+	msm(t, dir, "undo", "--force")
+	trashed := repo.trashPath(&Version{id: v.ID, origFile: v.OrigFile})
+	if _, delta := archiveBase(trashed); delta {
+		t.Errorf("the delta went to the trash as a delta")
+	}
+	out := filepath.Join(t.TempDir(), "out.dat")
+	msm(t, dir, "trash", "restore", "-o", out, v.ID)
+	if got := readFile(t, out); got != string(content)+"more\n" {
+		t.Errorf("delta restored from the trash: %d bytes", len(got))
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/*
+ * A label can track a whole directory. Its content is stored as a
+ * tar stream, and that stream is what gets hashed and compressed.
+ * The stream must be the same for identical trees, so entries are
+ * written in lexical order and without owners or timestamps.
+ *
+ * Directory versions are recorded with a trailing "/" in ORIGFILE
+ * and FILE.
+ */
+
+func isDir(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.IsDir()
+}
+
+func (v *Version) isDir() bool {
+	return strings.HasSuffix(v.file, "/")
+}
+
+func walkTree(dir string, fn func(path string, d fs.DirEntry) error) error {
+	/* Walk dir in lexical order, leaving out what .msmanagerignore lists */
+	ignore, err := readIgnore(dir)
+	if err != nil {
+		return err
+	}
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != dir {
+			name, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			if ignore.match(filepath.ToSlash(name), d.IsDir()) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+		return fn(path, d)
+	})
+}
+
+func contentSize(path string) (int64, error) {
+	/* The size of a file, or the total size of the files in a directory */
+	if !isDir(path) {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return 0, err
+		}
+		return fi.Size(), nil
+	}
+
+	var size int64
+	err := walkTree(path, func(p string, d fs.DirEntry) error {
+		if d.Type().IsRegular() {
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+func openContent(path string) (io.ReadCloser, error) {
+	/* A regular file is read as is, a directory as a tar stream */
+	if !isDir(path) {
+		return os.Open(path)
+	}
+
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(writeTar(w, path))
+	}()
+	return r, nil
+}
+
+func writeTar(w io.Writer, dir string) error {
+	tw := tar.NewWriter(w)
+
+	err := walkTree(dir, func(path string, d fs.DirEntry) error {
+		if path == dir {
+			return nil
+		}
+
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		hdr := &tar.Header{
+			Name:    filepath.ToSlash(name),
+			Mode:    int64(fi.Mode().Perm()),
+			ModTime: time.Unix(0, 0),
+			Format:  tar.FormatPAX,
+		}
+		switch {
+		case fi.IsDir():
+			hdr.Typeflag = tar.TypeDir
+			hdr.Name += "/"
+		case fi.Mode().IsRegular():
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = fi.Size()
+		default:
+			return fmt.Errorf("%s: only regular files and directories can be archived", path)
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if _, err := io.Copy(tw, f); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func extractTar(r io.Reader, dest string) error {
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		/* Never write outside dest, whatever the archive says */
+		if !filepath.IsLocal(hdr.Name) {
+			return fmt.Errorf("unsafe path in archive: %q", hdr.Name)
+		}
+		path := filepath.Join(dest, hdr.Name)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, fs.FileMode(hdr.Mode).Perm()|0700); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, fs.FileMode(hdr.Mode).Perm())
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported entry in archive: %q", hdr.Name)
+		}
+	}
+}
+
+func decompressTree(archive string, dest string) error {
+	reader, err := openArchive(archive)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	return extractTar(reader, dest)
+}
+
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dest)
+		return err
+	}
+	return out.Close()
+}
+
+func inflate(archive string, dest string, dir bool) error {
+	if dir {
+		return decompressTree(archive, dest)
+	}
+	return decompress(archive, dest)
+}
@@ -2,16 +2,24 @@ package main
 
 import (
 	"bufio"
-	"compress/gzip"
 	"crypto/sha1"
+	"encoding/json"
+	"flag"
 	"fmt"
-	"log"
 	"io"
+	"log"
 	"os"
 	"os/exec"
+	"os/user"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"text/template"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 type Version struct {
@@ -23,222 +31,809 @@ type Version struct {
 	file          string
 	author        string
 	id            string
+	note          string
+	size          int64
+	parent        string
+	mtime         time.Time
+	host          string
+	user          string
 }
 
+/* Exported mirrors of the tables, used for --json output */
 
-func calculateSha1(file string) (string) {
-	f, err := os.Open(file)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer f.Close()
+type VersionRecord struct {
+	Date      string `json:"date"`
+	Time      string `json:"time"`
+	Label     string `json:"label"`
+	Version   int    `json:"version"`
+	OrigFile  string `json:"origFile"`
+	File      string `json:"file"`
+	Author    string `json:"author"`
+	ID        string `json:"id"`
+	Note      string `json:"note"`
+	Size      *int64 `json:"size"`
+	Parent    string `json:"parent"`
+	ModTime   string `json:"mtime,omitempty"`
+	Host      string `json:"host,omitempty"`
+	User      string `json:"user,omitempty"`
+	Timestamp string `json:"timestamp,omitempty"`
+}
 
-	h := sha1.New()
-	if _, err := io.Copy(h, f); err != nil {
-		log.Fatal(err)
+type LabelRecord struct {
+	Label    string `json:"label"`
+	Basename string `json:"basename"`
+	Template string `json:"template,omitempty"`
+	Mode     string `json:"mode,omitempty"`
+
+	/* The latest version, filled in for labels --verbose */
+	Version *int   `json:"version,omitempty"`
+	Updated string `json:"updated,omitempty"`
+	Author  string `json:"author,omitempty"`
+}
+
+type ArchiveRecord struct {
+	ID     string `json:"id"`
+	Size   *int64 `json:"size"`
+	Refs   int    `json:"refs"`
+	Status string `json:"status"`
+	Base   bool   `json:"-"`
+}
+
+func (r ArchiveRecord) status() string {
+	/* A base is only needed by deltas, not by any version itself */
+	switch {
+	case r.Size == nil:
+		return "missing"
+	case r.Base:
+		return "base"
+	case r.Refs == 0:
+		return "orphan"
+	case r.Refs > 1:
+		return "shared"
 	}
-	return fmt.Sprintf("%x", h.Sum(nil))
+	return "ok"
 }
 
+type StatusRecord struct {
+	Label  string `json:"label"`
+	File   string `json:"file"`
+	Status string `json:"status"`
+}
 
-func readLabelsMap() map[string]string {
-	labels := make(map[string]string)
+func (v *Version) fields() []string {
+	return []string{v.date, v.time, v.label, strconv.Itoa(v.versionNumber),
+		v.origFile, v.file, v.author, v.id, v.note, formatSize(v.size), v.parent, formatMtime(v.mtime),
+		orUnknown(v.host), orUnknown(v.user)}
+}
 
-	f, err := os.Open(LabelsTable)
-	if err != nil {
-		log.Fatal(err)
+func orUnknown(s string) string {
+	if s == "" {
+		return "-"
 	}
+	return s
+}
 
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		field := strings.Fields(scanner.Text())
-		labels[field[0]] = field[1]
+func formatMtime(t time.Time) string {
+	/* The modification time of the input file, unknown (-) for older versions */
+	if t.IsZero() {
+		return "-"
 	}
-	return labels
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func formatSize(size int64) string {
+	/* Sizes are unknown (-1) for version 0 and for versions recorded before sizes were */
+	if size < 0 {
+		return "-"
+	}
+	return strconv.FormatInt(size, 10)
 }
 
+func (v *Version) record() VersionRecord {
+	r := VersionRecord{
+		Date:     v.date,
+		Time:     v.time,
+		Label:    v.label,
+		Version:  v.versionNumber,
+		OrigFile: v.origFile,
+		File:     v.file,
+		Author:   v.author,
+		ID:       v.id,
+		Note:     v.note,
+		Parent:   v.parent,
+		Host:     v.host,
+		User:     v.user,
+	}
+	if v.size >= 0 {
+		r.Size = &v.size
+	}
+	if !v.mtime.IsZero() {
+		r.ModTime = formatMtime(v.mtime)
+	}
+	if t, err := v.timestamp(); err == nil {
+		r.Timestamp = t.Format(time.RFC3339)
+	}
+	return r
+}
+
+
+func calculateSha1(file string) (string) {
+	sum, err := contentSha1(file)
+	if err != nil {
+		fail(err)
+	}
+	return sum
+}
 
-func writeToLabelsMap(label, basename string) {
-	f, err := os.OpenFile(LabelsTable, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+func contentSha1(file string) (string, error) {
+	f, err := openContent(file)
 	if err != nil {
-		log.Fatal(err)
+		return "", err
 	}
 	defer f.Close()
+	return readerSha1(f)
+}
 
-	/* Labels-table has two columns: LABEL BASENAME */
-	fmt.Fprintf(f, "%s %s\n", label, basename)
+func readerSha1(r io.Reader) (string, error) {
+	h := sha1.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
 }
 
 
-func readVersionsTable() (versionsList []*Version) {
-	f, err := os.Open(VersionsTable)
+func (repo *Repo) readLabels() (labels []LabelRecord) {
+	/* Labels in the order they were tracked */
+	f, err := os.Open(repo.labelsTable)
 	if err != nil {
-		log.Fatal(err)
+		fail(err)
 	}
+	defer f.Close()
 
 	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		v := new(Version)
-		v.parse(scanner.Text())
-		versionsList = append(versionsList, v)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		field := splitFields(line)
+		if len(field) == 0 || isMarker(line) {
+			continue
+		}
+		if len(field) < 2 {
+			fmt.Fprintf(os.Stderr, "%s:%d: malformed line %q, skipped\n", repo.labelsTable, n, line)
+			continue
+		}
+		l := LabelRecord{Label: field[0], Basename: field[1]}
+		if len(field) > 2 {
+			l.Template = field[2]
+		}
+		if len(field) > 3 {
+			l.Mode = field[3]
+		}
+		labels = append(labels, l)
 	}
 	if err := scanner.Err(); err != nil {
-		log.Fatal(err)
+		fail(err)
 	}
-	return 
+	return labels
 }
 
 
-func writeToVersionsTable(v Version) {
-	f, err := os.OpenFile(VersionsTable, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		log.Fatal(err)
+func (repo *Repo) readLabelsMap() map[string]string {
+	labels := make(map[string]string)
+	for _, l := range repo.readLabels() {
+		labels[l.Label] = l.Basename
 	}
+	return labels
+}
+
 
+func (repo *Repo) writeToLabelsMap(label, basename, template, mode string) {
 	/*
-	 * Version entry order:
-	 * DATE TIME LABEL VERSION ORIGFILE FILE AUTHOR ID
+	 * Labels-table has two columns: LABEL BASENAME,
+	 * a third, TEMPLATE, for labels with their own filenames,
+	 * and a fourth, MODE, that is "text" for text labels.
 	 */
+	line := joinFields(label, basename)
+	if mode != "" {
+		line = joinFields(label, basename, template, mode)
+	} else if template != "" {
+		line = joinFields(label, basename, template)
+	}
+	if err := appendLine(repo.labelsTable, line); err != nil {
+		fail(err)
+	}
+}
+
+var reservedNames = []string{"init", "config", "track", "update", "batch", "hist", "log", "labels",
+	"status", "restore", "checkout", "show", "undo", "delete", "amend", "rename", "set-basename", "diff",
+	"latest", "find", "info", "verify", "fsck", "trash", "archives", "gc", "bundle", "unbundle", "export", "completion"}
 
-	fmt.Fprintf(f, "%s %s %s %d %s %s %s %s\n",
-		v.date, v.time, v.label, v.versionNumber, v.origFile, v.file, v.author, v.id)
-	f.Close()
+func checkName(kind, name string) error {
+	/*
+	 * Labels and basenames end up in filenames in the repository
+	 * root, so they can't be paths or hidden names, and can't hold
+	 * control characters. A leading dash or a command name is most
+	 * likely a mistyped command line.
+	 */
+	switch {
+	case name == "":
+		return usageError("%s can't be empty", kind)
+	case strings.HasPrefix(name, "-"):
+		return usageError("%s %q can't start with a dash; options go before the arguments, and \"--\" ends them", kind, name)
+	case slices.Contains(reservedNames, name):
+		return usageError("%s %q is the name of a command, choose another", kind, name)
+	case strings.ContainsAny(name, `/\`):
+		return usageError("%s %q can't contain a path separator", kind, name)
+	case strings.HasPrefix(name, "."):
+		return usageError("%s %q can't start with a dot", kind, name)
+	case strings.IndexFunc(name, unicode.IsControl) >= 0:
+		return usageError("%s %q can't contain control characters", kind, name)
+	}
+	return nil
 }
 
-func compress(inputFile, outputFile string) error {
-	inFile, err := os.Open(inputFile)
-	if err != nil {
+/*
+ * Version filenames are made from a template. The extension, or a
+ * trailing "/" for directories, is part of {ext}.
+ */
+const DefaultTemplate = "{basename}_{version}_{initials}{ext}"
+
+var templatePlaceholder = regexp.MustCompile(`\{([^{}]*)\}`)
+
+var templateKeys = []string{"basename", "version", "initials", "date", "ext"}
+
+func checkTemplate(template string) error {
+	if err := checkPlaceholders(template, templateKeys); err != nil {
 		return err
 	}
-	defer inFile.Close()
+	if !strings.Contains(template, "{version}") {
+		return fmt.Errorf("template must contain {version}, or versions would share a filename")
+	}
+	return nil
+}
 
-	outFile, err := os.Create(outputFile)
-	if err != nil {
-		return err
+func checkPlaceholders(template string, keys []string) error {
+	for _, m := range templatePlaceholder.FindAllStringSubmatch(template, -1) {
+		if !slices.Contains(keys, m[1]) {
+			return fmt.Errorf("unknown placeholder {%s} in template (use %s)", m[1], strings.Join(keys, ", "))
+		}
 	}
-	defer outFile.Close()
+	if strings.ContainsAny(templatePlaceholder.ReplaceAllString(template, ""), "{}/") {
+		return fmt.Errorf("template can't have stray braces or a /")
+	}
+	return nil
+}
 
-	gzipWriter := gzip.NewWriter(outFile)
-	defer gzipWriter.Close()
+/*
+ * Restore names the file it writes from another template, with the
+ * original filename, the version filename, the label and the number.
+ */
+const DefaultRestoredTemplate = "restored_{origfile}"
 
-	if _, err := io.Copy(gzipWriter, inFile); err != nil {
+var restoredKeys = []string{"origfile", "file", "label", "version"}
+
+func checkRestoredTemplate(template string) error {
+	if err := checkPlaceholders(template, restoredKeys); err != nil {
 		return err
 	}
+	if !strings.Contains(template, "{origfile}") && !strings.Contains(template, "{file}") {
+		return fmt.Errorf("template must contain {origfile} or {file}, or restored files would have no name")
+	}
 	return nil
 }
 
-func decompress(inputFile string, outputFile string) error {
-	inFile, err := os.Open(inputFile)
-	if err != nil {
-		return err
+func restoredFilename(template string, v *Version) (string, error) {
+	/* Placeholders can be empty, so the name is checked once made */
+	name := renderFilename(template, map[string]string{
+		"origfile": strings.TrimSuffix(v.origFile, "/"),
+		"file":     strings.TrimSuffix(v.file, "/"),
+		"label":    v.label,
+		"version":  strconv.Itoa(v.versionNumber),
+	})
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+		return "", fmt.Errorf("restored template %q makes the unusable filename %q", template, name)
 	}
-	defer inFile.Close()
+	return name, nil
+}
 
-	outFile, err := os.Create(outputFile)
-	if err != nil {
-		return err
+func renderFilename(template string, values map[string]string) string {
+	return templatePlaceholder.ReplaceAllStringFunc(template, func(m string) string {
+		return values[m[1:len(m)-1]]
+	})
+}
+
+
+func (repo *Repo) readVersionsTable() (versionsList []*Version) {
+	/*
+	 * The table is read once and kept until it is written, so every
+	 * step of a command sees the same rows. Callers get their own
+	 * copies, to change as they like.
+	 */
+	if repo.versions == nil {
+		repo.versions = repo.parseVersionsTable()
+	}
+	for _, v := range repo.versions {
+		c := *v
+		versionsList = append(versionsList, &c)
 	}
-	defer outFile.Close()
+	return
+}
+
+func (repo *Repo) tableChanged() {
+	/* Call after writing the versions-table other than with writeToVersionsTable */
+	repo.versions = nil
+}
 
-	gzipReader, err := gzip.NewReader(inFile)
+func (repo *Repo) parseVersionsTable() []*Version {
+	versionsList := []*Version{}
+	repo.tableReads++
+	lines, err := readLines(repo.versionsTable)
 	if err != nil {
-		return err
+		fail(err)
 	}
-	defer gzipReader.Close()
 
-	if _, err := io.Copy(outFile, gzipReader); err != nil {
-		return err
+	/*
+	 * A bad row stops everything: skipping it could make undo or
+	 * update act on the wrong entry. Blank lines are ignored.
+	 */
+	schema := tableSchema(lines)
+	for i, line := range lines {
+		if isMarker(line) || strings.TrimSpace(line) == "" {
+			continue
+		}
+		v := new(Version)
+		if err := v.parse(line, schema); err != nil {
+			fail(integrityError("%s:%d: %v", repo.versionsTable, i+1, err))
+		}
+		versionsList = append(versionsList, v)
 	}
-	return nil
+	return versionsList
+}
+
+
+func (repo *Repo) writeToVersionsTable(v Version) {
+	/*
+	 * Version entry order:
+	 * DATE TIME LABEL VERSION ORIGFILE FILE AUTHOR ID NOTE SIZE PARENT MTIME HOST USER
+	 */
+	if err := appendLine(repo.versionsTable, joinFields(v.fields()...)); err != nil {
+		fail(err)
+	}
+	if repo.versions != nil {
+		repo.versions = append(repo.versions, &v)
+	}
+}
+
+var fieldEscaper = strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`, "\r", `\r`)
+var fieldUnescaper = strings.NewReplacer(`\\`, `\`, `\t`, "\t", `\n`, "\n", `\r`, "\r")
+
+func joinFields(fields ...string) string {
+	/*
+	 * Tables are tab-separated. Tabs, newlines and backslashes
+	 * inside a field are escaped so that names with spaces or
+	 * any other character survive a round trip.
+	 */
+	escaped := make([]string, len(fields))
+	for i, f := range fields {
+		escaped[i] = fieldEscaper.Replace(f)
+	}
+	return strings.Join(escaped, "\t")
+}
+
+func splitFields(line string) []string {
+	/*
+	 * Lines without a tab come from the old space-delimited
+	 * format, so they are split on whitespace as before.
+	 */
+	if !strings.Contains(line, "\t") {
+		return strings.Fields(line)
+	}
+
+	fields := strings.Split(line, "\t")
+	for i, f := range fields {
+		fields[i] = fieldUnescaper.Replace(f)
+	}
+	return fields
 }
 
+const DateFormat = "2006-01-02"
+
 func getDate() string {
 	date := time.Now()
-	return date.Format("2006-01-02")
+	return date.Format(DateFormat)
+}
+
+/*
+ * The TIME column holds seconds and the UTC offset, so that with
+ * DATE it makes an RFC 3339 timestamp. Entries written before, or
+ * with precision "minute", only have hour and minutes.
+ */
+var TimeFormats = map[string]string{
+	"second": "15:04:05Z07:00",
+	"minute": "15:04",
+}
+
+func getTime(precision string) string {
+	t := time.Now()
+	return t.Format(TimeFormats[precision])
+}
+
+func (v *Version) timestamp() (time.Time, error) {
+	/* Short times carry no offset, they are taken as local time */
+	for _, layout := range []string{TimeFormats["second"], TimeFormats["minute"]} {
+		if t, err := time.ParseInLocation(DateFormat+" "+layout, v.date+" "+v.time, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp %q", v.date+" "+v.time)
 }
 
-func getTime() string {
+
+func printRows(header string, rows [][]string) {
 	/*
-	 * This strange "15:04" is the golang way to
-	 * say hour and minutes, zero-padded
+	 * Align the columns like "column -t" does: each column is
+	 * as wide as its widest cell, separated by two spaces.
 	 */
-	t := time.Now()
-	return t.Format("15:04")
+	rows = append([][]string{strings.Fields(header)}, rows...)
+
+	var widths []int
+	for _, row := range rows {
+		for i, cell := range row {
+			if i == len(widths) {
+				widths = append(widths, 0)
+			}
+			widths[i] = max(widths[i], utf8.RuneCountInString(cell))
+		}
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	for _, row := range rows {
+		var line strings.Builder
+		for i, cell := range row {
+			line.WriteString(cell)
+			if i < len(row)-1 {
+				line.WriteString(strings.Repeat(" ", widths[i]-utf8.RuneCountInString(cell)+2))
+			}
+		}
+		fmt.Fprintln(w, strings.TrimRight(line.String(), " "))
+	}
 }
 
+/* Named templates for hist --format */
+var FormatPresets = map[string]string{
+	"short":   "{{.Label}} v{{.Version}} by {{.Author}} on {{.Date}}",
+	"oneline": "{{.Date}} {{.Time}} {{.Label}} {{.Version}} {{.File}} {{.Note}}",
+}
 
-func printColumns(header string, file string) {
-	cmd := exec.Command("column", "-t")
-	cmd.Stdout = os.Stdout
-	stdin, err := cmd.StdinPipe()
+func parseFormat(format string) (*template.Template, error) {
+	/*
+	 * The template gets a VersionRecord. Running it once on an
+	 * empty record catches references to fields that don't exist.
+	 */
+	if preset, ok := FormatPresets[format]; ok {
+		format = preset
+	}
+	tmpl, err := template.New("format").Parse(format)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("invalid --format: %v", err)
+	}
+	if err := tmpl.Execute(io.Discard, VersionRecord{}); err != nil {
+		return nil, fmt.Errorf("invalid --format: %v", err)
 	}
-	defer stdin.Close()
+	return tmpl, nil
+}
 
-	f, err := os.Open(file)
+func printJSON(v any) {
+	out, err := json.MarshalIndent(v, "", "  ")
 	if err != nil {
-		log.Fatal(err)
+		fail(err)
 	}
-	defer f.Close()
+	fmt.Println(string(out))
+}
+
+var stdin = bufio.NewReader(os.Stdin)
 
-	if err := cmd.Start(); err != nil {
-		log.Fatal(err)
+const MaxEmailAttempts = 3
+
+const MaxLabelAttempts = 3
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err == io.EOF && len(line) > 0 {
+		err = nil
 	}
+	return strings.TrimSpace(line), err
+}
 
-	scanner := bufio.NewScanner(f)
-	fmt.Fprintln(stdin, header)
-	for scanner.Scan() {
-		fmt.Fprintln(stdin, scanner.Text())
+func askAuthorEmail(r *bufio.Reader, authors []string) (string, error) {
+	/* A known author can be given by its number or its name before the @ */
+	for i, a := range authors {
+		fmt.Printf("  %d  %s\n", i+1, a)
 	}
+	for i := 0; i < MaxEmailAttempts; i++ {
+		fmt.Printf("Author email: ")
+		email, err := readLine(r)
+		if err == io.EOF {
+			return "", fmt.Errorf("no author email given")
+		}
+		if err != nil {
+			return "", err
+		}
+		if known := resolveAuthor(authors, email); known != "" {
+			return known, nil
+		}
+		if isValidEmail(email) {
+			return email, nil
+		}
+		fmt.Printf("Invalid email %q.\n", email)
+	}
+	return "", fmt.Errorf("no valid email after %d attempts", MaxEmailAttempts)
+}
+
+func pickLabel(r *bufio.Reader, labels []LabelRecord) (string, error) {
+	/* Pick a label by its number in the list, or by name */
+	if len(labels) == 0 {
+		return "", notFoundError("no labels yet, use %q first", "track")
+	}
+	for i, l := range labels {
+		fmt.Printf("  %d  %s\n", i+1, l.Label)
+	}
+	for i := 0; i < MaxLabelAttempts; i++ {
+		fmt.Printf("Label: ")
+		answer, err := readLine(r)
+		if err == io.EOF {
+			return "", usageError("no label given")
+		}
+		if err != nil {
+			return "", err
+		}
+		if n, err := strconv.Atoi(answer); err == nil && n >= 1 && n <= len(labels) {
+			return labels[n-1].Label, nil
+		}
+		for _, l := range labels {
+			if l.Label == answer {
+				return answer, nil
+			}
+		}
+		fmt.Printf("No such label %q.\n", answer)
+	}
+	return "", usageError("no label chosen after %d attempts", MaxLabelAttempts)
+}
+
+func resolveAuthor(authors []string, s string) string {
+	if n, err := strconv.Atoi(s); err == nil && n >= 1 && n <= len(authors) {
+		return authors[n-1]
+	}
+	var found string
+	for _, a := range authors {
+		name, _, _ := strings.Cut(a, "@")
+		if strings.EqualFold(a, s) {
+			return a
+		}
+		if strings.EqualFold(name, s) {
+			if found != "" {
+				/* Ambiguous, the full email is needed */
+				return ""
+			}
+			found = a
+		}
+	}
+	return found
+}
 
-	if err = scanner.Err(); err != nil {
-		fmt.Fprintln(os.Stderr, "reading file:", err)
+func (repo *Repo) readAuthors() []string {
+	lines, err := readLines(repo.authorsFile)
+	if err != nil && !os.IsNotExist(err) {
+		fail(err)
 	}
-	if err := stdin.Close(); err != nil {
-		log.Fatal(err)
+	var authors []string
+	for _, line := range lines {
+		if line = strings.TrimSpace(line); line != "" {
+			authors = append(authors, line)
+		}
+	}
+	return authors
+}
+
+func (repo *Repo) addAuthor(email string) error {
+	if !isValidEmail(email) {
+		return fmt.Errorf("invalid email %q", email)
 	}
-	if err := cmd.Wait(); err != nil {
-		log.Fatal(err)
+	/* The authors file is created with the first author */
+	authors := repo.readAuthors()
+	for _, a := range authors {
+		if strings.EqualFold(a, email) {
+			return fmt.Errorf("%s is already a known author", email)
+		}
 	}
+	return writeLines(repo.authorsFile, append(authors, email))
 }
 
-func askAuthorEmail() (email string) {
-	fmt.Printf("Author email: ")
-	_, err := fmt.Scan(&email)
+func (repo *Repo) authorEmail() (string, error) {
+	/*
+	 * The author comes from --author if given. With --yes nobody
+	 * may be there to answer, so use the configured author or fail.
+	 * Otherwise ask, offering the known authors, and offer to save
+	 * a new one.
+	 */
+	switch {
+	case authorFlag != "":
+		if !isValidEmail(authorFlag) {
+			return "", fmt.Errorf("invalid email %q", authorFlag)
+		}
+		return authorFlag, nil
+	case assumeYes && repo.config.author != "":
+		return repo.config.author, nil
+	case assumeYes:
+		return "", fmt.Errorf("no author email: use --author or set it with %q", "config author <email>")
+	}
+
+	authors := repo.readAuthors()
+	email, err := askAuthorEmail(stdin, authors)
 	if err != nil {
-		log.Fatal(err)
+		return "", err
+	}
+	if !slices.Contains(authors, email) && askYesNo(stdin, fmt.Sprintf("Save %s as a known author?", email)) {
+		if err := repo.addAuthor(email); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+	return email, nil
+}
+
+func isValidEmail(email string) bool {
+	/*
+	 * Not a full RFC 5322 check, just enough to catch typos:
+	 * something before the @, and a dot inside the domain.
+	 */
+	local, domain, ok := strings.Cut(email, "@")
+	if !ok || local == "" || strings.ContainsAny(email, " \t") {
+		return false
+	}
+	dot := strings.LastIndex(domain, ".")
+	return dot > 0 && dot < len(domain)-1
+}
+
+func printUpdate(label string, file string, email string, note string) {
+	inform("\n")
+	inform("Label: %s\n", label)
+	inform("File : %s\n", file)
+	inform("Email: %s\n", email)
+	if note != "" {
+		inform("Note : %s\n", note)
 	}
-	return
 }
 
+func askConfirmation(r *bufio.Reader, label string, file string, email string, note string) bool {
+	printUpdate(label, file, email, note)
+	return askYesNo(r, "Confirm update?")
+}
+
+func askNote(r *bufio.Reader) (string, error) {
+	/* The note on one line, for when there is no editor to write it in */
+	fmt.Print("Note (empty for none): ")
+	note, err := readLine(r)
+	if err == io.EOF {
+		err = nil
+	}
+	return note, err
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+func (repo *Repo) editor() string {
+	/* The editor for notes: config editor, else $VISUAL or $EDITOR; none for no editor */
+	switch repo.config.editor {
+	case "none":
+		return ""
+	case "":
+		if visual := os.Getenv("VISUAL"); visual != "" {
+			return visual
+		}
+		return os.Getenv("EDITOR")
+	}
+	return repo.config.editor
+}
+
+func (repo *Repo) editNote(label, file string) (string, error) {
+	/*
+	 * Like git commit without -m: write a template to a temporary
+	 * file, open the editor on it and read back what was saved,
+	 * without the comment lines.
+	 */
+	f, err := os.CreateTemp("", "msmanager-note-*.txt")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprintf(f, "\n# Note for the update of label %q with %s.\n", label, file)
+	fmt.Fprintf(f, "# Lines starting with # are left out, and an empty note aborts the update.\n")
+	if err := f.Close(); err != nil {
+		return "", err
+	}
 
+	/* Through the shell, so the editor can have arguments, like "code --wait" */
+	cmd := exec.Command("sh", "-c", repo.editor()+` "$@"`, "editor", f.Name())
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("editor %q: %w", repo.editor(), err)
+	}
 
-func askConfirmation(label string, file string, email string) bool {
-	fmt.Println()
-	fmt.Printf("Label: %s\n", label)
-	fmt.Printf("File : %s\n", file)
-	fmt.Printf("Email: %s\n", email)
-	fmt.Printf("Confirm update? (y/n): ")
+	data, err := os.ReadFile(f.Name())
+	if err != nil {
+		return "", err
+	}
+	var lines []string
+	for _, line := range strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n") {
+		if !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n")), nil
+}
 
-	var ans string
-	_, err := fmt.Scan(&ans)
+func (repo *Repo) readMessage(r *bufio.Reader) (email string, note string, err error) {
+	/*
+	 * Like a commit message given to git on stdin: the first line
+	 * is the author, a known one can be given by number or name,
+	 * and the lines after it are the note.
+	 */
+	data, err := io.ReadAll(r)
 	if err != nil {
-		log.Fatal(err)
+		return "", "", err
+	}
+	first, rest, _ := strings.Cut(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
+	email = strings.TrimSpace(first)
+	if known := resolveAuthor(repo.readAuthors(), email); known != "" {
+		email = known
+	}
+	if !isValidEmail(email) {
+		return "", "", fmt.Errorf("invalid author email %q on the first line of stdin", email)
+	}
+	return email, strings.TrimSpace(rest), nil
+}
+
+func inform(format string, a ...any) {
+	/* Informational output, left out with --quiet. Errors and data go on as before */
+	if !quiet {
+		fmt.Printf(format, a...)
+	}
+}
+
+/* Diagnostics for --verbose, on stderr with timestamps */
+var debugLog = log.New(io.Discard, "msmanager: ", log.LstdFlags|log.Lmicroseconds)
+
+func debugf(format string, a ...any) {
+	debugLog.Printf(format, a...)
+}
+
+func askYesNo(r *bufio.Reader, question string) bool {
+	if assumeYes {
+		return true
+	}
+	fmt.Printf("%s (y/n): ", question)
+
+	ans, err := readLine(r)
+	if err != nil && err != io.EOF {
+		fail(err)
 	}
 
 	if ans == "y" || ans == "yes" {
 		return true
-	} 
+	}
 	return false
 }
 
 
 
-func getLastVersionNumber(label string) (lastVersion int) {
-	versionsTable := readVersionsTable()
+func (repo *Repo) getLastVersionNumber(label string) (lastVersion int) {
+	versionsTable := repo.readVersionsTable()
 	for _, v := range versionsTable {
-		if v.label == "main" {
+		if v.label == label {
 			lastVersion = v.versionNumber
 		}
 	}
@@ -246,22 +841,64 @@ func getLastVersionNumber(label string) (lastVersion int) {
 }
 
 
-func (v *Version) parse(s string) {
+func (v *Version) parse(s string, schema int) error {
 	/*
 	 * Version entry order:
-	 * DATE TIME LABEL VERSION ORIGFILE FILE AUTHOR ID
+	 * DATE TIME LABEL VERSION ORIGFILE FILE AUTHOR ID NOTE SIZE PARENT MTIME HOST USER
+	 *
+	 * Entries written before notes, sizes, parents, mtimes, hosts and
+	 * users existed lack the last columns. An unknown one is "-".
+	 * Trailing spaces and the CR of files edited on Windows are ignored.
 	 */
 
-	r := strings.NewReader(s)
-	_, err := fmt.Fscanf(r, "%s %s %s %d %s %s %s %s",
-		&v.date, &v.time, &v.label, &v.versionNumber, &v.origFile, &v.file, &v.author, &v.id)
+	field := splitFields(strings.TrimRight(s, " \r"))
+	if schema < 2 && len(field) == 8 {
+		field = append(field, "")
+	}
+	for schema < 2 && len(field) >= 9 && len(field) < 11 {
+		field = append(field, "-")
+	}
+	if schema < 3 && len(field) == 11 {
+		field = append(field, "-")
+	}
+	if schema < 4 && len(field) == 12 {
+		field = append(field, "-", "-")
+	}
+	if len(field) != 14 {
+		return fmt.Errorf("expected 14 fields, got %d: %q", len(field), s)
+	}
+
+	n, err := strconv.Atoi(field[3])
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Fscanf: %v\n", err)
+		return fmt.Errorf("bad version number %q: %q", field[3], s)
 	}
+	size := int64(-1)
+	if field[9] != "-" {
+		if size, err = strconv.ParseInt(field[9], 10, 64); err != nil {
+			return fmt.Errorf("bad size %q: %q", field[9], s)
+		}
+	}
+
+	v.date, v.time, v.label, v.versionNumber = field[0], field[1], field[2], n
+	v.origFile, v.file, v.author, v.id, v.note = field[4], field[5], field[6], field[7], field[8]
+	v.size = size
+	v.parent = field[10]
+	if field[11] != "-" {
+		if v.mtime, err = time.Parse(time.RFC3339Nano, field[11]); err != nil {
+			return fmt.Errorf("bad mtime %q: %q", field[11], s)
+		}
+	}
+	if field[12] != "-" {
+		v.host = field[12]
+	}
+	if field[13] != "-" {
+		v.user = field[13]
+	}
+	return nil
 }
 
 
-func isLastVersionChanged(label string) (prevFile string, err error) {
+func (repo *Repo) isLastVersionChanged(label string) (prevFile string, err error) {
 	/*
 	 * Check if the file of the previous version is equal to the one archived.
 	 * This is done by comparing the sha1 of the file with the id of the archive.
@@ -269,47 +906,56 @@ func isLastVersionChanged(label string) (prevFile string, err error) {
 	 */
 
 	var prevID string
-	for _, v := range readVersionsTable() {
+	for _, v := range repo.readVersionsTable() {
 		if v.label == label {
 			prevID = v.id
 			prevFile = v.file
 		}
 	}
-	if prevFile == "none" {
-		return
+	if prevFile == "" || prevFile == "none" {
+		return "none", nil
 	}
 
-	if prevID != calculateSha1(prevFile) {
+	/* A previous version file that was deleted by hand comes back as fs.ErrNotExist */
+	sum, err := repo.inputSha1(label, repo.workPath(prevFile))
+	if err != nil {
+		return prevFile, err
+	}
+	debugf("previous version %s has id %s, archived as %s", prevFile, sum, prevID)
+	if prevID != sum {
 		err = fmt.Errorf("WARNING: %s is different from the archived version.", prevFile)
 	}
 	return
 }
 
 
-func restoreLastVersion(label string) {
-	var id string
-	var filename string
-	for _, version := range readVersionsTable() {
+func (repo *Repo) restoreLastVersion(label string) {
+	var last *Version
+	for _, version := range repo.readVersionsTable() {
 		if version.label == label {
-			id = version.id
-			filename = version.file
+			last = version
 		}
 	}
+	if last == nil || last.versionNumber == 0 {
+		inform("No previous version to restore.\n")
+		return
+	}
+	filename := last.file
 
-	compressed_file := filepath.Join(ArchivesDir, id) + ".gz"
-	if err := decompress(compressed_file, filename); err != nil {
-		log.Fatal(err)
+	debugf("inflate %s into %s", repo.archivePath(last.id), repo.workPath(filename))
+	if err := repo.inflateVersion(last, repo.workPath(filename)); err != nil {
+		fail(err)
 	}
-	fmt.Printf("Restore previous version: %s\n", filename)
+	inform("Restore previous version: %s\n", filename)
 	return
 }
 
-func removeLastLine(tableFile string) error {
+func readLines(tableFile string) ([]string, error) {
 	var lines []string
 
 	f, err := os.Open(tableFile)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer f.Close()
 
@@ -319,25 +965,241 @@ func removeLastLine(tableFile string) error {
 	}
 
 	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return lines, nil
+}
+
+func writeLines(tableFile string, lines []string) error {
+	/*
+	 * Write to a temporary file in the same directory and rename it
+	 * over tableFile, so a crash never leaves a half-written table.
+	 */
+	tmp, err := os.CreateTemp(filepath.Dir(tableFile), filepath.Base(tableFile)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	writer := bufio.NewWriter(tmp)
+	for _, line := range lines {
+		fmt.Fprintf(writer, "%s\n", line)
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), tableFile)
+}
+
+func appendLine(tableFile string, line string) error {
+	/*
+	 * Appending in place could leave half a line behind, so
+	 * rewrite the whole table through writeLines instead.
+	 */
+	lines, err := readLines(tableFile)
+	if err != nil {
+		return err
+	}
+	return writeLines(tableFile, append(lines, line))
+}
+
+func removeLastLine(tableFile string) error {
+	lines, err := readLines(tableFile)
+	if err != nil {
 		return err
 	}
 
-	if len(lines) == 0 {
+	if len(lines) == 0 || isMarker(lines[len(lines)-1]) {
 		return nil
 	}
+	return writeLines(tableFile, lines[:len(lines)-1])
+}
 
-	lines = lines[:len(lines)-1]
-	output, err := os.Create(tableFile)
+func editTable(tableFile string, edit func(field []string) []string) error {
+	/*
+	 * Rewrite tableFile replacing each row with what edit returns.
+	 * Rows for which edit returns nil are removed. Blank lines are dropped,
+	 * and the schema marker is kept as it is.
+	 */
+	lines, err := readLines(tableFile)
 	if err != nil {
 		return err
 	}
-	defer output.Close()
 
-	writer := bufio.NewWriter(output)
+	var edited []string
 	for _, line := range lines {
-		fmt.Fprintf(writer, "%s\n", line)
+		if isMarker(line) {
+			edited = append(edited, line)
+			continue
+		}
+		field := splitFields(line)
+		if len(field) == 0 {
+			continue
+		}
+		if field = edit(field); field != nil {
+			edited = append(edited, joinFields(field...))
+		}
 	}
-	writer.Flush()
-	return nil
+	return writeLines(tableFile, edited)
+}
+
+func filterTable(tableFile string, keep func(field []string) bool) error {
+	return editTable(tableFile, func(field []string) []string {
+		if !keep(field) {
+			return nil
+		}
+		return field
+	})
 }
 
+func (repo *Repo) findVersion(label string, number string) (*Version, error) {
+	/*
+	 * Look up a version of label by its number, or the
+	 * highest one if number is "latest".
+	 */
+	var found *Version
+	for _, v := range repo.readVersionsTable() {
+		if v.label != label || v.versionNumber == 0 {
+			continue
+		}
+		if number == "latest" {
+			if found == nil || v.versionNumber > found.versionNumber {
+				found = v
+			}
+		} else if strconv.Itoa(v.versionNumber) == number {
+			found = v
+		}
+	}
+
+	if found == nil {
+		if _, ok := repo.readLabelsMap()[label]; !ok {
+			return nil, notFoundError("no such label %q", label)
+		}
+		if number == "latest" {
+			return nil, notFoundError("label %q has no versions yet", label)
+		}
+		return nil, notFoundError("label %q has no version %s", label, number)
+	}
+	return found, nil
+}
+
+func (repo *Repo) lookupVersion(args []string) (*Version, error) {
+	/* A version is given by its ID, or by label and version number (or "latest") */
+	if len(args) == 2 {
+		return repo.findVersion(args[0], args[1])
+	}
+	if !isSha1(args[0]) {
+		return nil, usageError("%q is not a valid ID", args[0])
+	}
+	for _, v := range repo.readVersionsTable() {
+		if v.id == args[0] {
+			return v, nil
+		}
+	}
+	return nil, notFoundError("unable to find ID %s", args[0])
+}
+
+func isSha1(s string) bool {
+	if len(s) != 40 {
+		return false
+	}
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
+
+func (repo *Repo) workPath(file string) string {
+	/* Version files live in the repository root, next to the data directory */
+	return filepath.Join(repo.root, file)
+}
+
+func (repo *Repo) freeName(file string) string {
+	return freePath(file, repo.workPath)
+}
+
+func freePath(file string, path func(string) string) string {
+	/*
+	 * file, or if something is there already the first of
+	 * name.undo.ext, name.undo2.ext... that is free, looked
+	 * up at path(name).
+	 */
+	dir := strings.HasSuffix(file, "/")
+	file = strings.TrimSuffix(file, "/")
+	name := file
+	for n := 1; ; n++ {
+		if _, err := os.Lstat(path(name)); os.IsNotExist(err) {
+			break
+		}
+		ext := filepath.Ext(file)
+		if dir {
+			ext = ""
+		}
+		suffix := ".undo"
+		if n > 1 {
+			suffix += strconv.Itoa(n)
+		}
+		name = strings.TrimSuffix(file, ext) + suffix + ext
+	}
+	if dir {
+		name += "/"
+	}
+	return name
+}
+
+func (repo *Repo) contains(path string) (bool, error) {
+	/* Tell if path is inside the repository root */
+	root, err := filepath.Abs(repo.root)
+	if err != nil {
+		return false, err
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return false, err
+	}
+	rel, err := filepath.Rel(root, abs)
+	return err == nil && filepath.IsLocal(rel), nil
+}
+
+func parseArgs(fs *flag.FlagSet, args []string) []string {
+	/*
+	 * The flag package stops at the first positional argument.
+	 * Parse again after each one so flags can go anywhere,
+	 * as in "restore <id> --force". A "--" ends flag parsing.
+	 */
+	var positional []string
+	for {
+		fs.Parse(args)
+		rest := fs.Args()
+		if len(rest) == 0 {
+			break
+		}
+		if n := len(args) - len(rest); n > 0 && args[n-1] == "--" {
+			positional = append(positional, rest...)
+			break
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+	return positional
+}
+
+func provenance() (host, username string) {
+	/* The machine and account a version is made on, empty if unknown */
+	host, _ = os.Hostname()
+	if u, err := user.Current(); err == nil {
+		username = u.Username
+	}
+	return host, username
+}
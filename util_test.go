@@ -0,0 +1,531 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadLabelsMapSkipsMalformedLines(t *testing.T) {
+	dir := newTestRepo(t)
+	repo := openTestRepo(t, dir)
+	writeFile(t, repo.labelsTable, schemaMarker()+"\nA\ta\ntruncated\nB\tb\n\n")
+
+	labels := repo.readLabelsMap()
+	if len(labels) != 2 || labels["A"] != "a" || labels["B"] != "b" {
+		t.Errorf("got %v, want A and B", labels)
+	}
+
+	/* And the commands still work on such a table, telling what they skip */
+	r := run(t, dir, "", "labels")
+	if r.code != ExitOK || !strings.Contains(r.stdout, "A") || !strings.Contains(r.stdout, "B") {
+		t.Errorf("labels: exit %d\n%s", r.code, r.stdout)
+	}
+	if !strings.Contains(r.stderr, `malformed line "truncated"`) {
+		t.Errorf("truncated line not reported: %q", r.stderr)
+	}
+}
+
+func TestJoinSplitFields(t *testing.T) {
+	fields := []string{"Chapter One.docx", "tab\there", "new\nline", `back\slash`, "ünïcode", ""}
+	got := splitFields(joinFields(fields...))
+	if strings.Join(got, "|") != strings.Join(fields, "|") {
+		t.Errorf("round trip: got %q, want %q", got, fields)
+	}
+}
+
+func TestAskAuthorEmail(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+		ok    bool
+	}{
+		{"jane@example.com\n", "jane@example.com", true},
+		{"\nnot-an-email\njane@example.com\n", "jane@example.com", true},
+		{"\n\nnope\njane@example.com\n", "", false},
+		{"jane@localhost\n", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		got, err := askAuthorEmail(bufio.NewReader(strings.NewReader(tt.input)), nil)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("input %q: got %q, %v", tt.input, got, err)
+		}
+	}
+}
+
+func TestIsValidEmail(t *testing.T) {
+	for email, ok := range map[string]bool{
+		"jane@example.com":  true,
+		"j.d@lab.uni.edu":   true,
+		"":                  false,
+		"@example.com":      false,
+		"jane@example":      false,
+		"jane@example.":     false,
+		"ja ne@example.com": false,
+	} {
+		if isValidEmail(email) != ok {
+			t.Errorf("isValidEmail(%q) = %v", email, !ok)
+		}
+	}
+}
+
+func TestPrintRows(t *testing.T) {
+	out := captureStdout(t, func() {
+		printRows("LABEL VERSION FILE", [][]string{
+			{"a", "1", "a_1.txt"},
+			{"nature-submission", "12", "n.txt"},
+			{"ñandú", "3", "x"},
+		})
+	})
+	want := "LABEL              VERSION  FILE\n" +
+		"a                  1        a_1.txt\n" +
+		"nature-submission  12       n.txt\n" +
+		"ñandú              3        x\n"
+	if out != want {
+		t.Errorf("got\n%s\nwant\n%s", out, want)
+	}
+
+	/* Short rows and empty last cells leave no trailing spaces */
+	out = captureStdout(t, func() { printRows("A B", [][]string{{"long-cell"}, {"x", ""}}) })
+	if want := "A          B\nlong-cell\nx\n"; out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+func TestFailedWriteKeepsTable(t *testing.T) {
+	/*
+	 * Run rename with a file size limit below the size of the
+	 * versions-table, so writing the new table fails halfway.
+	 */
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	writeFile(t, filepath.Join(dir, "a.txt"), "one\n")
+	msm(t, dir, "--author", testAuthor, "--yes", "update", "-m", strings.Repeat("long note ", 2000), "paper", "a.txt")
+	repo := openTestRepo(t, dir)
+	before := readFile(t, repo.versionsTable)
+
+	cmd := exec.Command("sh", "-c", `ulimit -f 8 && exec "$0" rename paper draft`, os.Args[0])
+	cmd.Dir = dir
+	cmd.Env = testEnv()
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Fatalf("rename wrote a table past the file size limit:\n%s", out)
+	}
+
+	if got := readFile(t, repo.versionsTable); got != before {
+		t.Errorf("the versions-table changed after a failed write")
+	}
+	if labels := repo.readLabelsMap(); labels["paper"] != "paper" {
+		t.Errorf("labels after a failed rename: %v", labels)
+	}
+	entries, _ := os.ReadDir(repo.dataDir)
+	for _, e := range entries {
+		if strings.Contains(e.Name(), ".tmp") {
+			t.Errorf("temporary file %s left behind", e.Name())
+		}
+	}
+	msm(t, dir, "latest", "paper")
+}
+
+func TestTimestamps(t *testing.T) {
+	/* Old rows have the local time to the minute, new ones to the second with an offset */
+	for _, tt := range []struct {
+		line   string
+		schema int
+		want   time.Time
+	}{
+		{"2024-03-05\t14:07\tpaper\t1\ta.txt\tpaper_1_FD.txt\ta@b.co\tid", 1, time.Date(2024, 3, 5, 14, 7, 0, 0, time.Local)},
+		{"2024-03-05\t14:07:09+02:00\tpaper\t1\ta.txt\tpaper_1_FD.txt\ta@b.co\tid\tnote\t3\tnone\t-\t-\t-", SchemaVersion, time.Date(2024, 3, 5, 12, 7, 9, 0, time.UTC)},
+		{"2024-03-05\t14:07:09Z\tpaper\t1\ta.txt\tpaper_1_FD.txt\ta@b.co\tid\tnote\t3\tnone\t-\t-\t-", SchemaVersion, time.Date(2024, 3, 5, 14, 7, 9, 0, time.UTC)},
+	} {
+		var v Version
+		if err := v.parse(tt.line, tt.schema); err != nil {
+			t.Fatalf("parse %q: %v", tt.line, err)
+		}
+		got, err := v.timestamp()
+		if err != nil || !got.Equal(tt.want) {
+			t.Errorf("timestamp of %s %s: %v, %v, want %v", v.date, v.time, got, err, tt.want)
+		}
+	}
+
+	var v Version
+	if err := v.parse("2024-03-05\t2pm\tpaper\t1\ta.txt\tpaper_1_FD.txt\ta@b.co\tid", 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.timestamp(); err == nil {
+		t.Errorf("timestamp of %q did not fail", v.time)
+	}
+}
+
+func TestRapidUpdatesHaveDistinctTimes(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+
+	/* Both updates fall in the same minute, where times to the minute would be equal */
+	now := time.Now()
+	if now.Second() > 55 {
+		time.Sleep(time.Until(now.Truncate(time.Minute).Add(time.Minute)))
+	}
+	update(t, dir, "paper", "a.txt", "one\n")
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+	update(t, dir, "paper", "a.txt", "two\n")
+
+	v := versionsOf(t, dir, "paper")
+	if v[0].Time == v[1].Time || v[0].Timestamp == v[1].Timestamp {
+		t.Errorf("two updates a second apart have the same time: %s %s", v[0].Time, v[1].Time)
+	}
+	if _, err := time.Parse(time.RFC3339, v[1].Timestamp); err != nil {
+		t.Errorf("timestamp %q: %v", v[1].Timestamp, err)
+	}
+	if !strings.HasSuffix(v[1].Time, "Z") && !strings.ContainsAny(v[1].Time, "+-") {
+		t.Errorf("time %q has no offset", v[1].Time)
+	}
+}
+
+func TestResolveAuthor(t *testing.T) {
+	authors := []string{"jane@example.com", "john@example.com", "jane@other.org"}
+	for _, tt := range []struct{ in, want string }{
+		{"1", "jane@example.com"},
+		{"3", "jane@other.org"},
+		{"4", ""},
+		{"0", ""},
+		{"john", "john@example.com"},
+		{"JOHN@example.com", "john@example.com"},
+		{"jane", ""},
+		{"jane@other.org", "jane@other.org"},
+		{"nobody", ""},
+	} {
+		if got := resolveAuthor(authors, tt.in); got != tt.want {
+			t.Errorf("resolveAuthor(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+
+	got, err := askAuthorEmail(bufio.NewReader(strings.NewReader("2\n")), authors)
+	if err != nil || got != "john@example.com" {
+		t.Errorf("askAuthorEmail with 2: %q, %v", got, err)
+	}
+}
+
+func TestAddAuthor(t *testing.T) {
+	dir := newTestRepo(t)
+	msm(t, dir, "config", "author", "add", "jane@example.com")
+	msm(t, dir, "config", "author", "add", "john@example.com")
+	msmFails(t, dir, ExitError, "config", "author", "add", "JANE@example.com")
+	msmFails(t, dir, ExitError, "config", "author", "add", "not-an-email")
+	repo := openTestRepo(t, dir)
+	if got := repo.readAuthors(); !slices.Equal(got, []string{"jane@example.com", "john@example.com"}) {
+		t.Errorf("authors %q", got)
+	}
+
+	/* A new author typed at the prompt is saved if asked to */
+	withStdin(t, "new@example.com\ny\n")
+	withQuiet(t)
+	captureStdout(t, func() {
+		if email, err := repo.authorEmail(); err != nil || email != "new@example.com" {
+			t.Errorf("authorEmail: %q, %v", email, err)
+		}
+	})
+	if got := repo.readAuthors(); !slices.Contains(got, "new@example.com") {
+		t.Errorf("the new author was not saved: %q", got)
+	}
+	withStdin(t, "2\n")
+	captureStdout(t, func() {
+		if email, err := repo.authorEmail(); err != nil || email != "john@example.com" {
+			t.Errorf("authorEmail by number: %q, %v", email, err)
+		}
+	})
+}
+
+func TestReadMessage(t *testing.T) {
+	dir := newTestRepo(t)
+	repo := openTestRepo(t, dir)
+	if err := repo.addAuthor("jane@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		input, email, note string
+		ok                 bool
+	}{
+		{"john@example.com\nfixed the intro\n", "john@example.com", "fixed the intro", true},
+		{"john@example.com\r\nfirst line\r\nsecond line\r\n", "john@example.com", "first line\nsecond line", true},
+		{"  john@example.com  \n", "john@example.com", "", true},
+		{"1\nby number\n", "jane@example.com", "by number", true},
+		{"jane\nby name\n", "jane@example.com", "by name", true},
+		{"fixed the intro\njohn@example.com\n", "", "", false},
+		{"", "", "", false},
+	} {
+		email, note, err := repo.readMessage(bufio.NewReader(strings.NewReader(tt.input)))
+		if (err == nil) != tt.ok || email != tt.email || note != tt.note {
+			t.Errorf("input %q: %q, %q, %v", tt.input, email, note, err)
+		}
+	}
+}
+
+func TestParseVersion(t *testing.T) {
+	row := joinFields("2024-03-05", "14:07:09Z", "paper", "2", "a.txt", "paper_2_FD.txt", "a@b.co", "id", "a note", "3", "parent", "-", "-", "-")
+	for _, line := range []string{row, row + "\r", row + "  ", row + " \r"} {
+		var v Version
+		if err := v.parse(line, SchemaVersion); err != nil {
+			t.Errorf("parse %q: %v", line, err)
+		} else if v.user != "" || v.versionNumber != 2 || v.note != "a note" || v.size != 3 {
+			t.Errorf("parse %q: %+v", line, v)
+		}
+	}
+
+	for _, line := range []string{
+		joinFields("2024-03-05", "14:07:09Z", "paper", "2", "a.txt"),
+		strings.Replace(row, "\t2\t", "\ttwo\t", 1),
+		strings.Replace(row, "\t3\t", "\tbig\t", 1),
+		row + "\textra",
+	} {
+		var v Version
+		err := v.parse(line, SchemaVersion)
+		if err == nil || !strings.Contains(err.Error(), strconv.Quote(line)) {
+			t.Errorf("parse %q: %v", line, err)
+		}
+	}
+}
+
+func TestBadRowStopsReading(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	update(t, dir, "paper", "a.txt", "one\n")
+	repo := openTestRepo(t, dir)
+
+	/* CRLF line endings, as from an editor on Windows, read fine */
+	table := readFile(t, repo.versionsTable)
+	writeFile(t, repo.versionsTable, strings.ReplaceAll(table, "\n", "\r\n"))
+	if v := versionsOf(t, dir, "paper"); len(v) != 1 || strings.ContainsRune(v[0].User, '\r') {
+		t.Errorf("rows with CRLF: %+v", v)
+	}
+
+	/* A short row is an error naming the line, not a half-read version */
+	writeFile(t, repo.versionsTable, table+"2024-03-05\t14:07\tpaper\t2\n")
+	r := msmFails(t, dir, ExitIntegrity, "hist")
+	if !strings.Contains(r.stderr, "versions-table:4:") || !strings.Contains(r.stderr, "expected 14 fields, got 4") {
+		t.Errorf("hist with a short row: %s", r.stderr)
+	}
+	if r := run(t, dir, "", "--author", testAuthor, "--yes", "update", "paper", "a.txt"); r.code != ExitIntegrity {
+		t.Errorf("update with a short row: exit %d\n%s", r.code, r.stderr)
+	}
+}
+
+func TestPickLabel(t *testing.T) {
+	labels := []LabelRecord{{Label: "paper"}, {Label: "thesis"}, {Label: "grant"}}
+	for _, tt := range []struct {
+		input, want string
+		ok          bool
+	}{
+		{"2\n", "thesis", true},
+		{"grant\n", "grant", true},
+		{"7\nnope\n1\n", "paper", true},
+		{"0\nx\ny\n", "", false},
+		{"", "", false},
+	} {
+		var got string
+		var err error
+		captureStdout(t, func() { got, err = pickLabel(bufio.NewReader(strings.NewReader(tt.input)), labels) })
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("input %q: %q, %v", tt.input, got, err)
+		}
+	}
+	if _, err := pickLabel(bufio.NewReader(strings.NewReader("1\n")), nil); exitCode(err) != ExitNotFound {
+		t.Errorf("pickLabel with no labels: %v", err)
+	}
+}
+
+func TestUpdateReadsTableOnce(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	update(t, dir, "paper", "a.txt", "one\n")
+	update(t, dir, "paper", "b.txt", "two\n")
+	writeFile(t, filepath.Join(dir, "c.txt"), "three\n")
+	repo := openTestRepo(t, dir)
+
+	savedYes, savedAuthor := assumeYes, authorFlag
+	assumeYes, authorFlag = true, testAuthor
+	t.Cleanup(func() { assumeYes, authorFlag = savedYes, savedAuthor })
+	t.Chdir(dir)
+
+	withQuiet(t)
+	updateLabel(repo, []string{"msmanager", "update", "paper", "c.txt"})
+	if repo.tableReads != 1 {
+		t.Errorf("update read the versions-table %d times", repo.tableReads)
+	}
+	if v := versionsOf(t, dir, "paper"); len(v) != 3 || v[2].OrigFile != "c.txt" {
+		t.Errorf("paper after the update: %+v", v)
+	}
+}
+
+func BenchmarkReadVersionsTable(b *testing.B) {
+	/* A table of ten thousand rows, read from disk and from memory */
+	dir := b.TempDir()
+	repo := newRepo(dir, dir)
+	var lines []string
+	for i := range 10000 {
+		v := Version{date: "2024-01-02", time: "03:04:05", label: "label" + strconv.Itoa(i%100),
+			versionNumber: i/100 + 1, origFile: "in.tex", file: "out.tex", author: testAuthor,
+			id: strings.Repeat("0", 40), note: "a note", size: 1234, mtime: time.Unix(0, 0)}
+		lines = append(lines, joinFields(v.fields()...))
+	}
+	if err := os.WriteFile(repo.versionsTable, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("disk", func(b *testing.B) {
+		for range b.N {
+			repo.tableChanged()
+			repo.readVersionsTable()
+		}
+	})
+	b.Run("memory", func(b *testing.B) {
+		for range b.N {
+			repo.readVersionsTable()
+		}
+	})
+}
+
+func TestEditNote(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	writeFile(t, filepath.Join(dir, "a.txt"), "one\n")
+	scripts := t.TempDir()
+	seen := filepath.Join(scripts, "seen")
+	editor := func(name, body string) string {
+		t.Helper()
+		path := filepath.Join(scripts, name)
+		writeFile(t, path, "#!/bin/sh\ncp \"$1\" "+seen+"\n"+body+"\n")
+		if err := os.Chmod(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	writes := editor("writes", `printf 'Fixed the typo\n\nin the abstract\n' >> "$1"`)
+	leaves := editor("leaves", "true")
+	fails := editor("fails", "exit 3")
+
+	/* Run with stdin a terminal, which /dev/null passes for */
+	onTerminal := func(env []string, args ...string) result {
+		t.Helper()
+		tty, err := os.Open(os.DevNull)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tty.Close()
+		cmd := exec.Command(os.Args[0], args...)
+		cmd.Dir = dir
+		cmd.Env = append(testEnv(), env...)
+		cmd.Stdin = tty
+		var stdout, stderr strings.Builder
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		err = cmd.Run()
+		code := ExitOK
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			code = exitErr.ExitCode()
+		}
+		return result{stdout.String(), stderr.String(), code}
+	}
+	args := []string{"--author", testAuthor, "update", "paper", "a.txt"}
+
+	/* A note left empty aborts, and one the editor fails on too */
+	r := onTerminal([]string{"EDITOR=" + leaves}, args...)
+	if r.code != ExitError || !strings.Contains(r.stderr, "empty note, update aborted") {
+		t.Errorf("update with the note left empty: exit %d\n%s", r.code, r.stderr)
+	}
+	if got := readFile(t, seen); !strings.Contains(got, `# Note for the update of label "paper" with a.txt.`) {
+		t.Errorf("the editor was given %q", got)
+	}
+	r = onTerminal([]string{"EDITOR=" + fails}, args...)
+	if r.code != ExitError || !strings.Contains(r.stderr, "exit status 3") {
+		t.Errorf("update with a failing editor: exit %d\n%s", r.code, r.stderr)
+	}
+
+	/* The config editor goes before $EDITOR, and none is no editor */
+	msm(t, dir, "config", "editor", leaves)
+	if r := onTerminal([]string{"EDITOR=" + fails}, args...); !strings.Contains(r.stderr, "empty note") {
+		t.Errorf("update with config editor: exit %d\n%s", r.code, r.stderr)
+	}
+	msm(t, dir, "config", "editor", "none")
+	os.Remove(seen)
+	if onTerminal([]string{"EDITOR=" + fails}, args...); exists(seen) {
+		t.Errorf("update with config editor none ran an editor")
+	}
+	if v := versionsOf(t, dir, "paper"); len(v) != 0 {
+		t.Errorf("versions after the aborted updates: %+v", v)
+	}
+	msm(t, dir, "config", "editor", "")
+
+	/* What the editor saves is the note, without the comments */
+	repo := openTestRepo(t, dir)
+	tty, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tty.Close()
+	savedStdin, savedAuthor := os.Stdin, authorFlag
+	os.Stdin, authorFlag = tty, testAuthor
+	t.Cleanup(func() { os.Stdin, authorFlag = savedStdin, savedAuthor })
+	t.Setenv("EDITOR", writes)
+	t.Chdir(dir)
+	withStdin(t, "y\n")
+	captureStdout(t, func() { updateLabel(repo, []string{"msmanager", "update", "paper", "a.txt"}) })
+	if v := versionsOf(t, dir, "paper"); len(v) != 1 || v[0].Note != "Fixed the typo\n\nin the abstract" {
+		t.Errorf("versions after an update with the editor: %+v", v)
+	}
+}
+
+func TestAskNote(t *testing.T) {
+	dir := newTestRepo(t)
+	track(t, dir, "paper", "paper")
+	writeFile(t, filepath.Join(dir, "a.txt"), "one\n")
+	writeFile(t, filepath.Join(dir, "b.txt"), "two\n")
+	repo := openTestRepo(t, dir)
+
+	/* On a terminal and with no editor, the note is asked for on one line */
+	tty, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tty.Close()
+	savedStdin, savedAuthor := os.Stdin, authorFlag
+	os.Stdin, authorFlag = tty, testAuthor
+	t.Cleanup(func() { os.Stdin, authorFlag = savedStdin, savedAuthor })
+	t.Setenv("VISUAL", "")
+	t.Setenv("EDITOR", "")
+	t.Chdir(dir)
+	withStdin(t, "Fixed the typo\ny\n")
+	out := captureStdout(t, func() { updateLabel(repo, []string{"msmanager", "update", "paper", "a.txt"}) })
+	if !strings.Contains(out, "Note (empty for none): ") {
+		t.Errorf("update without an editor did not ask for the note:\n%s", out)
+	}
+	if v := versionsOf(t, dir, "paper"); len(v) != 1 || v[0].Note != "Fixed the typo" {
+		t.Errorf("versions after an update with the note asked: %+v", v)
+	}
+
+	/* Unlike with the editor, an empty one is no note */
+	withStdin(t, "\ny\n")
+	captureStdout(t, func() { updateLabel(repo, []string{"msmanager", "update", "paper", "b.txt"}) })
+	if v := versionsOf(t, dir, "paper"); len(v) != 2 || v[1].Note != "" {
+		t.Errorf("versions after an update with no note: %+v", v)
+	}
+}
+
+func TestEditorVisual(t *testing.T) {
+	repo := openTestRepo(t, newTestRepo(t))
+	t.Setenv("VISUAL", "vi")
+	t.Setenv("EDITOR", "ed")
+	if got := repo.editor(); got != "vi" {
+		t.Errorf("editor with $VISUAL and $EDITOR: %q", got)
+	}
+	t.Setenv("VISUAL", "")
+	if got := repo.editor(); got != "ed" {
+		t.Errorf("editor with $EDITOR only: %q", got)
+	}
+}